@@ -0,0 +1,106 @@
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// auditLog writes what is typed in a terminal, and optionally what it prints,
+// to a plain text file with one timestamped line per chunk:
+//
+//	2006-01-02T15:04:05.000Z07:00 sid=<sid> pid=<pid> in "ls -l\r"
+type auditLog struct {
+	mu     sync.Mutex
+	f      *os.File
+	sid    string
+	pid    int
+	output bool
+	closed bool
+}
+
+// newAuditLog returns nil when auditing is off
+func (cli *RttyClient) newAuditLog(sid string, term *Terminal) (*auditLog, error) {
+	if cli.cfg.auditDir == "" {
+		return nil, nil
+	}
+
+	return newAuditLog(cli.cfg.auditDir, cli.cfg.id, sid, term, cli.cfg.auditOutput)
+}
+
+func newAuditLog(dir, devid, sid string, term *Terminal, output bool) (*auditLog, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	name := fmt.Sprintf("%s-%s-%s.log", devid, time.Now().Format("20060102-150405"), sid)
+
+	f, err := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &auditLog{
+		f:      f,
+		sid:    sid,
+		pid:    term.Pid(),
+		output: output,
+	}
+
+	a.write("start", term.backend)
+
+	return a, nil
+}
+
+func (a *auditLog) input(data []byte) {
+	a.write("in", string(data))
+}
+
+func (a *auditLog) recordOutput(data []byte) {
+	if a != nil && a.output {
+		a.write("out", string(data))
+	}
+}
+
+// A nil audit log logs nothing
+func (a *auditLog) write(event, data string) {
+	if a == nil {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.closed {
+		return
+	}
+
+	fmt.Fprintf(a.f, "%s sid=%s pid=%d %s %q\n",
+		time.Now().Format("2006-01-02T15:04:05.000Z07:00"), a.sid, a.pid, event, data)
+}
+
+func (a *auditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+
+	a.write("end", "")
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.closed {
+		return nil
+	}
+
+	a.closed = true
+
+	return a.f.Close()
+}
@@ -0,0 +1,30 @@
+//go:build linux
+// +build linux
+
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// bindToInterface makes the connection leave through iface whatever the
+// routing table says, which needs CAP_NET_RAW.
+func bindToInterface(d *net.Dialer, iface string) error {
+	d.Control = func(network, address string, c syscall.RawConn) error {
+		var err error
+
+		c.Control(func(fd uintptr) {
+			err = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, iface)
+		})
+
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,37 @@
+//go:build !linux
+// +build !linux
+
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// bindToInterface binds the connection to the first address of iface, since
+// there is no portable way to bind a socket to a device.
+func bindToInterface(d *net.Dialer, iface string) error {
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return err
+	}
+
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return err
+	}
+
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.IsGlobalUnicast() {
+			d.LocalAddr = &net.TCPAddr{IP: ipnet.IP}
+			return nil
+		}
+	}
+
+	return fmt.Errorf("no usable address on interface %s", iface)
+}
@@ -0,0 +1,49 @@
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/traditionalchinese"
+	"golang.org/x/text/transform"
+)
+
+// Charsets terminals may use instead of UTF-8, the web terminal only speaks UTF-8
+var charsets = map[string]encoding.Encoding{
+	"gbk":          simplifiedchinese.GBK,
+	"gb18030":      simplifiedchinese.GB18030,
+	"big5":         traditionalchinese.Big5,
+	"latin1":       charmap.ISO8859_1,
+	"iso-8859-1":   charmap.ISO8859_1,
+	"windows-1252": charmap.Windows1252,
+}
+
+func lookupCharset(name string) (encoding.Encoding, error) {
+	enc, ok := charsets[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("unsupported charset '%s', must be one of %s",
+			name, strings.Join(slices.Sorted(maps.Keys(charsets)), ", "))
+	}
+
+	return enc, nil
+}
+
+// transcode converts what the terminal prints from enc to UTF-8, and what is
+// typed from UTF-8 to enc. Characters enc lacks are replaced.
+func transcode(term *Terminal, enc encoding.Encoding) (io.Reader, io.Writer) {
+	r := transform.NewReader(term, enc.NewDecoder())
+	w := transform.NewWriter(term, encoding.ReplaceUnsupported(enc.NewEncoder()))
+
+	return r, w
+}
@@ -0,0 +1,167 @@
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// OSC 52 lets a program set, or ask for, the clipboard of the web terminal
+var osc52 = []byte("\x1b]52;")
+
+// clipboardFilter drops the OSC 52 sequences in what the terminal prints, all
+// of them or only those larger than max. Dropping the requests too means the
+// web terminal never answers with what is in its clipboard.
+type clipboardFilter struct {
+	r   io.Reader
+	max int // Largest sequence let through, -1 lets none
+	err error
+
+	// A sequence, or what may be the start of one, waiting for the rest
+	pending []byte
+	// Inside a sequence being dropped
+	drop bool
+	out  []byte
+}
+
+func checkClipboardConfig(cfg *Config) error {
+	switch cfg.clipboard {
+	case "allow", "strip":
+		return nil
+	default:
+		return fmt.Errorf("invalid clipboard: %s, must be one of allow, strip", cfg.clipboard)
+	}
+}
+
+// newClipboardFilter returns r unchanged when all clipboard sequences may pass
+func newClipboardFilter(r io.Reader, cfg *Config) io.Reader {
+	f := &clipboardFilter{r: r, max: -1}
+
+	if cfg.clipboard == "allow" {
+		if cfg.clipboardMaxSize == 0 {
+			return r
+		}
+		f.max = int(cfg.clipboardMaxSize) * 1024
+	}
+
+	return f
+}
+
+func (f *clipboardFilter) Read(b []byte) (int, error) {
+	for len(f.out) == 0 {
+		if f.err != nil {
+			return 0, f.err
+		}
+
+		n, err := f.r.Read(b)
+		f.out = f.filter(b[:n])
+		f.err = err
+
+		// What is left at the end can't be completed anymore
+		if err != nil && !f.drop && !bytes.HasPrefix(f.pending, osc52) {
+			f.out = append(f.out, f.pending...)
+			f.pending = nil
+		}
+	}
+
+	n := copy(b, f.out)
+	f.out = f.out[n:]
+
+	return n, nil
+}
+
+func (f *clipboardFilter) filter(data []byte) []byte {
+	var out []byte
+
+	f.pending = append(f.pending, data...)
+
+	for len(f.pending) > 0 {
+		if f.drop {
+			end, ok := oscEnd(f.pending)
+			if !ok {
+				// Hold a trailing ESC, it may begin the terminator
+				if f.pending[len(f.pending)-1] == 0x1b {
+					f.pending = f.pending[len(f.pending)-1:]
+				} else {
+					f.pending = f.pending[:0]
+				}
+				break
+			}
+
+			f.pending = f.pending[end:]
+			f.drop = false
+			continue
+		}
+
+		i := bytes.Index(f.pending, osc52)
+		if i < 0 {
+			n := len(f.pending) - partialPrefix(f.pending, osc52)
+			out = append(out, f.pending[:n]...)
+			f.pending = f.pending[n:]
+			break
+		}
+
+		out = append(out, f.pending[:i]...)
+		f.pending = f.pending[i:]
+
+		end, ok := oscEnd(f.pending[len(osc52):])
+		if !ok {
+			// No need to wait for the rest of what will be dropped anyway
+			if len(f.pending) > f.max {
+				f.pending = f.pending[len(osc52):]
+				f.drop = true
+				continue
+			}
+			break
+		}
+
+		end += len(osc52)
+
+		if end <= f.max {
+			out = append(out, f.pending[:end]...)
+		}
+
+		f.pending = f.pending[end:]
+	}
+
+	// Don't keep what was read into the buffer of the caller
+	f.pending = bytes.Clone(f.pending)
+
+	return out
+}
+
+// oscEnd returns where the OSC sequence at the start of b ends. It's ended by
+// BEL or ST, and cut short by any other escape sequence, which is kept.
+func oscEnd(b []byte) (int, bool) {
+	for i, c := range b {
+		switch c {
+		case 0x07:
+			return i + 1, true
+		case 0x1b:
+			if i+1 == len(b) {
+				return 0, false
+			}
+			if b[i+1] == '\\' {
+				return i + 2, true
+			}
+			return i, true
+		}
+	}
+
+	return 0, false
+}
+
+// partialPrefix returns the length of the longest end of b that begins prefix
+func partialPrefix(b, prefix []byte) int {
+	for n := min(len(b), len(prefix)-1); n > 0; n-- {
+		if bytes.HasSuffix(b, prefix[:n]) {
+			return n
+		}
+	}
+	return 0
+}
@@ -9,9 +9,12 @@ import (
 	"bytes"
 	"context"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"os"
 	"os/exec"
 	"os/user"
+	"path/filepath"
 	"strings"
 	"time"
 
@@ -22,6 +25,7 @@ import (
 const (
 	rttyCmdRunningLimit = 5
 	rttyCmdExecTimeout  = 30 * time.Second
+	rttyCmdChunkSize    = 32 * 1024 // bytes of output in a chunk of a result
 )
 
 const (
@@ -31,98 +35,263 @@ const (
 	rttyCmdErrNoMem
 	rttyCmdErrSysErr
 	rttyCmdErrRespTooBig
+	rttyCmdErrNoDir
+	rttyCmdErrCanceled
+	rttyCmdErrInvalid
+	rttyCmdErrBusy
 )
 
 var rttyCmdSemaphore = make(chan struct{}, rttyCmdRunningLimit)
 
+// cmdMsg is a command the server asks to run
+type cmdMsg struct {
+	username string
+	name     string
+	token    string
+	params   []string
+	env      []string // KEY=VALUE, after cmd-env
+	cwd      string
+	shell    bool
+	chunked  bool
+
+	job       bool
+	jobStream bool
+	jobStatus string
+
+	cancel string
+
+	schedule []byte
+
+	script     []byte
+	scriptPath string // the script, once written
+}
+
 func handleCmdMsg(cli *RttyClient, data []byte) error {
-	username, cmdName, token, params, err := parseCmdMsg(data)
+	msg, err := parseCmdMsg(data)
 	if err != nil {
 		log.Error().Err(err).Msg("invalid command message format")
 		return nil
 	}
 
-	log.Debug().Msgf("command: %s, username: %s, token: %s, params: %v", cmdName, username, token, params)
+	// Jobs and commands belong to the user they run as
+	if u := cmdUser(&cli.cfg, msg.username); u != msg.username {
+		log.Debug().Msgf("command of %s run as %s", msg.username, u)
+		msg.username = u
+	}
 
-	u, err := user.Lookup(username)
-	if err != nil {
-		cmdErrReply(cli, token, rttyCmdErrPermit)
+	if msg.jobStatus != "" {
+		cmdJobStatus(cli, msg)
 		return nil
 	}
 
-	cmdPath, err := exec.LookPath(cmdName)
-	if cmdPath == "" {
-		log.Error().Err(err).Msgf("command not found: %s", cmdName)
-		cmdErrReply(cli, token, rttyCmdErrNotFound)
+	if msg.cancel != "" {
+		cmdCancel(cli, msg)
+		return nil
+	}
+
+	if msg.schedule != nil {
+		handleCmdSchedule(cli, msg)
+		return nil
+	}
+
+	token := msg.token
+
+	audit := newCmdAudit(cli, msg)
+
+	log.Debug().Msgf("command: %s, username: %s, token: %s, params: %v, env: %v, shell: %v", msg.name,
+		msg.username, token, msg.params, msg.env, msg.shell)
+
+	t, errCode := prepareCmd(cli, msg, audit)
+	if errCode != rttyCmdErrNone {
+		audit.fail(cli, errCode)
+		cmdErrReply(cli, token, errCode)
+		return nil
+	}
+
+	if msg.job {
+		startCmdJob(cli, t, msg, audit)
 		return nil
 	}
 
 	select {
 	case rttyCmdSemaphore <- struct{}{}:
-		go executeCommand(cli, u, cmdPath, params, token)
+		go executeCommand(cli, t, msg, audit)
 	default:
 		log.Warn().Msgf("command limit reached: %d", rttyCmdRunningLimit)
+		msg.cleanup()
+		audit.fail(cli, rttyCmdErrNoMem)
 		cmdErrReply(cli, token, rttyCmdErrNoMem)
 	}
 
 	return nil
 }
 
-func executeCommand(cli *RttyClient, u *user.User, cmdPath string, params []string, token string) {
+// cmdTarget is what a command runs as, where and with which environment
+type cmdTarget struct {
+	u    *user.User
+	path string
+	dir  string
+	env  []string
+}
+
+// prepareCmd checks the command of msg may be run, and writes its script.
+// It returns rttyCmdErr* otherwise.
+func prepareCmd(cli *RttyClient, msg *cmdMsg, audit *cmdAudit) (*cmdTarget, int) {
+	cmdName, username := msg.name, msg.username
+
+	// The shell is what runs, and what cmd-allow and cmd-deny apply to
+	if msg.shell {
+		cmdName, msg.params = shellCommand(cmdName, msg.params)
+	}
+
+	u, err := user.Lookup(username)
+	if err != nil {
+		log.Error().Err(err).Msgf("command user not found: %s", username)
+		return nil, rttyCmdErrPermit
+	}
+
+	cmdPath, err := exec.LookPath(cmdName)
+	if cmdPath == "" {
+		log.Error().Err(err).Msgf("command not found: %s", cmdName)
+		return nil, rttyCmdErrNotFound
+	}
+
+	audit.Path = cmdPath
+
+	if err := cmdAllowed(&cli.cfg, cmdName, cmdPath, username); err != nil {
+		log.Warn().Err(err).Msgf("refused command: %s, username: %s", cmdName, username)
+		return nil, rttyCmdErrPermit
+	}
+
+	dir := msg.cwd
+	if dir != "" && !filepath.IsAbs(dir) {
+		dir = filepath.Join(u.HomeDir, dir)
+	}
+
+	if dir != "" {
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			log.Error().Msgf("command directory not found: %s", dir)
+			return nil, rttyCmdErrNoDir
+		}
+	}
+
+	audit.Dir = dir
+
+	// The server's variables come last to take precedence
+	env := append(cmdEnv(u), cli.cfg.cmdEnv...)
+	env = append(env, msg.env...)
+
+	if msg.script != nil {
+		msg.scriptPath, err = writeCmdScript(msg.script, u)
+		if err != nil {
+			log.Error().Err(err).Msgf("write command script failed: %s", cmdName)
+			return nil, rttyCmdErrSysErr
+		}
+
+		msg.params = append([]string{msg.scriptPath}, msg.params...)
+	}
+
+	return &cmdTarget{u: u, path: cmdPath, dir: dir, env: env}, rttyCmdErrNone
+}
+
+// cmdEnv returns the environment of rtty with that of the user u, whom
+// commands are run as
+func cmdEnv(u *user.User) []string {
+	env := os.Environ()
+
+	if u.HomeDir != "" {
+		env = append(env, "HOME="+u.HomeDir)
+	}
+
+	return append(env, "USER="+u.Username, "LOGNAME="+u.Username)
+}
+
+func executeCommand(cli *RttyClient, t *cmdTarget, msg *cmdMsg, audit *cmdAudit) {
 	defer func() {
+		msg.cleanup()
 		<-rttyCmdSemaphore
 	}()
 
-	log.Debug().Msgf("starting command execution: %s, token: %s", cmdPath, token)
+	token := msg.token
+
+	log.Debug().Msgf("starting command execution: %s, token: %s", t.path, token)
 
 	ctx, cancel := context.WithTimeout(context.Background(), rttyCmdExecTimeout)
 	defer cancel()
 
-	cmd := exec.CommandContext(ctx, cmdPath, params...)
+	defer trackCmd(token, msg.username, cancel)()
 
-	setSysProcAttr(cmd, u)
+	code, stdout, stderr, errCode := runCmd(ctx, t, msg.params, token)
+	if errCode != rttyCmdErrNone {
+		audit.fail(cli, errCode)
+		cmdErrReply(cli, token, errCode)
+		return
+	}
+
+	audit.Stdout = newCmdAuditOutput(stdout)
+	audit.Stderr = newCmdAuditOutput(stderr)
+	audit.exit(cli, code)
+
+	cmdReply(cli, token, code, stdout, stderr, msg.chunked)
+}
+
+// runCmd runs the command t with params to its end, returning its code and
+// output, else rttyCmdErr*. token is what logs name the command by.
+func runCmd(ctx context.Context, t *cmdTarget, params []string, token string) (int, []byte, []byte, int) {
+	cmd := exec.CommandContext(ctx, t.path, params...)
+	cmd.Env = t.env
+	cmd.Dir = t.dir
+
+	release, err := setSysProcAttr(cmd, t.u)
+	if err != nil {
+		log.Error().Err(err).Msgf("command can't run as %s: %s, token: %s", t.u.Username, t.path, token)
+		return 0, nil, nil, rttyCmdErrPermit
+	}
+	defer release()
 
 	var stdout, stderr bytes.Buffer
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
 
 	exitCode := 0
-	err := cmd.Run()
+	err = cmd.Run()
 
 	if err != nil {
 		if ctx.Err() == context.DeadlineExceeded {
-			log.Error().Msgf("command timeout: %s, token: %s", cmdPath, token)
-			cmdErrReply(cli, token, rttyCmdErrSysErr)
-			return
+			log.Error().Msgf("command timeout: %s, token: %s", t.path, token)
+			return 0, nil, nil, rttyCmdErrSysErr
+		} else if ctx.Err() == context.Canceled {
+			log.Info().Msgf("command canceled: %s, token: %s", t.path, token)
+			return 0, nil, nil, rttyCmdErrCanceled
 		} else if exitErr, ok := err.(*exec.ExitError); ok {
 			exitCode = exitErr.ExitCode()
 		} else {
-			log.Error().Err(err).Msgf("command execution failed: %s, token: %s", cmdPath, token)
-			cmdErrReply(cli, token, rttyCmdErrSysErr)
-			return
+			log.Error().Err(err).Msgf("command execution failed: %s, token: %s", t.path, token)
+			return 0, nil, nil, rttyCmdErrSysErr
 		}
 	}
 
-	stdoutBytes := stdout.Bytes()
-	stderrBytes := stderr.Bytes()
-
-	cmdReply(cli, token, exitCode, stdoutBytes, stderrBytes)
+	return exitCode, stdout.Bytes(), stderr.Bytes(), rttyCmdErrNone
 }
 
-func parseCmdMsg(data []byte) (string, string, string, []string, error) {
+// parseCmdMsg parses the username, command and token, each ending with a
+// NUL, then the number of params and the params, each ending with a NUL but
+// maybe the last, and from servers knowing MsgRegAttrCmdEnv the number of
+// variables and the variables alike, then attributes
+func parseCmdMsg(data []byte) (*cmdMsg, error) {
 	var parts []string
 
 	for {
 		i := bytes.Index(data, []byte{0})
 		if i < 0 {
-			return "", "", "", nil, fmt.Errorf("invalid command message format")
+			return nil, fmt.Errorf("invalid command message format")
 		}
 
 		parts = append(parts, string(data[:i]))
 		data = data[i+1:]
 
 		if len(data) == 0 {
-			return "", "", "", nil, fmt.Errorf("invalid command message format")
+			return nil, fmt.Errorf("invalid command message format")
 		}
 
 		if len(parts) == 3 {
@@ -130,29 +299,124 @@ func parseCmdMsg(data []byte) (string, string, string, []string, error) {
 		}
 	}
 
-	if len(data) < 1 {
-		return "", "", "", nil, fmt.Errorf("invalid command message format")
+	msg := &cmdMsg{username: parts[0], name: parts[1], token: parts[2]}
+
+	// A count, then as many strings
+	list := func(what string) ([]string, error) {
+		n := int(data[0])
+		data = data[1:]
+
+		var items []string
+
+		for range n {
+			if len(data) == 0 {
+				return nil, fmt.Errorf("invalid command message format: expected %d %s, got %d", n, what, len(items))
+			}
+
+			item, rest, _ := bytes.Cut(data, []byte{0})
+			items = append(items, string(item))
+			data = rest
+		}
+
+		return items, nil
 	}
 
-	var params []string
+	var err error
 
-	nparams := data[0]
+	msg.params, err = list("params")
+	if err != nil {
+		return nil, err
+	}
 
-	if nparams > 0 {
-		data = bytes.TrimSuffix(data[1:], []byte{0})
-		params = strings.Split(string(data), "\x00")
+	if len(data) > 0 {
+		msg.env, err = list("variables")
+		if err != nil {
+			return nil, err
+		}
 
-		if len(params) != int(nparams) {
-			return "", "", "", nil, fmt.Errorf("invalid command message format: expected %d params, got %d", nparams, len(params))
+		for _, kv := range msg.env {
+			if name, _, ok := strings.Cut(kv, "="); !ok || name == "" {
+				return nil, fmt.Errorf("invalid env '%s'", kv)
+			}
 		}
 	}
 
-	return parts[0], parts[1], parts[2], params, nil
+	err = parseMsgAttrs(data, func(attrType byte, val []byte) error {
+		switch attrType {
+		case proto.MsgCmdAttrCwd:
+			msg.cwd = string(val)
+		case proto.MsgCmdAttrShell:
+			msg.shell = true
+		case proto.MsgCmdAttrChunked:
+			msg.chunked = true
+		case proto.MsgCmdAttrJob:
+			msg.job = true
+			msg.jobStream = len(val) > 0 && val[0] == 1
+		case proto.MsgCmdAttrJobStatus:
+			msg.jobStatus = string(val)
+		case proto.MsgCmdAttrCancel:
+			msg.cancel = string(val)
+		case proto.MsgCmdAttrScript:
+			msg.script = val
+		case proto.MsgCmdAttrSchedule:
+			msg.schedule = val
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return msg, nil
 }
 
-func cmdErrReply(cli *RttyClient, token string, err int) {
-	msg := fmt.Sprintf(`{"token":"%s","attrs":{"err":%d,"msg":"%s"}}`, token, err, cmderr2str(err))
+// cmdReplyMsg is the reply to a cmd message, or a message the server is sent
+// for one later on, with attrs depending on what it tells
+type cmdReplyMsg struct {
+	Token string `json:"token"`
+	Attrs any    `json:"attrs"`
+}
+
+type cmdErrAttrs struct {
+	Err int    `json:"err"`
+	Msg string `json:"msg"`
+}
+
+// cmdResultAttrs is the result of a command, with stdout and stderr base64
+// encoded
+type cmdResultAttrs struct {
+	Code   int    `json:"code"`
+	Stdout string `json:"stdout"`
+	Stderr string `json:"stderr"`
+}
+
+// cmdChunkAttrs is a chunk of a result, those of stdout and of stderr to be
+// appended to those of the previous chunks. The last one has the code rather
+// than more set.
+type cmdChunkAttrs struct {
+	Chunk  int    `json:"chunk"`
+	More   bool   `json:"more,omitempty"`
+	Code   *int   `json:"code,omitempty"`
+	Stdout string `json:"stdout"`
+	Stderr string `json:"stderr"`
+}
+
+// writeCmdReply sends the reply to the cmd message of token, unless it
+// doesn't fit in a message
+func writeCmdReply(cli *RttyClient, token string, attrs any) bool {
+	msg, err := json.Marshal(cmdReplyMsg{Token: token, Attrs: attrs})
+	if err != nil || len(msg) > 0xffff {
+		return false
+	}
+
 	cli.WriteMsg(proto.MsgTypeCmd, msg)
+	return true
+}
+
+func cmdErrReply(cli *RttyClient, token string, err int) {
+	if !writeCmdReply(cli, token, cmdErrAttrs{Err: err, Msg: cmderr2str(err)}) {
+		log.Error().Msgf("command error reply too big, token: %.64s", token)
+	}
 }
 
 func cmderr2str(err int) string {
@@ -167,20 +431,63 @@ func cmderr2str(err int) string {
 		return "sys error"
 	case rttyCmdErrRespTooBig:
 		return "stdout+stderr is too big"
+	case rttyCmdErrNoDir:
+		return "no such directory"
+	case rttyCmdErrCanceled:
+		return "canceled"
+	case rttyCmdErrInvalid:
+		return "invalid"
+	case rttyCmdErrBusy:
+		return "busy"
 	default:
 		return ""
 	}
 }
 
-func cmdReply(cli *RttyClient, token string, code int, stdout []byte, stderr []byte) {
-	stdoutB64 := base64.StdEncoding.EncodeToString(stdout)
-	stderrB64 := base64.StdEncoding.EncodeToString(stderr)
-	msg := fmt.Sprintf(`{"token":"%s","attrs":{"code":%d,"stdout":"%s","stderr":"%s"}}`, token, code, stdoutB64, stderrB64)
+// cmdReply sends the result of a command, in chunks if too big for a
+// message and the server takes them
+func cmdReply(cli *RttyClient, token string, code int, stdout []byte, stderr []byte, chunked bool) {
+	attrs := cmdResultAttrs{
+		Code:   code,
+		Stdout: base64.StdEncoding.EncodeToString(stdout),
+		Stderr: base64.StdEncoding.EncodeToString(stderr),
+	}
+
+	if writeCmdReply(cli, token, attrs) {
+		return
+	}
 
-	if len(msg) > 0xffff {
+	if !chunked {
 		cmdErrReply(cli, token, rttyCmdErrRespTooBig)
 		return
 	}
 
-	cli.WriteMsg(proto.MsgTypeCmd, msg)
+	for n := 0; ; n++ {
+		out := stdout[:min(len(stdout), rttyCmdChunkSize)]
+		stdout = stdout[len(out):]
+
+		errOut := stderr[:min(len(stderr), rttyCmdChunkSize-len(out))]
+		stderr = stderr[len(errOut):]
+
+		attrs := cmdChunkAttrs{
+			Chunk:  n,
+			Stdout: base64.StdEncoding.EncodeToString(out),
+			Stderr: base64.StdEncoding.EncodeToString(errOut),
+		}
+
+		if len(stdout)+len(stderr) > 0 {
+			attrs.More = true
+		} else {
+			attrs.Code = &code
+		}
+
+		if !writeCmdReply(cli, token, attrs) {
+			log.Error().Msgf("command reply chunk %d too big, token: %.64s", n, token)
+			return
+		}
+
+		if !attrs.More {
+			return
+		}
+	}
 }
@@ -0,0 +1,219 @@
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/zhaojh329/rtty-go/proto"
+)
+
+// Strings breaking JSON built by hand
+var hostileTokens = []string{
+	`"quoted"`,
+	`back\slash\`,
+	"new\nline\r\t",
+	"nul\x00byte",
+	"bad\xff\xfeutf8",
+	" </script>",
+	`{"token":"x"},"attrs":{}`,
+}
+
+var hostileOutput = []byte("\"'\\\n\r\x00\xff\xfe}{ ")
+
+type testCmdReply struct {
+	Token string `json:"token"`
+	Attrs struct {
+		Err    int    `json:"err"`
+		Msg    string `json:"msg"`
+		Code   *int   `json:"code"`
+		Chunk  int    `json:"chunk"`
+		More   bool   `json:"more"`
+		Stdout string `json:"stdout"`
+		Stderr string `json:"stderr"`
+		Job    string `json:"job"`
+		State  string `json:"state"`
+	} `json:"attrs"`
+}
+
+// cmdReplies returns the replies fn sends the server
+func cmdReplies(t *testing.T, fn func(cli *RttyClient)) []testCmdReply {
+	t.Helper()
+
+	a, b := net.Pipe()
+
+	cli := &RttyClient{conn: a, msg: proto.NewMsgReaderWriter(proto.RoleRtty, a)}
+	srv := proto.NewMsgReaderWriter(proto.RoleRttys, b)
+
+	done := make(chan []testCmdReply)
+
+	go func() {
+		var replies []testCmdReply
+
+		for {
+			typ, data, err := srv.Read()
+			if err != nil {
+				break
+			}
+
+			if typ != proto.MsgTypeCmd {
+				t.Errorf("got %s message", proto.MsgTypeName(typ))
+				continue
+			}
+
+			var reply testCmdReply
+
+			if !json.Valid(data) {
+				t.Errorf("invalid JSON: %q", data)
+			} else if err := json.Unmarshal(data, &reply); err != nil {
+				t.Errorf("%v: %q", err, data)
+			}
+
+			replies = append(replies, reply)
+		}
+
+		done <- replies
+	}()
+
+	fn(cli)
+	a.Close()
+
+	return <-done
+}
+
+func decodeOutput(t *testing.T, s string) []byte {
+	t.Helper()
+
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		t.Errorf("output %q: %v", s, err)
+	}
+
+	return b
+}
+
+// jsonString is s as JSON carries it: strings are Unicode, encoding/json
+// replaces each invalid byte with U+FFFD
+func jsonString(s string) string {
+	return string([]rune(s))
+}
+
+func checkCmdReplies(t *testing.T, replies []testCmdReply, n int, token string) {
+	t.Helper()
+
+	want := jsonString(token)
+
+	if len(replies) != n {
+		t.Fatalf("%q: got %d replies, want %d", token, len(replies), n)
+	}
+
+	for _, r := range replies {
+		if r.Token != want {
+			t.Errorf("token %q, want %q", r.Token, want)
+		}
+	}
+}
+
+func TestCmdReplyHostile(t *testing.T) {
+	for _, token := range hostileTokens {
+		replies := cmdReplies(t, func(cli *RttyClient) {
+			cmdReply(cli, token, 3, hostileOutput, hostileOutput, false)
+		})
+
+		checkCmdReplies(t, replies, 1, token)
+
+		r := replies[0].Attrs
+		if r.Code == nil || *r.Code != 3 {
+			t.Errorf("%q: code %v, want 3", token, r.Code)
+		}
+
+		if !bytes.Equal(decodeOutput(t, r.Stdout), hostileOutput) ||
+			!bytes.Equal(decodeOutput(t, r.Stderr), hostileOutput) {
+			t.Errorf("%q: output %q %q", token, r.Stdout, r.Stderr)
+		}
+	}
+}
+
+func TestCmdErrReplyHostile(t *testing.T) {
+	for _, token := range hostileTokens {
+		replies := cmdReplies(t, func(cli *RttyClient) {
+			cmdErrReply(cli, token, rttyCmdErrNotFound)
+		})
+
+		checkCmdReplies(t, replies, 1, token)
+
+		r := replies[0].Attrs
+		if r.Err != rttyCmdErrNotFound || r.Msg != cmderr2str(rttyCmdErrNotFound) {
+			t.Errorf("%q: err %d %q", token, r.Err, r.Msg)
+		}
+	}
+}
+
+func TestCmdReplyChunkedHostile(t *testing.T) {
+	stdout := bytes.Repeat(hostileOutput, rttyCmdChunkSize*2/len(hostileOutput))
+
+	for _, token := range hostileTokens {
+		replies := cmdReplies(t, func(cli *RttyClient) {
+			cmdReply(cli, token, 0, stdout, hostileOutput, true)
+		})
+
+		checkCmdReplies(t, replies, 3, token)
+
+		var out, errOut []byte
+
+		for i, r := range replies {
+			last := i == len(replies)-1
+
+			if r.Attrs.Chunk != i || r.Attrs.More == last || (r.Attrs.Code != nil) != last {
+				t.Errorf("%q: chunk %d: %+v", token, i, r.Attrs)
+			}
+
+			out = append(out, decodeOutput(t, r.Attrs.Stdout)...)
+			errOut = append(errOut, decodeOutput(t, r.Attrs.Stderr)...)
+		}
+
+		if !bytes.Equal(out, stdout) || !bytes.Equal(errOut, hostileOutput) {
+			t.Errorf("%q: output not put back together", token)
+		}
+	}
+}
+
+func TestCmdJobReplyHostile(t *testing.T) {
+	for _, token := range hostileTokens {
+		start := time.Now()
+
+		exited := &cmdJob{id: token, start: start, end: start, code: 1}
+		exited.stdout.buf = hostileOutput
+		exited.stderr.buf = hostileOutput
+
+		failed := &cmdJob{id: token, start: start, end: start, err: rttyCmdErrSysErr}
+
+		replies := cmdReplies(t, func(cli *RttyClient) {
+			exited.reply(cli, token)
+			failed.reply(cli, token)
+		})
+
+		checkCmdReplies(t, replies, 2, token)
+
+		r := replies[0].Attrs
+		if r.State != "exited" || r.Code == nil || *r.Code != 1 ||
+			r.Job != jsonString(token) ||
+			!bytes.Equal(decodeOutput(t, r.Stdout), hostileOutput) ||
+			!bytes.Equal(decodeOutput(t, r.Stderr), hostileOutput) {
+			t.Errorf("%q: exited job %+v", token, r)
+		}
+
+		r = replies[1].Attrs
+		if r.State != "failed" || r.Err != rttyCmdErrSysErr || r.Msg != cmderr2str(rttyCmdErrSysErr) {
+			t.Errorf("%q: failed job %+v", token, r)
+		}
+	}
+}
@@ -9,13 +9,34 @@
 package main
 
 import (
+	"os"
 	"os/exec"
 	"os/user"
 	"strconv"
 	"syscall"
 )
 
-func setSysProcAttr(cmd *exec.Cmd, u *user.User) {
+// shellCommand returns the shell and its arguments to run line with params
+// as $1 and on
+func shellCommand(line string, params []string) (string, []string) {
+	return "/bin/sh", append([]string{"-c", line, "sh"}, params...)
+}
+
+// chownCmdFile gives f to u, for the command run as u to access
+func chownCmdFile(f *os.File, u *user.User) error {
+	uid, _ := strconv.Atoi(u.Uid)
+	gid, _ := strconv.Atoi(u.Gid)
+
+	if uid == os.Geteuid() {
+		return nil
+	}
+
+	return f.Chown(uid, gid)
+}
+
+// setSysProcAttr makes cmd run as u. The returned func is to be called once
+// cmd is done.
+func setSysProcAttr(cmd *exec.Cmd, u *user.User) (func(), error) {
 	uid, _ := strconv.Atoi(u.Uid)
 	gid, _ := strconv.Atoi(u.Gid)
 
@@ -25,4 +46,6 @@ func setSysProcAttr(cmd *exec.Cmd, u *user.User) {
 			Gid: uint32(gid),
 		},
 	}
+
+	return func() {}, nil
 }
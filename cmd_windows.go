@@ -9,9 +9,85 @@
 package main
 
 import (
+	"errors"
+	"os"
 	"os/exec"
 	"os/user"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
 )
 
-func setSysProcAttr(cmd *exec.Cmd, u *user.User) {
+// shellCommand returns the shell and its arguments to run line with params
+// following it
+func shellCommand(line string, params []string) (string, []string) {
+	shell := os.Getenv("ComSpec")
+	if shell == "" {
+		shell = "cmd.exe"
+	}
+
+	return shell, append([]string{"/c", line}, params...)
+}
+
+// chownCmdFile leaves f to rtty, the files it creates in its temporary
+// directory are accessible to administrators only
+func chownCmdFile(f *os.File, u *user.User) error {
+	return nil
+}
+
+// setSysProcAttr makes cmd run as u: as rtty itself when it is u, else with
+// the token of a session u is logged on to, which rtty only gets running as
+// LocalSystem. Without the password of u, that is all there is. The returned
+// func releases the token once cmd is done.
+func setSysProcAttr(cmd *exec.Cmd, u *user.User) (func(), error) {
+	if cur, err := user.Current(); err == nil && cur.Uid == u.Uid {
+		return func() {}, nil
+	}
+
+	token, err := sessionUserToken(u.Uid)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Token:      syscall.Token(token),
+		HideWindow: true,
+	}
+
+	return func() { token.Close() }, nil
+}
+
+// sessionUserToken returns the token of a session the user of sid is logged
+// on to
+func sessionUserToken(sid string) (windows.Token, error) {
+	var sessions *windows.WTS_SESSION_INFO
+	var count uint32
+
+	if err := windows.WTSEnumerateSessions(0, 0, 1, &sessions, &count); err != nil {
+		return 0, err
+	}
+	defer windows.WTSFreeMemory(uintptr(unsafe.Pointer(sessions)))
+
+	var lastErr error = errors.New("no session the user is logged on to")
+
+	for _, s := range unsafe.Slice(sessions, count) {
+		var token windows.Token
+
+		if err := windows.WTSQueryUserToken(s.SessionID, &token); err != nil {
+			if !errors.Is(err, windows.ERROR_NO_TOKEN) {
+				lastErr = err
+			}
+			continue
+		}
+
+		tu, err := token.GetTokenUser()
+		if err == nil && tu.User.Sid.String() == sid {
+			return token, nil
+		}
+
+		token.Close()
+	}
+
+	return 0, lastErr
 }
@@ -0,0 +1,143 @@
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// cmdAudit records a command the server asked to run, once done with it, to
+// the log and as a JSON line of <audit-dir>/<id>-cmd.log
+type cmdAudit struct {
+	Time     string          `json:"time"`
+	Token    string          `json:"token"`
+	User     string          `json:"user"`
+	Cmd      string          `json:"cmd"`
+	Args     []string        `json:"args"`
+	Shell    bool            `json:"shell,omitempty"`
+	Script   string          `json:"script_sha256,omitempty"`
+	Path     string          `json:"path,omitempty"`
+	Dir      string          `json:"dir,omitempty"`
+	Job      string          `json:"job,omitempty"`
+	Schedule string          `json:"schedule,omitempty"`
+	Code     *int            `json:"code,omitempty"`
+	Err      string          `json:"err,omitempty"`
+	Duration float64         `json:"duration"`
+	Stdout   *cmdAuditOutput `json:"stdout,omitempty"`
+	Stderr   *cmdAuditOutput `json:"stderr,omitempty"`
+
+	start time.Time
+	stat  string // what the command is counted as in the stats
+}
+
+// cmdAuditOutput identifies what a command printed without keeping it
+type cmdAuditOutput struct {
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+var cmdAuditMu sync.Mutex
+
+// newCmdAudit is called before the shell is made the command of msg, which
+// counts as running from then on
+func newCmdAudit(cli *RttyClient, msg *cmdMsg) *cmdAudit {
+	now := time.Now()
+
+	a := &cmdAudit{
+		Time:  now.Format("2006-01-02T15:04:05.000Z07:00"),
+		Token: msg.token,
+		User:  msg.username,
+		Cmd:   msg.name,
+		Args:  append([]string{}, msg.params...),
+		Shell: msg.shell,
+		start: now,
+		stat:  cmdStatsName(msg),
+	}
+
+	cli.cmdStats.start(a.stat)
+
+	if msg.script != nil {
+		sum := sha256.Sum256(msg.script)
+		a.Script = hex.EncodeToString(sum[:])
+	}
+
+	return a
+}
+
+func newCmdAuditOutput(data []byte) *cmdAuditOutput {
+	sum := sha256.Sum256(data)
+	return &cmdAuditOutput{Size: int64(len(data)), SHA256: hex.EncodeToString(sum[:])}
+}
+
+// fail records the command couldn't be run, or to its end, with err
+func (a *cmdAudit) fail(cli *RttyClient, err int) {
+	a.Err = cmderr2str(err)
+	a.write(cli)
+}
+
+// exit records the command exited with code
+func (a *cmdAudit) exit(cli *RttyClient, code int) {
+	a.Code = &code
+	a.write(cli)
+}
+
+func (a *cmdAudit) write(cli *RttyClient) {
+	a.Duration = math.Round(time.Since(a.start).Seconds()*1000) / 1000
+
+	cli.cmdStats.done(a.stat, a)
+
+	what := "command"
+	if a.Job != "" {
+		what = "job " + a.Job
+	} else if a.Schedule != "" {
+		what = "scheduled command " + a.Schedule
+	}
+
+	if a.Code != nil {
+		log.Info().Msgf("%s %s, username: %s, token: %s, exited %d in %.3fs", what, a.Cmd, a.User, a.Token,
+			*a.Code, a.Duration)
+	} else {
+		log.Info().Msgf("%s %s, username: %s, token: %s, failed: %s", what, a.Cmd, a.User, a.Token, a.Err)
+	}
+
+	dir := cli.cfg.auditDir
+	if dir == "" {
+		return
+	}
+
+	line, err := json.Marshal(a)
+	if err != nil {
+		return
+	}
+
+	cmdAuditMu.Lock()
+	defer cmdAuditMu.Unlock()
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		log.Error().Err(err).Msg("write command audit log failed")
+		return
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, cli.cfg.id+"-cmd.log"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		log.Error().Err(err).Msg("write command audit log failed")
+		return
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		log.Error().Err(err).Msg("write command audit log failed")
+	}
+}
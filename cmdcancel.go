@@ -0,0 +1,85 @@
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// cmdRunning is a command the server waits on the reply of
+type cmdRunning struct {
+	username string
+	cancel   context.CancelFunc
+}
+
+var (
+	rttyCmdRunningMu sync.Mutex
+	rttyCmdRunning   = make(map[string]*cmdRunning) // by token
+)
+
+type cmdCancelAttrs struct {
+	Canceled string `json:"canceled"`
+}
+
+// trackCmd makes the command of token cancelable until the returned func is
+// called
+func trackCmd(token, username string, cancel context.CancelFunc) func() {
+	c := &cmdRunning{username: username, cancel: cancel}
+
+	rttyCmdRunningMu.Lock()
+	rttyCmdRunning[token] = c
+	rttyCmdRunningMu.Unlock()
+
+	return func() {
+		rttyCmdRunningMu.Lock()
+		if rttyCmdRunning[token] == c {
+			delete(rttyCmdRunning, token)
+		}
+		rttyCmdRunningMu.Unlock()
+	}
+}
+
+// cmdCancel kills the job, or else the command of the token, msg asks to
+// cancel, which only the user who started it may. The command replies with
+// rttyCmdErrCanceled, and msg with what was canceled.
+func cmdCancel(cli *RttyClient, msg *cmdMsg) {
+	id := msg.cancel
+
+	rttyCmdJobsMu.Lock()
+	job := rttyCmdJobs[id]
+	rttyCmdJobsMu.Unlock()
+
+	var cancel context.CancelFunc
+
+	if job != nil && job.username == msg.username {
+		job.mu.Lock()
+		if job.end.IsZero() {
+			cancel = job.cancel
+		}
+		job.mu.Unlock()
+	} else {
+		rttyCmdRunningMu.Lock()
+		if c := rttyCmdRunning[id]; c != nil && c.username == msg.username {
+			cancel = c.cancel
+		}
+		rttyCmdRunningMu.Unlock()
+	}
+
+	if cancel == nil {
+		log.Error().Msgf("no command to cancel: %s", id)
+		cmdErrReply(cli, msg.token, rttyCmdErrNotFound)
+		return
+	}
+
+	log.Info().Msgf("cancel command: %s, username: %s", id, msg.username)
+
+	cancel()
+
+	writeCmdReply(cli, msg.token, cmdCancelAttrs{Canceled: id})
+}
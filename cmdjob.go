@@ -0,0 +1,315 @@
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"os/exec"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Jobs are commands run in the background, such as firmware upgrades or
+// backups, which outlive rttyCmdExecTimeout. The server is given the ID of a
+// job at once, asks for its status with it, and is sent the result once done.
+const (
+	rttyCmdJobRunningLimit = 5
+	rttyCmdJobTimeout      = 24 * time.Hour
+	rttyCmdJobKeep         = time.Hour // finished jobs are kept for their result
+	rttyCmdJobKeepLimit    = 32
+	rttyCmdJobOutputLimit  = 16 * 1024 // last bytes kept of stdout and of stderr
+)
+
+type cmdJob struct {
+	id       string
+	token    string // of the message which started it, the result is sent with it
+	username string
+	start    time.Time
+	stream   bool // output is sent as it comes
+	audit    *cmdAudit
+	cancel   context.CancelFunc
+
+	mu     sync.Mutex
+	stdout cmdJobOutput
+	stderr cmdJobOutput
+	end    time.Time // zero while running
+	code   int
+	err    int // rttyCmdErr* when it couldn't run to its end
+}
+
+// cmdJobOutput keeps the last rttyCmdJobOutputLimit bytes written by a job
+// to stdout or stderr, and the hash of them all
+type cmdJobOutput struct {
+	cli  *RttyClient
+	job  *cmdJob
+	name string
+	buf  []byte
+	size int64
+	sum  hash.Hash
+}
+
+// cmdJobAttrs is the status of a job, with its code once exited, or its
+// error once failed
+type cmdJobAttrs struct {
+	Job     string `json:"job"`
+	State   string `json:"state"`
+	Elapsed int64  `json:"elapsed"`
+	Code    *int   `json:"code,omitempty"`
+	Err     int    `json:"err,omitempty"`
+	Msg     string `json:"msg,omitempty"`
+	Stdout  string `json:"stdout"`
+	Stderr  string `json:"stderr"`
+}
+
+var (
+	rttyCmdJobSemaphore = make(chan struct{}, rttyCmdJobRunningLimit)
+
+	rttyCmdJobsMu sync.Mutex
+	rttyCmdJobs   = make(map[string]*cmdJob)
+)
+
+func (o *cmdJobOutput) Write(p []byte) (int, error) {
+	o.job.mu.Lock()
+	o.size += int64(len(p))
+	o.sum.Write(p)
+	o.buf = append(o.buf, p...)
+	if len(o.buf) > rttyCmdJobOutputLimit {
+		o.buf = o.buf[len(o.buf)-rttyCmdJobOutputLimit:]
+	}
+	o.job.mu.Unlock()
+
+	if o.job.stream {
+		for chunk := range slices.Chunk(p, rttyCmdJobOutputLimit) {
+			writeCmdReply(o.cli, o.job.token, map[string]string{
+				"job":   o.job.id,
+				"state": "running",
+				o.name:  base64.StdEncoding.EncodeToString(chunk),
+			})
+		}
+	}
+
+	return len(p), nil
+}
+
+func newCmdJobID() (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// expireCmdJobs forgets the jobs finished over rttyCmdJobKeep ago, and the
+// oldest finished ones beyond rttyCmdJobKeepLimit. Called with rttyCmdJobsMu
+// held.
+func expireCmdJobs() {
+	for {
+		var oldest *cmdJob
+		var oldestEnd time.Time
+
+		finished := 0
+
+		for id, job := range rttyCmdJobs {
+			job.mu.Lock()
+			end := job.end
+			job.mu.Unlock()
+
+			if end.IsZero() {
+				continue
+			}
+
+			if time.Since(end) > rttyCmdJobKeep {
+				delete(rttyCmdJobs, id)
+				continue
+			}
+
+			finished++
+
+			if oldest == nil || end.Before(oldestEnd) {
+				oldest, oldestEnd = job, end
+			}
+		}
+
+		if finished <= rttyCmdJobKeepLimit || oldest == nil {
+			return
+		}
+
+		delete(rttyCmdJobs, oldest.id)
+	}
+}
+
+// startCmdJob runs the command of msg in the background, and replies with
+// the ID of its job
+func startCmdJob(cli *RttyClient, t *cmdTarget, msg *cmdMsg, audit *cmdAudit) {
+	select {
+	case rttyCmdJobSemaphore <- struct{}{}:
+	default:
+		log.Warn().Msgf("job limit reached: %d", rttyCmdJobRunningLimit)
+		msg.cleanup()
+		audit.fail(cli, rttyCmdErrNoMem)
+		cmdErrReply(cli, msg.token, rttyCmdErrNoMem)
+		return
+	}
+
+	id, err := newCmdJobID()
+	if err != nil {
+		<-rttyCmdJobSemaphore
+		log.Error().Err(err).Msg("generate job ID failed")
+		msg.cleanup()
+		audit.fail(cli, rttyCmdErrSysErr)
+		cmdErrReply(cli, msg.token, rttyCmdErrSysErr)
+		return
+	}
+
+	job := &cmdJob{
+		id:       id,
+		token:    msg.token,
+		username: msg.username,
+		start:    time.Now(),
+		stream:   msg.jobStream,
+		audit:    audit,
+	}
+
+	job.stdout = cmdJobOutput{cli: cli, job: job, name: "stdout", sum: sha256.New()}
+	job.stderr = cmdJobOutput{cli: cli, job: job, name: "stderr", sum: sha256.New()}
+
+	audit.Job = id
+
+	ctx, cancel := context.WithTimeout(context.Background(), rttyCmdJobTimeout)
+	job.cancel = cancel
+
+	rttyCmdJobsMu.Lock()
+	expireCmdJobs()
+	rttyCmdJobs[id] = job
+	rttyCmdJobsMu.Unlock()
+
+	log.Info().Msgf("job %s started: %s, username: %s", id, t.path, msg.username)
+
+	job.reply(cli, msg.token)
+
+	go job.run(ctx, cli, t, msg)
+}
+
+func (job *cmdJob) run(ctx context.Context, cli *RttyClient, t *cmdTarget, msg *cmdMsg) {
+	defer func() {
+		msg.cleanup()
+		<-rttyCmdJobSemaphore
+	}()
+
+	defer job.cancel()
+
+	cmd := exec.CommandContext(ctx, t.path, msg.params...)
+	cmd.Env = t.env
+	cmd.Dir = t.dir
+
+	cmd.Stdout = &job.stdout
+	cmd.Stderr = &job.stderr
+
+	release, err := setSysProcAttr(cmd, t.u)
+	if err == nil {
+		err = cmd.Run()
+		release()
+	}
+
+	job.mu.Lock()
+
+	if release == nil {
+		log.Error().Err(err).Msgf("job %s can't run as %s", job.id, t.u.Username)
+		job.err = rttyCmdErrPermit
+	} else if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			log.Error().Msgf("job %s timeout: %s", job.id, t.path)
+			job.err = rttyCmdErrSysErr
+		} else if ctx.Err() == context.Canceled {
+			log.Info().Msgf("job %s canceled: %s", job.id, t.path)
+			job.err = rttyCmdErrCanceled
+		} else if exitErr, ok := err.(*exec.ExitError); ok {
+			job.code = exitErr.ExitCode()
+		} else {
+			log.Error().Err(err).Msgf("job %s failed: %s", job.id, t.path)
+			job.err = rttyCmdErrSysErr
+		}
+	}
+
+	job.end = time.Now()
+
+	job.audit.Stdout = &cmdAuditOutput{Size: job.stdout.size, SHA256: hex.EncodeToString(job.stdout.sum.Sum(nil))}
+	job.audit.Stderr = &cmdAuditOutput{Size: job.stderr.size, SHA256: hex.EncodeToString(job.stderr.sum.Sum(nil))}
+
+	job.mu.Unlock()
+
+	if job.err != rttyCmdErrNone {
+		job.audit.fail(cli, job.err)
+	} else {
+		job.audit.exit(cli, job.code)
+	}
+
+	job.reply(cli, job.token)
+}
+
+// cmdJobStatus replies with the status of the job msg asks for, which only
+// the user who started it may
+func cmdJobStatus(cli *RttyClient, msg *cmdMsg) {
+	rttyCmdJobsMu.Lock()
+	expireCmdJobs()
+	job := rttyCmdJobs[msg.jobStatus]
+	rttyCmdJobsMu.Unlock()
+
+	if job == nil || job.username != msg.username {
+		log.Error().Msgf("job not found: %s", msg.jobStatus)
+		cmdErrReply(cli, msg.token, rttyCmdErrNotFound)
+		return
+	}
+
+	job.reply(cli, msg.token)
+}
+
+// reply sends the status of the job with the output it has left, and once it
+// finished its code or error
+func (job *cmdJob) reply(cli *RttyClient, token string) {
+	job.mu.Lock()
+
+	state := "running"
+	elapsed := time.Since(job.start)
+
+	if !job.end.IsZero() {
+		state = "exited"
+		elapsed = job.end.Sub(job.start)
+
+		if job.err != rttyCmdErrNone {
+			state = "failed"
+		}
+	}
+
+	attrs := cmdJobAttrs{
+		Job:     job.id,
+		State:   state,
+		Elapsed: int64(elapsed.Seconds()),
+		Stdout:  base64.StdEncoding.EncodeToString(job.stdout.buf),
+		Stderr:  base64.StdEncoding.EncodeToString(job.stderr.buf),
+	}
+
+	switch state {
+	case "exited":
+		code := job.code
+		attrs.Code = &code
+	case "failed":
+		attrs.Err = job.err
+		attrs.Msg = cmderr2str(job.err)
+	}
+
+	job.mu.Unlock()
+
+	writeCmdReply(cli, token, attrs)
+}
@@ -0,0 +1,97 @@
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package main
+
+import (
+	"fmt"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Rules of cmd-allow and cmd-deny are regular expressions matching the whole
+// name of the command with this prefix, else paths when starting with /, of
+// a directory when ending with / as well, else names looked up in PATH
+const cmdRuleRegexp = "re:"
+
+func checkCmdPolicyConfig(cfg *Config) error {
+	for _, rule := range append(cfg.cmdAllow, cfg.cmdDeny...) {
+		if re, ok := strings.CutPrefix(rule, cmdRuleRegexp); ok {
+			if _, err := regexp.Compile(re); err != nil {
+				return fmt.Errorf("invalid command rule '%s': %w", rule, err)
+			}
+		} else if rule == "" || strings.Contains(rule, "/") && !filepath.IsAbs(rule) {
+			return fmt.Errorf("invalid command rule '%s': must be a name, an absolute path or %s", rule, cmdRuleRegexp)
+		}
+	}
+
+	if cfg.cmdUser != "" {
+		if _, err := user.Lookup(cfg.cmdUser); err != nil {
+			return fmt.Errorf("invalid cmd-user '%s': %w", cfg.cmdUser, err)
+		}
+
+		if len(cfg.cmdUsers) > 0 && !slices.Contains(cfg.cmdUsers, cfg.cmdUser) {
+			return fmt.Errorf("invalid cmd-user '%s': not in cmd-users", cfg.cmdUser)
+		}
+	}
+
+	return nil
+}
+
+// cmdUser returns the user to run a command the server asked to run as
+// username: cmd-user unless set or username is in cmd-users
+func cmdUser(cfg *Config, username string) string {
+	if cfg.cmdUser == "" || slices.Contains(cfg.cmdUsers, username) {
+		return username
+	}
+	return cfg.cmdUser
+}
+
+// cmdRuleMatch tells whether the rule matches the command of name, found at
+// path
+func cmdRuleMatch(rule, name, path string) bool {
+	if re, ok := strings.CutPrefix(rule, cmdRuleRegexp); ok {
+		ok, _ = regexp.MatchString("^(?:"+re+")$", name)
+		return ok
+	}
+
+	if !strings.HasPrefix(rule, "/") {
+		return name == rule
+	}
+
+	if strings.HasSuffix(rule, "/") {
+		return strings.HasPrefix(path, rule)
+	}
+
+	return path == rule
+}
+
+// cmdAllowed tells whether the command of name, found at path, may be run as
+// username: unless cmd-deny matches it, if cmd-allow does or is empty, and if
+// cmd-users has the user or is empty
+func cmdAllowed(cfg *Config, name, path, username string) error {
+	if len(cfg.cmdUsers) > 0 && !slices.Contains(cfg.cmdUsers, username) {
+		return fmt.Errorf("user %s not allowed to run commands", username)
+	}
+
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+
+	match := func(rule string) bool { return cmdRuleMatch(rule, name, path) }
+
+	if slices.ContainsFunc(cfg.cmdDeny, match) {
+		return fmt.Errorf("command %s denied", name)
+	}
+
+	if len(cfg.cmdAllow) > 0 && !slices.ContainsFunc(cfg.cmdAllow, match) {
+		return fmt.Errorf("command %s not allowed", name)
+	}
+
+	return nil
+}
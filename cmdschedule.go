@@ -0,0 +1,517 @@
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// The server may leave commands for rtty to run on its own, such as health
+// snapshots of devices seldom connected. The schedule it sends replaces the
+// previous one and is kept in cmd-schedule, results wait for the server.
+const (
+	rttyCmdScheduleLimit       = 32
+	rttyCmdScheduleMinInterval = 10 * time.Second
+	rttyCmdScheduleResultLimit = 64       // oldest results are dropped beyond
+	rttyCmdScheduleOutputLimit = 4 * 1024 // last bytes kept of stdout and of stderr
+)
+
+// Shorthands for cron expressions
+var cronAliases = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+}
+
+// cmdScheduleEntry is a command of the schedule, run as the commands the
+// server sends are. When is "@every <duration>" or a cron expression.
+type cmdScheduleEntry struct {
+	ID    string   `json:"id"`
+	When  string   `json:"when"`
+	User  string   `json:"user"`
+	Cmd   string   `json:"cmd"`
+	Args  []string `json:"args,omitempty"`
+	Shell bool     `json:"shell,omitempty"`
+
+	when    cmdScheduleWhen
+	next    time.Time
+	running bool
+}
+
+// cmdScheduleFile is what cmd-schedule keeps, with the token of the message
+// the schedule came with, which its results are sent with
+type cmdScheduleFile struct {
+	Token   string              `json:"token"`
+	Entries []*cmdScheduleEntry `json:"entries"`
+}
+
+// cmdScheduleAttrs is the reply to a schedule
+type cmdScheduleAttrs struct {
+	Scheduled int `json:"scheduled"`
+}
+
+// cmdScheduleResultAttrs is the result of a run of an entry, with its code,
+// or its error when it couldn't run to its end
+type cmdScheduleResultAttrs struct {
+	Schedule string `json:"schedule"`
+	Time     string `json:"time"`
+	Code     *int   `json:"code,omitempty"`
+	Err      int    `json:"err,omitempty"`
+	Msg      string `json:"msg,omitempty"`
+	Stdout   string `json:"stdout"`
+	Stderr   string `json:"stderr"`
+}
+
+type cmdSchedule struct {
+	cli  *RttyClient
+	wake chan struct{}
+
+	mu        sync.Mutex
+	token     string
+	entries   []*cmdScheduleEntry
+	results   []cmdReplyMsg
+	connected bool
+}
+
+func checkCmdScheduleConfig(cfg *Config) error {
+	if cfg.cmdSchedule != "" && !filepath.IsAbs(cfg.cmdSchedule) {
+		return fmt.Errorf("invalid cmd-schedule: %s, must be an absolute path", cfg.cmdSchedule)
+	}
+	return nil
+}
+
+func newCmdSchedule(cli *RttyClient) *cmdSchedule {
+	s := &cmdSchedule{
+		cli:  cli,
+		wake: make(chan struct{}, 1),
+	}
+
+	data, err := os.ReadFile(cli.cfg.cmdSchedule)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warn().Err(err).Msg("failed to read command schedule")
+		}
+		return s
+	}
+
+	var f cmdScheduleFile
+
+	if err := json.Unmarshal(data, &f); err != nil {
+		log.Warn().Err(err).Msg("invalid command schedule")
+		return s
+	}
+
+	if err := parseCmdSchedule(f.Entries); err != nil {
+		log.Warn().Err(err).Msg("invalid command schedule")
+		return s
+	}
+
+	s.token, s.entries = f.Token, f.Entries
+
+	log.Info().Msgf("%d scheduled commands", len(s.entries))
+
+	return s
+}
+
+// parseCmdSchedule checks the entries, parsing when they run
+func parseCmdSchedule(entries []*cmdScheduleEntry) error {
+	if len(entries) > rttyCmdScheduleLimit {
+		return fmt.Errorf("%d commands scheduled, at most %d", len(entries), rttyCmdScheduleLimit)
+	}
+
+	ids := make(map[string]bool)
+
+	for _, e := range entries {
+		if e == nil || e.ID == "" || e.Cmd == "" {
+			return fmt.Errorf("scheduled command without id or cmd")
+		}
+
+		if ids[e.ID] {
+			return fmt.Errorf("scheduled command %s repeated", e.ID)
+		}
+
+		ids[e.ID] = true
+
+		when, err := parseCmdScheduleWhen(e.When)
+		if err != nil {
+			return fmt.Errorf("scheduled command %s: %w", e.ID, err)
+		}
+
+		e.when = when
+	}
+
+	return nil
+}
+
+// handleCmdSchedule replaces the schedule with that msg carries
+func handleCmdSchedule(cli *RttyClient, msg *cmdMsg) {
+	s := cli.schedule
+	if s == nil {
+		log.Warn().Msg("command schedule refused, cmd-schedule isn't set")
+		cmdErrReply(cli, msg.token, rttyCmdErrPermit)
+		return
+	}
+
+	var entries []*cmdScheduleEntry
+
+	err := json.Unmarshal(msg.schedule, &entries)
+	if err == nil {
+		err = parseCmdSchedule(entries)
+	}
+
+	if err != nil {
+		log.Error().Err(err).Msg("invalid command schedule")
+		cmdErrReply(cli, msg.token, rttyCmdErrInvalid)
+		return
+	}
+
+	if err := s.save(msg.token, entries); err != nil {
+		log.Error().Err(err).Msg("failed to save command schedule")
+		cmdErrReply(cli, msg.token, rttyCmdErrSysErr)
+		return
+	}
+
+	s.mu.Lock()
+	s.token, s.entries = msg.token, entries
+	s.mu.Unlock()
+
+	log.Info().Msgf("%d commands scheduled", len(entries))
+
+	s.wakeUp()
+
+	writeCmdReply(cli, msg.token, cmdScheduleAttrs{Scheduled: len(entries)})
+}
+
+func (s *cmdSchedule) save(token string, entries []*cmdScheduleEntry) error {
+	data, err := json.MarshalIndent(cmdScheduleFile{Token: token, Entries: entries}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path := s.cli.cfg.cmdSchedule
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+func (s *cmdSchedule) wakeUp() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run starts the entries once due, an entry still running being skipped
+func (s *cmdSchedule) run() {
+	for {
+		s.mu.Lock()
+
+		now := time.Now()
+		wait := time.Hour
+
+		for _, e := range s.entries {
+			if e.next.IsZero() {
+				e.next = e.when.next(now)
+			}
+
+			if e.next.IsZero() {
+				continue
+			}
+
+			if !now.Before(e.next) {
+				if e.running {
+					log.Warn().Msgf("scheduled command %s still running, skipped", e.ID)
+				} else {
+					e.running = true
+					go s.runEntry(e, s.token)
+				}
+
+				e.next = e.when.next(now)
+			}
+
+			if !e.next.IsZero() {
+				wait = min(wait, e.next.Sub(now))
+			}
+		}
+
+		s.mu.Unlock()
+
+		select {
+		case <-s.wake:
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (s *cmdSchedule) runEntry(e *cmdScheduleEntry, token string) {
+	cli := s.cli
+	start := time.Now()
+
+	msg := &cmdMsg{
+		username: cmdUser(&cli.cfg, e.User),
+		name:     e.Cmd,
+		token:    token,
+		params:   slices.Clone(e.Args),
+		shell:    e.Shell,
+	}
+
+	audit := newCmdAudit(cli, msg)
+	audit.Schedule = e.ID
+
+	attrs := cmdScheduleResultAttrs{Schedule: e.ID, Time: start.Format(time.RFC3339)}
+
+	var code int
+	var stdout, stderr []byte
+
+	// Counted with the commands the server runs, the run is skipped when
+	// they're too many
+	errCode := rttyCmdErrBusy
+
+	select {
+	case rttyCmdSemaphore <- struct{}{}:
+		var t *cmdTarget
+
+		t, errCode = prepareCmd(cli, msg, audit)
+		if errCode == rttyCmdErrNone {
+			ctx, cancel := context.WithTimeout(context.Background(), rttyCmdExecTimeout)
+			code, stdout, stderr, errCode = runCmd(ctx, t, msg.params, "schedule "+e.ID)
+			cancel()
+		}
+
+		<-rttyCmdSemaphore
+	default:
+		log.Warn().Msgf("command limit reached: %d, scheduled command %s skipped", rttyCmdRunningLimit, e.ID)
+	}
+
+	if errCode != rttyCmdErrNone {
+		audit.fail(cli, errCode)
+		attrs.Err = errCode
+		attrs.Msg = cmderr2str(errCode)
+	} else {
+		audit.Stdout = newCmdAuditOutput(stdout)
+		audit.Stderr = newCmdAuditOutput(stderr)
+		audit.exit(cli, code)
+		attrs.Code = &code
+	}
+
+	attrs.Stdout = base64.StdEncoding.EncodeToString(stdout[max(0, len(stdout)-rttyCmdScheduleOutputLimit):])
+	attrs.Stderr = base64.StdEncoding.EncodeToString(stderr[max(0, len(stderr)-rttyCmdScheduleOutputLimit):])
+
+	s.mu.Lock()
+	e.running = false
+	s.results = append(s.results, cmdReplyMsg{Token: token, Attrs: attrs})
+	if n := len(s.results) - rttyCmdScheduleResultLimit; n > 0 {
+		log.Warn().Msgf("%d results of scheduled commands dropped", n)
+		s.results = s.results[n:]
+	}
+	s.mu.Unlock()
+
+	s.report()
+}
+
+// online tells the schedule the device registered, the results waiting are
+// sent then
+func (s *cmdSchedule) online() {
+	s.mu.Lock()
+	s.connected = true
+	s.mu.Unlock()
+
+	s.report()
+}
+
+func (s *cmdSchedule) offline() {
+	s.mu.Lock()
+	s.connected = false
+	s.mu.Unlock()
+}
+
+// report sends the results waiting while the device is registered
+func (s *cmdSchedule) report() {
+	for {
+		s.mu.Lock()
+		if !s.connected || len(s.results) == 0 {
+			s.mu.Unlock()
+			return
+		}
+		res := s.results[0]
+		s.results = s.results[1:]
+		s.mu.Unlock()
+
+		if !writeCmdReply(s.cli, res.Token, res.Attrs) {
+			log.Error().Msgf("result of scheduled command too big, token: %.64s", res.Token)
+		}
+	}
+}
+
+// cmdScheduleWhen tells when an entry runs next after t, zero if never
+type cmdScheduleWhen interface {
+	next(t time.Time) time.Time
+}
+
+type everySpec time.Duration
+
+func (d everySpec) next(t time.Time) time.Time {
+	return t.Add(time.Duration(d))
+}
+
+func parseCmdScheduleWhen(when string) (cmdScheduleWhen, error) {
+	if alias, ok := cronAliases[when]; ok {
+		when = alias
+	}
+
+	if every, ok := strings.CutPrefix(when, "@every "); ok {
+		d, err := time.ParseDuration(strings.TrimSpace(every))
+		if err != nil {
+			return nil, fmt.Errorf("invalid interval '%s': %w", every, err)
+		}
+
+		if d < rttyCmdScheduleMinInterval {
+			return nil, fmt.Errorf("interval %v below %v", d, rttyCmdScheduleMinInterval)
+		}
+
+		return everySpec(d), nil
+	}
+
+	return parseCron(when)
+}
+
+// cronSpec is a cron expression: the minutes, hours, days of the month,
+// months and days of the week it matches, as bits
+type cronSpec struct {
+	minute, hour, dom, month, dow uint64
+	domStar, dowStar              bool
+}
+
+var cronFieldRanges = [5]struct{ min, max int }{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+
+// parseCron parses the 5 fields of a cron expression, each * or a list of
+// numbers and ranges, maybe with a step
+func parseCron(expr string) (*cronSpec, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid cron expression '%s'", expr)
+	}
+
+	var bits [5]uint64
+
+	for i, field := range fields {
+		lim := cronFieldRanges[i]
+
+		for part := range strings.SplitSeq(field, ",") {
+			rng, stepStr, hasStep := strings.Cut(part, "/")
+
+			step := 1
+			if hasStep {
+				n, err := strconv.Atoi(stepStr)
+				if err != nil || n < 1 {
+					return nil, fmt.Errorf("invalid cron step '%s'", part)
+				}
+				step = n
+			}
+
+			lo, hi := lim.min, lim.max
+
+			if rng != "*" {
+				a, b, isRange := strings.Cut(rng, "-")
+
+				n, err := strconv.Atoi(a)
+				if err != nil {
+					return nil, fmt.Errorf("invalid cron field '%s'", part)
+				}
+
+				lo, hi = n, n
+
+				if isRange {
+					if hi, err = strconv.Atoi(b); err != nil {
+						return nil, fmt.Errorf("invalid cron field '%s'", part)
+					}
+				} else if hasStep {
+					hi = lim.max
+				}
+
+				if lo < lim.min || hi > lim.max || lo > hi {
+					return nil, fmt.Errorf("cron field '%s' out of %d-%d", part, lim.min, lim.max)
+				}
+			}
+
+			for v := lo; v <= hi; v += step {
+				bits[i] |= 1 << v
+			}
+		}
+	}
+
+	// Sunday is 0 or 7
+	if bits[4]&(1<<7) != 0 {
+		bits[4] |= 1
+	}
+
+	return &cronSpec{
+		minute:  bits[0],
+		hour:    bits[1],
+		dom:     bits[2],
+		month:   bits[3],
+		dow:     bits[4],
+		domStar: strings.HasPrefix(fields[2], "*"),
+		dowStar: strings.HasPrefix(fields[4], "*"),
+	}, nil
+}
+
+// day tells whether the day of t matches, either of the day of the month
+// and the day of the week unless one starts with *, as with cron
+func (c *cronSpec) day(t time.Time) bool {
+	dom := c.dom&(1<<t.Day()) != 0
+	dow := c.dow&(1<<int(t.Weekday())) != 0
+
+	if c.domStar || c.dowStar {
+		return dom && dow
+	}
+
+	return dom || dow
+}
+
+func (c *cronSpec) next(t time.Time) time.Time {
+	t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute()+1, 0, 0, t.Location())
+
+	// Dates such as February 30 never come
+	for end := t.AddDate(5, 0, 0); t.Before(end); {
+		switch {
+		case c.month&(1<<int(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.day(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case c.hour&(1<<t.Hour()) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case c.minute&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+
+	return time.Time{}
+}
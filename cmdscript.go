@@ -0,0 +1,50 @@
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package main
+
+import (
+	"os"
+	"os/user"
+
+	"github.com/rs/zerolog/log"
+)
+
+// writeCmdScript writes the script the server sent along with a command to
+// a temporary file only u, who runs the command, has access to. It's given
+// to the command, the interpreter, before the params.
+func writeCmdScript(script []byte, u *user.User) (string, error) {
+	f, err := os.CreateTemp("", "rtty-script-")
+	if err != nil {
+		return "", err
+	}
+
+	_, err = f.Write(script)
+	if err == nil {
+		err = chownCmdFile(f, u)
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	return f.Name(), nil
+}
+
+// cleanup removes the script of the command once done with it
+func (msg *cmdMsg) cleanup() {
+	if msg.scriptPath == "" {
+		return
+	}
+
+	if err := os.Remove(msg.scriptPath); err != nil {
+		log.Warn().Err(err).Msgf("remove command script %s failed", msg.scriptPath)
+	}
+}
@@ -0,0 +1,153 @@
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package main
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Names of commands counted apart, the next ones are counted together
+	rttyCmdStatsLimit = 64
+	rttyCmdStatsOther = "(other)"
+)
+
+// CmdStats counts the commands of a name the server had run since start, by
+// a cmd message, a job, an exec session or its schedule. Errors are by what
+// kept them from running to their end, Codes by their exit codes but 0.
+type CmdStats struct {
+	Runs        uint64
+	Errors      map[string]uint64
+	Codes       map[int]uint64
+	Duration    time.Duration // of them all
+	MaxDuration time.Duration
+	Running     int
+	MaxRunning  int
+}
+
+type cmdStats struct {
+	mu   sync.Mutex
+	cmds map[string]*CmdStats
+}
+
+// cmdStatsName is what the command of msg is counted as: its name, or the
+// first word of the line of the shell
+func cmdStatsName(msg *cmdMsg) string {
+	if msg.shell {
+		if fields := strings.Fields(msg.name); len(fields) > 0 {
+			return fields[0]
+		}
+	}
+	return msg.name
+}
+
+func (s *cmdStats) get(name string) *CmdStats {
+	if s.cmds == nil {
+		s.cmds = make(map[string]*CmdStats)
+	}
+
+	if _, ok := s.cmds[name]; !ok && len(s.cmds) >= rttyCmdStatsLimit {
+		name = rttyCmdStatsOther
+	}
+
+	cs := s.cmds[name]
+	if cs == nil {
+		cs = &CmdStats{Errors: make(map[string]uint64), Codes: make(map[int]uint64)}
+		s.cmds[name] = cs
+	}
+
+	return cs
+}
+
+// start counts a command of name as running until done
+func (s *cmdStats) start(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cs := s.get(name)
+	cs.Running++
+	cs.MaxRunning = max(cs.MaxRunning, cs.Running)
+}
+
+// done counts the end of a command of name, as its audit a records
+func (s *cmdStats) done(name string, a *cmdAudit) {
+	d := time.Since(a.start)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cs := s.get(name)
+	cs.Running--
+	cs.Runs++
+	cs.Duration += d
+	cs.MaxDuration = max(cs.MaxDuration, d)
+
+	if a.Code == nil {
+		cs.Errors[a.Err]++
+	} else if *a.Code != 0 {
+		cs.Codes[*a.Code]++
+	}
+}
+
+func (s *cmdStats) snapshot() map[string]CmdStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cmds := make(map[string]CmdStats)
+
+	for name, cs := range s.cmds {
+		c := *cs
+		c.Errors = maps.Clone(cs.Errors)
+		c.Codes = maps.Clone(cs.Codes)
+		cmds[name] = c
+	}
+
+	return cmds
+}
+
+// Failures counts the runs which failed to run to their end or exited with
+// a code other than 0
+func (cs CmdStats) Failures() uint64 {
+	var n uint64
+
+	for _, v := range cs.Errors {
+		n += v
+	}
+
+	for _, v := range cs.Codes {
+		n += v
+	}
+
+	return n
+}
+
+func (cs CmdStats) String() string {
+	var sb strings.Builder
+
+	var avg time.Duration
+	if cs.Runs > 0 {
+		avg = cs.Duration / time.Duration(cs.Runs)
+	}
+
+	fmt.Fprintf(&sb, "runs %d, failures %d, avg %v, max %v, running %d, max running %d", cs.Runs,
+		cs.Failures(), avg.Round(time.Millisecond), cs.MaxDuration.Round(time.Millisecond), cs.Running,
+		cs.MaxRunning)
+
+	for _, err := range slices.Sorted(maps.Keys(cs.Errors)) {
+		fmt.Fprintf(&sb, ", %s %d", err, cs.Errors[err])
+	}
+
+	for _, code := range slices.Sorted(maps.Keys(cs.Codes)) {
+		fmt.Fprintf(&sb, ", exit %d: %d", code, cs.Codes[code])
+	}
+
+	return sb.String()
+}
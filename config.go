@@ -7,7 +7,10 @@ package main
 
 import (
 	"fmt"
+	"net"
+	"net/url"
 	"os"
+	"path/filepath"
 	"runtime"
 	"strings"
 
@@ -20,7 +23,7 @@ import (
 type Config struct {
 	group       string
 	id          string
-	host        string
+	hosts       []string
 	port        uint16
 	description string
 	token       string
@@ -28,11 +31,136 @@ type Config struct {
 	username    string
 	reconnect   bool
 
+	shell        string
+	shellArgs    []string
+	shellWrapper string
+	env          []string
+	labels       []string
+	runAs        string
+	noRoot       bool
+	chroot       string
+
+	// Terminal profiles by name, from the config file only
+	profiles map[string]*termProfile
+
+	commandAllow  []string
+	commandDeny   []string
+	commandFilter *commandFilter
+
+	recordDir   string
+	recordInput bool
+
+	auditDir    string
+	auditOutput bool
+
+	utmp bool
+
+	onSessionStart string
+	onSessionEnd   string
+	onFileReceived string
+	onFileSent     string
+
+	banner     string
+	bannerFile string
+
+	term               string
+	charset            string
+	clipboard          string
+	clipboardMaxSize   uint16
+	maxTtys            uint8
+	termTimeout        uint
+	termTimeoutWarning uint16
+	termCols           uint16
+	termRows           uint16
+	termKillDelay      uint16
+	sessionGrace       uint16
+	scrollback         uint16
+
+	serial       string
+	serialBaud   uint
+	serialParity string
+
+	reconnectDelay    uint16
+	reconnectMaxDelay uint16
+	reconnectJitter   uint8
+
+	dialTimeout  uint16
+	readTimeout  uint16
+	writeTimeout uint16
+
 	ssl      bool
 	cacert   string
 	sslcert  string
 	sslkey   string
 	insecure bool
+	systemCA bool
+
+	tpmDevice string
+
+	transport string
+	wsPath    string
+	proxy     string
+	autoProxy bool
+	dnsServer string
+
+	bindInterface string
+	bindAddress   string
+
+	backupInterface string
+
+	mqttTopic    string
+	mqttUsername string
+	mqttPassword string
+
+	sshJump       string
+	sshKey        string
+	sshKnownHosts string
+
+	keepaliveIdle     uint16
+	keepaliveInterval uint16
+	keepaliveCount    uint8
+
+	happyEyeballsDelay uint16
+
+	maxUploadRate     uint
+	maxDownloadRate   uint
+	maxTermRate       uint
+	fileMaxRate       uint
+	fileMaxTransfers  uint8
+	fileWindow        uint8
+	fileStallTimeout  uint16
+	filePreserveOwner bool
+	fileFifoDir       string
+	downloadDir       string
+	fileConfirm       bool
+	fileAllow         []string
+	fileSymlink       string
+	fileChannel       bool
+	fileDelta         bool
+	fileKey           string
+	fileStorage       string
+	fileS3AccessKey   string
+	fileS3SecretKey   string
+	fileS3Region      string
+	syncPush          []string
+	syncPull          []string
+	syncInterval      uint16
+	sftp              bool
+	sftpRoot          string
+	cmdAllow          []string
+	cmdDeny           []string
+	cmdUsers          []string
+	cmdUser           string
+	cmdEnv            []string
+	cmdSchedule       string
+	termCoalesce      uint16
+	termReadBuffer    uint16
+	termAckWindow     uint16
+	compress          bool
+	fileCompress      bool
+	fileExist         string
+
+	statsInterval uint16
 }
 
 func (cfg *Config) Parse(c *cli.Command) error {
@@ -48,20 +176,120 @@ func (cfg *Config) Parse(c *cli.Command) error {
 	}
 
 	fields := map[string]any{
-		"group":       &cfg.group,
-		"id":          &cfg.id,
-		"host":        &cfg.host,
-		"port":        &cfg.port,
-		"description": &cfg.description,
-		"token":       &cfg.token,
-		"heartbeat":   &cfg.heartbeat,
-		"username":    &cfg.username,
-		"reconnect":   &cfg.reconnect,
-		"ssl":         &cfg.ssl,
-		"cacert":      &cfg.cacert,
-		"cert":        &cfg.sslcert,
-		"key":         &cfg.sslkey,
-		"insecure":    &cfg.insecure,
+		"group":                  &cfg.group,
+		"id":                     &cfg.id,
+		"host":                   &cfg.hosts,
+		"port":                   &cfg.port,
+		"description":            &cfg.description,
+		"token":                  &cfg.token,
+		"heartbeat":              &cfg.heartbeat,
+		"username":               &cfg.username,
+		"shell":                  &cfg.shell,
+		"shell-args":             &cfg.shellArgs,
+		"shell-wrapper":          &cfg.shellWrapper,
+		"env":                    &cfg.env,
+		"session-label":          &cfg.labels,
+		"run-as":                 &cfg.runAs,
+		"chroot":                 &cfg.chroot,
+		"no-root":                &cfg.noRoot,
+		"command-allow":          &cfg.commandAllow,
+		"command-deny":           &cfg.commandDeny,
+		"record-dir":             &cfg.recordDir,
+		"record-input":           &cfg.recordInput,
+		"audit-dir":              &cfg.auditDir,
+		"audit-output":           &cfg.auditOutput,
+		"utmp":                   &cfg.utmp,
+		"on-session-start":       &cfg.onSessionStart,
+		"on-session-end":         &cfg.onSessionEnd,
+		"on-file-received":       &cfg.onFileReceived,
+		"on-file-sent":           &cfg.onFileSent,
+		"banner":                 &cfg.banner,
+		"banner-file":            &cfg.bannerFile,
+		"term":                   &cfg.term,
+		"charset":                &cfg.charset,
+		"clipboard":              &cfg.clipboard,
+		"clipboard-max-size":     &cfg.clipboardMaxSize,
+		"serial":                 &cfg.serial,
+		"serial-baud":            &cfg.serialBaud,
+		"serial-parity":          &cfg.serialParity,
+		"max-ttys":               &cfg.maxTtys,
+		"term-timeout":           &cfg.termTimeout,
+		"term-timeout-warning":   &cfg.termTimeoutWarning,
+		"term-cols":              &cfg.termCols,
+		"term-rows":              &cfg.termRows,
+		"term-kill-delay":        &cfg.termKillDelay,
+		"session-grace":          &cfg.sessionGrace,
+		"scrollback":             &cfg.scrollback,
+		"reconnect":              &cfg.reconnect,
+		"reconnect-delay":        &cfg.reconnectDelay,
+		"reconnect-max-delay":    &cfg.reconnectMaxDelay,
+		"reconnect-jitter":       &cfg.reconnectJitter,
+		"dial-timeout":           &cfg.dialTimeout,
+		"read-timeout":           &cfg.readTimeout,
+		"write-timeout":          &cfg.writeTimeout,
+		"ssl":                    &cfg.ssl,
+		"cacert":                 &cfg.cacert,
+		"cert":                   &cfg.sslcert,
+		"key":                    &cfg.sslkey,
+		"insecure":               &cfg.insecure,
+		"system-ca":              &cfg.systemCA,
+		"tpm-device":             &cfg.tpmDevice,
+		"transport":              &cfg.transport,
+		"ws-path":                &cfg.wsPath,
+		"proxy":                  &cfg.proxy,
+		"auto-proxy":             &cfg.autoProxy,
+		"dns-server":             &cfg.dnsServer,
+		"bind-interface":         &cfg.bindInterface,
+		"bind-address":           &cfg.bindAddress,
+		"backup-interface":       &cfg.backupInterface,
+		"mqtt-topic":             &cfg.mqttTopic,
+		"mqtt-username":          &cfg.mqttUsername,
+		"mqtt-password":          &cfg.mqttPassword,
+		"ssh-jump":               &cfg.sshJump,
+		"ssh-key":                &cfg.sshKey,
+		"ssh-known-hosts":        &cfg.sshKnownHosts,
+		"tcp-keepalive-idle":     &cfg.keepaliveIdle,
+		"tcp-keepalive-interval": &cfg.keepaliveInterval,
+		"tcp-keepalive-count":    &cfg.keepaliveCount,
+		"happy-eyeballs-delay":   &cfg.happyEyeballsDelay,
+		"max-upload-rate":        &cfg.maxUploadRate,
+		"max-download-rate":      &cfg.maxDownloadRate,
+		"max-term-rate":          &cfg.maxTermRate,
+		"file-max-rate":          &cfg.fileMaxRate,
+		"file-max-transfers":     &cfg.fileMaxTransfers,
+		"file-window":            &cfg.fileWindow,
+		"file-stall-timeout":     &cfg.fileStallTimeout,
+		"file-preserve-owner":    &cfg.filePreserveOwner,
+		"file-fifo-dir":          &cfg.fileFifoDir,
+		"download-dir":           &cfg.downloadDir,
+		"file-confirm":           &cfg.fileConfirm,
+		"file-allow":             &cfg.fileAllow,
+		"file-symlink":           &cfg.fileSymlink,
+		"file-channel":           &cfg.fileChannel,
+		"file-delta":             &cfg.fileDelta,
+		"file-key":               &cfg.fileKey,
+		"file-storage":           &cfg.fileStorage,
+		"file-s3-access-key":     &cfg.fileS3AccessKey,
+		"file-s3-secret-key":     &cfg.fileS3SecretKey,
+		"file-s3-region":         &cfg.fileS3Region,
+		"sync-push":              &cfg.syncPush,
+		"sync-pull":              &cfg.syncPull,
+		"sync-interval":          &cfg.syncInterval,
+		"sftp":                   &cfg.sftp,
+		"sftp-root":              &cfg.sftpRoot,
+		"cmd-allow":              &cfg.cmdAllow,
+		"cmd-deny":               &cfg.cmdDeny,
+		"cmd-users":              &cfg.cmdUsers,
+		"cmd-user":               &cfg.cmdUser,
+		"cmd-env":                &cfg.cmdEnv,
+		"cmd-schedule":           &cfg.cmdSchedule,
+		"term-coalesce":          &cfg.termCoalesce,
+		"term-read-buffer":       &cfg.termReadBuffer,
+		"term-ack-window":        &cfg.termAckWindow,
+		"compress":               &cfg.compress,
+		"file-compress":          &cfg.fileCompress,
+		"file-exist":             &cfg.fileExist,
+		"stats-interval":         &cfg.statsInterval,
 	}
 
 	for name, opt := range fields {
@@ -92,11 +320,238 @@ func (cfg *Config) Parse(c *cli.Command) error {
 		return fmt.Errorf("description too long: must be 1-126 characters")
 	}
 
+	switch cfg.transport {
+	case "tcp", "ws", "wss", "mqtt":
+	default:
+		return fmt.Errorf("invalid transport: %s, must be one of tcp, ws, wss, mqtt", cfg.transport)
+	}
+
+	if cfg.proxy != "" {
+		u, err := url.Parse(cfg.proxy)
+		if err != nil {
+			return fmt.Errorf("invalid proxy: %w", err)
+		}
+
+		switch u.Scheme {
+		case "http", "socks5", "socks5h":
+		default:
+			return fmt.Errorf("invalid proxy: unsupported scheme '%s', must be one of http, socks5, socks5h", u.Scheme)
+		}
+
+		if u.Host == "" {
+			return fmt.Errorf("invalid proxy: %s, expected scheme://[user:password@]host:port", cfg.proxy)
+		}
+	}
+
+	if cfg.dnsServer != "" {
+		if _, err := parseDNSServer(cfg.dnsServer); err != nil {
+			return err
+		}
+	}
+
+	if cfg.bindAddress != "" && net.ParseIP(cfg.bindAddress) == nil {
+		return fmt.Errorf("invalid bind address: %s", cfg.bindAddress)
+	}
+
+	if err := checkEnv(cfg.env); err != nil {
+		return err
+	}
+
+	for i, kv := range cfg.labels {
+		if name, _, ok := strings.Cut(kv, "="); !ok || name == "" {
+			return fmt.Errorf("invalid session label '%s', expected KEY=VALUE", kv)
+		}
+
+		cfg.labels[i] = os.ExpandEnv(kv)
+	}
+
+	cfg.commandFilter, err = newCommandFilter(cfg.commandAllow, cfg.commandDeny)
+	if err != nil {
+		return err
+	}
+
+	if cfg.runAs != "" && runtime.GOOS == "windows" {
+		return fmt.Errorf("run-as is not supported on Windows")
+	}
+
+	if cfg.chroot != "" {
+		if runtime.GOOS == "windows" {
+			return fmt.Errorf("chroot is not supported on Windows")
+		}
+
+		if st, err := os.Stat(cfg.chroot); err != nil || !st.IsDir() {
+			return fmt.Errorf("invalid chroot: %s is not a directory", cfg.chroot)
+		}
+
+		// Looking it up in the PATH would find the one of the host
+		if cfg.shell != "" && !filepath.IsAbs(cfg.shell) {
+			return fmt.Errorf("invalid shell: %s, must be an absolute path with chroot", cfg.shell)
+		}
+
+		if wrapper := strings.Fields(cfg.shellWrapper); len(wrapper) > 0 && !filepath.IsAbs(wrapper[0]) {
+			return fmt.Errorf("invalid shell wrapper: %s, must be an absolute path with chroot", wrapper[0])
+		}
+	}
+
+	if strings.TrimSpace(cfg.shellWrapper) != "" && runtime.GOOS == "windows" {
+		return fmt.Errorf("shell-wrapper is not supported on Windows")
+	}
+
+	if err := checkNoRoot(cfg); err != nil {
+		return err
+	}
+
+	if cfg.term == "" {
+		return fmt.Errorf("invalid term: must not be empty")
+	}
+
+	if cfg.charset != "" {
+		if _, err := lookupCharset(cfg.charset); err != nil {
+			return err
+		}
+	}
+
+	if err := checkClipboardConfig(cfg); err != nil {
+		return err
+	}
+
+	if err := checkFileExistConfig(cfg); err != nil {
+		return err
+	}
+
+	if err := checkFileAllowConfig(cfg); err != nil {
+		return err
+	}
+
+	if err := checkFileSymlinkConfig(cfg); err != nil {
+		return err
+	}
+
+	if cfg.fileFifoDir != "" && !filepath.IsAbs(cfg.fileFifoDir) {
+		return fmt.Errorf("invalid file-fifo-dir: %s, must be an absolute path", cfg.fileFifoDir)
+	}
+
+	if cfg.downloadDir != "" && !filepath.IsAbs(cfg.downloadDir) {
+		return fmt.Errorf("invalid download-dir: %s, must be an absolute path", cfg.downloadDir)
+	}
+
+	if err := checkSftpConfig(cfg); err != nil {
+		return err
+	}
+
+	if err := checkFileKeyConfig(cfg); err != nil {
+		return err
+	}
+
+	if err := checkFileStorageConfig(cfg); err != nil {
+		return err
+	}
+
+	if err := checkCmdPolicyConfig(cfg); err != nil {
+		return err
+	}
+
+	if err := checkEnv(cfg.cmdEnv); err != nil {
+		return err
+	}
+
+	if err := checkCmdScheduleConfig(cfg); err != nil {
+		return err
+	}
+
+	if err := checkFileSyncConfig(cfg); err != nil {
+		return err
+	}
+
+	if cfg.serial != "" {
+		if err := checkSerialConfig(cfg); err != nil {
+			return err
+		}
+	}
+
+	if cfg.termCols == 0 || cfg.termRows == 0 {
+		return fmt.Errorf("invalid terminal size: %dx%d", cfg.termCols, cfg.termRows)
+	}
+
+	// A read must fit in one message
+	if cfg.termReadBuffer == 0 || cfg.termReadBuffer > 63 {
+		return fmt.Errorf("invalid term read buffer: %dKB, must be 1 to 63", cfg.termReadBuffer)
+	}
+
+	if cfg.fileWindow == 0 {
+		return fmt.Errorf("invalid file window: must not be 0")
+	}
+
+	if cfg.termAckWindow == 0 {
+		return fmt.Errorf("invalid term ack window: must not be 0")
+	}
+
+	if len(cfg.hosts) == 0 {
+		return fmt.Errorf("you must specify at least one host")
+	}
+
+	// Each host may carry its own port, otherwise the global port is used.
+	// SRV names are resolved to host and port when connecting.
+	for i, host := range cfg.hosts {
+		if isSRVName(host) {
+			continue
+		}
+
+		if path, ok := strings.CutPrefix(host, unixHostPrefix); ok {
+			if path == "" {
+				return fmt.Errorf("invalid host: %s, expected unix:///path/to/socket", host)
+			}
+			continue
+		}
+
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			cfg.hosts[i] = net.JoinHostPort(host, fmt.Sprintf("%d", cfg.port))
+		}
+	}
+
+	if cfg.sshJump != "" && (cfg.sshKey == "" || cfg.sshKnownHosts == "") {
+		return fmt.Errorf("ssh-jump requires ssh-key and ssh-known-hosts")
+	}
+
+	// Without cacert the system store is all that's trusted anyway
+	if cfg.systemCA && cfg.cacert == "" {
+		return fmt.Errorf("system-ca requires cacert, the system certificate store is used without it")
+	}
+
+	if cfg.reconnectDelay < 1 {
+		cfg.reconnectDelay = 1
+		log.Warn().Msgf("reconnect delay too low, setting to minimum 1 second")
+	}
+
+	if cfg.reconnectMaxDelay < cfg.reconnectDelay {
+		cfg.reconnectMaxDelay = cfg.reconnectDelay
+	}
+
+	if cfg.reconnectJitter > 100 {
+		return fmt.Errorf("invalid reconnect jitter: must be 0-100 percent")
+	}
+
+	if cfg.dialTimeout < 1 {
+		cfg.dialTimeout = 1
+		log.Warn().Msgf("dial timeout too low, setting to minimum 1 second")
+	}
+
+	if cfg.readTimeout < 1 {
+		cfg.readTimeout = 1
+		log.Warn().Msgf("read timeout too low, setting to minimum 1 second")
+	}
+
 	if cfg.heartbeat < 5 {
 		cfg.heartbeat = 5
 		log.Warn().Msgf("heartbeat interval too low, setting to minimum 5 seconds")
 	}
 
+	if yamlCfg != nil {
+		if err := cfg.parseProfiles(yamlCfg); err != nil {
+			return err
+		}
+	}
+
 	if runtime.GOOS != "windows" && os.Getuid() != 0 {
 		return fmt.Errorf("operation not permitted, must be run as root")
 	}
@@ -121,6 +576,27 @@ func getConfigOpt(yamlCfg *yaml.File, name string, opt any) error {
 		if err == nil {
 			*opt = val
 		}
+	case *[]string:
+		var node yaml.Node
+		node, err = yaml.Child(yamlCfg.Root, name)
+		if err == nil {
+			switch node := node.(type) {
+			case nil:
+				err = &yaml.NodeNotFound{Full: name, Spec: name}
+			case yaml.List:
+				var vals []string
+				for i := range node.Len() {
+					if val, ok := node.Item(i).(yaml.Scalar); ok {
+						vals = append(vals, val.String())
+					}
+				}
+				*opt = vals
+			case yaml.Scalar:
+				*opt = parseConfigList(node.String())
+			default:
+				err = fmt.Errorf("expected a list")
+			}
+		}
 	case *int, *uint, *uint8, *uint16:
 		num, err = yamlCfg.GetInt(name)
 		if err == nil {
@@ -167,5 +643,25 @@ func getFlagOpt(c *cli.Command, name string, opt any) {
 		*opt = c.Uint16(name)
 	case *bool:
 		*opt = c.Bool(name)
+	case *[]string:
+		*opt = c.StringSlice(name)
+	}
+}
+
+// parseConfigList parses a list written on one line, e.g. ["a", "b"] or a, b
+func parseConfigList(s string) []string {
+	var vals []string
+
+	s = strings.TrimSpace(s)
+	s = strings.TrimPrefix(s, "[")
+	s = strings.TrimSuffix(s, "]")
+
+	for val := range strings.SplitSeq(s, ",") {
+		val = strings.Trim(strings.TrimSpace(val), `"'`)
+		if val != "" {
+			vals = append(vals, val)
+		}
 	}
+
+	return vals
 }
@@ -0,0 +1,233 @@
+//go:build windows
+// +build windows
+
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+// Package conpty runs a process attached to a Windows pseudo console.
+package conpty
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+const (
+	defaultCols = 80
+	defaultRows = 40
+)
+
+type ConPty struct {
+	hpc     windows.Handle
+	process windows.Handle
+	pid     int
+	in      windows.Handle // input of the console, written by us
+	out     windows.Handle // output of the console, read by us
+}
+
+type conPtyArgs struct {
+	cols, rows int
+	env        []string
+}
+
+type ConPtyOption func(args *conPtyArgs)
+
+func ConPtyDimensions(cols, rows int) ConPtyOption {
+	return func(args *conPtyArgs) {
+		args.cols = cols
+		args.rows = rows
+	}
+}
+
+// ConPtyEnv sets the environment of the process to env, each entry in the
+// form KEY=VALUE. Without it, the process inherits ours.
+func ConPtyEnv(env []string) ConPtyOption {
+	return func(args *conPtyArgs) {
+		args.env = env
+	}
+}
+
+// Start starts commandLine attached to a new pseudo console. Close must be
+// called to release it, which also ends the process.
+func Start(commandLine string, options ...ConPtyOption) (*ConPty, error) {
+	args := &conPtyArgs{cols: defaultCols, rows: defaultRows}
+
+	for _, opt := range options {
+		opt(args)
+	}
+
+	var ptyIn, ptyOut, in, out windows.Handle
+
+	if err := windows.CreatePipe(&ptyIn, &in, nil, 0); err != nil {
+		return nil, fmt.Errorf("CreatePipe: %w", err)
+	}
+
+	if err := windows.CreatePipe(&out, &ptyOut, nil, 0); err != nil {
+		closeHandles(ptyIn, in)
+		return nil, fmt.Errorf("CreatePipe: %w", err)
+	}
+
+	// The console holds its own references, with ours gone reading out
+	// ends once the console is closed
+	defer closeHandles(ptyIn, ptyOut)
+
+	var hpc windows.Handle
+
+	size := windows.Coord{X: int16(args.cols), Y: int16(args.rows)}
+
+	if err := windows.CreatePseudoConsole(size, ptyIn, ptyOut, 0, &hpc); err != nil {
+		closeHandles(in, out)
+		return nil, fmt.Errorf("CreatePseudoConsole: %w", err)
+	}
+
+	pi, err := createProcess(hpc, commandLine, args.env)
+	if err != nil {
+		windows.ClosePseudoConsole(hpc)
+		closeHandles(in, out)
+		return nil, fmt.Errorf("create process: %w", err)
+	}
+
+	windows.CloseHandle(pi.Thread)
+
+	return &ConPty{
+		hpc:     hpc,
+		process: pi.Process,
+		pid:     int(pi.ProcessId),
+		in:      in,
+		out:     out,
+	}, nil
+}
+
+func createProcess(hpc windows.Handle, commandLine string, env []string) (*windows.ProcessInformation, error) {
+	cmdline, err := windows.UTF16PtrFromString(commandLine)
+	if err != nil {
+		return nil, err
+	}
+
+	flags := uint32(windows.EXTENDED_STARTUPINFO_PRESENT)
+
+	var block *uint16
+
+	if env != nil {
+		block, err = envBlock(env)
+		if err != nil {
+			return nil, err
+		}
+		flags |= windows.CREATE_UNICODE_ENVIRONMENT
+	}
+
+	attrs, err := windows.NewProcThreadAttributeList(1)
+	if err != nil {
+		return nil, err
+	}
+	defer attrs.Delete()
+
+	// The value of the attribute is the handle itself, not a pointer to it
+	err = attrs.Update(windows.PROC_THREAD_ATTRIBUTE_PSEUDOCONSOLE,
+		*(*unsafe.Pointer)(unsafe.Pointer(&hpc)), unsafe.Sizeof(hpc))
+	if err != nil {
+		return nil, err
+	}
+
+	si := &windows.StartupInfoEx{ProcThreadAttributeList: attrs.List()}
+	si.Cb = uint32(unsafe.Sizeof(*si))
+
+	var pi windows.ProcessInformation
+
+	err = windows.CreateProcess(nil, cmdline, nil, nil, false, flags, block, nil, &si.StartupInfo, &pi)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pi, nil
+}
+
+// envBlock builds the environment block CreateProcess takes: each entry
+// ended by a NUL, then one more NUL
+func envBlock(env []string) (*uint16, error) {
+	var block []uint16
+
+	for _, kv := range env {
+		s, err := windows.UTF16FromString(kv)
+		if err != nil {
+			return nil, fmt.Errorf("environment variable %q: %w", kv, err)
+		}
+		block = append(block, s...)
+	}
+
+	if len(block) == 0 {
+		block = append(block, 0)
+	}
+
+	block = append(block, 0)
+
+	return &block[0], nil
+}
+
+func closeHandles(handles ...windows.Handle) {
+	for _, h := range handles {
+		windows.CloseHandle(h)
+	}
+}
+
+// Close closes the console, which ends the process.
+func (c *ConPty) Close() error {
+	windows.ClosePseudoConsole(c.hpc)
+	closeHandles(c.in, c.out, c.process)
+	return nil
+}
+
+// Wait waits for the process to exit and returns its exit code.
+func (c *ConPty) Wait(ctx context.Context) (uint32, error) {
+	for {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+
+		ev, err := windows.WaitForSingleObject(c.process, 1000)
+		if err != nil {
+			return 0, err
+		}
+
+		if ev != uint32(windows.WAIT_TIMEOUT) {
+			var code uint32
+			err := windows.GetExitCodeProcess(c.process, &code)
+			return code, err
+		}
+	}
+}
+
+// Pid returns the process ID of the process.
+func (c *ConPty) Pid() int {
+	return c.pid
+}
+
+func (c *ConPty) Resize(cols, rows int) error {
+	return windows.ResizePseudoConsole(c.hpc, windows.Coord{X: int16(cols), Y: int16(rows)})
+}
+
+func (c *ConPty) Read(p []byte) (int, error) {
+	var n uint32
+
+	err := windows.ReadFile(c.out, p, &n, nil)
+	if errors.Is(err, windows.ERROR_BROKEN_PIPE) {
+		return int(n), io.EOF
+	}
+
+	return int(n), err
+}
+
+func (c *ConPty) Write(p []byte) (int, error) {
+	var n uint32
+
+	err := windows.WriteFile(c.in, p, &n, nil)
+
+	return int(n), err
+}
@@ -0,0 +1,93 @@
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package main
+
+import (
+	"fmt"
+	"os/user"
+	"runtime"
+	"slices"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Commands that run others with more privileges, logged under no-root
+var elevationCommands = []string{"su", "sudo", "doas", "pkexec", "run0"}
+
+// checkNoRoot makes sure no terminal can start as root. The shell runs as
+// root unless started as run-as, or through login for a given username.
+func checkNoRoot(cfg *Config) error {
+	if !cfg.noRoot || cfg.serial != "" {
+		return nil
+	}
+
+	if runtime.GOOS == "windows" {
+		return fmt.Errorf("no-root is not supported on Windows")
+	}
+
+	if cfg.runAs != "" {
+		return checkNotRoot(cfg.runAs)
+	}
+
+	if cfg.username == "" || cfg.shell != "" || cfg.chroot != "" {
+		return fmt.Errorf("no-root requires run-as, or username without shell and chroot")
+	}
+
+	return checkNotRoot(cfg.username)
+}
+
+func checkNotRoot(name string) error {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return fmt.Errorf("no-root: %w", err)
+	}
+
+	if u.Uid == "0" {
+		return fmt.Errorf("no-root: %s is root", name)
+	}
+
+	return nil
+}
+
+// watchElevation logs the elevation commands run in the terminal until its
+// processes are all gone. They are looked for once a second, so ones exiting
+// at once may go unnoticed.
+func (s *TermSession) watchElevation() {
+	pid := s.term.Pid()
+	if pid == 0 {
+		return
+	}
+
+	seen := make(map[int]bool)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		procs := sessionProcs(pid)
+		if len(procs) == 0 {
+			return
+		}
+
+		for p, comm := range procs {
+			if seen[p] || !slices.Contains(elevationCommands, comm) {
+				continue
+			}
+
+			seen[p] = true
+
+			log.Warn().Msgf("privilege elevation in tty %s: %s(%d)", s.sid, comm, p)
+			s.audit.write("elevate", fmt.Sprintf("%s(%d)", comm, p))
+		}
+
+		for p := range seen {
+			if _, ok := procs[p]; !ok {
+				delete(seen, p)
+			}
+		}
+	}
+}
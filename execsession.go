@@ -0,0 +1,312 @@
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os/exec"
+	"os/user"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/valyala/bytebufferpool"
+	"github.com/zhaojh329/rtty-go/proto"
+)
+
+const (
+	rttyExecRunningLimit = 5
+	// Output still coming once the command exited, from what it left behind
+	rttyExecWaitDelay = 5 * time.Second
+	// Messages of input waiting for the command to read them, it's killed
+	// beyond rather than the connection waiting for it
+	rttyExecInputQueue = 64
+)
+
+// An exec session runs a command with its stdin, stdout and stderr relayed
+// through messages of its sid, for tools asking questions on the way. There
+// is neither a pty nor a login, and it doesn't count against max-ttys. The
+// server opens one by a login with MsgLoginAttrExec, and the command is
+// killed on logout, once the connection is gone, or once it leaves too much
+// input unread.
+type execSession struct {
+	cli    *RttyClient
+	sid    string
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	cancel context.CancelFunc
+	audit  *cmdAudit
+	stdout execOutput
+	stderr execOutput
+
+	// Written to stdin by writeInput, only touched by the message reader
+	inputs chan []byte
+	eof    bool // no more input is taken
+}
+
+// execOutput sends what the command writes to stdout or stderr, hashing it
+// for the audit
+type execOutput struct {
+	s      *execSession
+	stderr bool
+	size   int64
+	sum    hash.Hash
+}
+
+func (o *execOutput) Write(p []byte) (int, error) {
+	o.size += int64(len(p))
+	o.sum.Write(p)
+
+	if o.stderr {
+		o.s.cli.WriteMsg(proto.MsgTypeExec, o.s.sid, proto.MsgExecStderr, p)
+	} else {
+		o.s.cli.WriteMsg(proto.MsgTypeTermData, o.s.sid, p)
+	}
+
+	return len(p), nil
+}
+
+func (o *execOutput) auditOutput() *cmdAuditOutput {
+	return &cmdAuditOutput{Size: o.size, SHA256: hex.EncodeToString(o.sum.Sum(nil))}
+}
+
+// parseExecAttr parses the username, command and args, each ending with a
+// NUL, of MsgLoginAttrExec
+func parseExecAttr(val []byte) (*cmdMsg, error) {
+	parts := strings.Split(string(bytes.TrimSuffix(val, []byte{0})), "\x00")
+	if len(parts) < 2 || parts[1] == "" {
+		return nil, fmt.Errorf("invalid exec '%q'", val)
+	}
+
+	return &cmdMsg{username: parts[0], name: parts[1], params: parts[2:]}, nil
+}
+
+// startExec opens the exec session sid running the command of val, as
+// commands the server runs are, with the variables env of the login after
+// theirs
+func (cli *RttyClient) startExec(sid string, val []byte, env []string) error {
+	msg, err := parseExecAttr(val)
+	if err != nil {
+		log.Error().Err(err).Msg("invalid login msg")
+		return cli.WriteMsg(proto.MsgTypeLogin, sid, byte(1))
+	}
+
+	// The sid of a terminal or of another session isn't taken over
+	_, inUse := cli.sessions.Load(sid)
+	if !inUse {
+		_, inUse = cli.observers.Load(sid)
+	}
+	if !inUse {
+		_, inUse = cli.execs.Load(sid)
+	}
+
+	if inUse {
+		log.Error().Msgf("exec %s: sid already in use", sid)
+		return cli.WriteMsg(proto.MsgTypeLogin, sid, byte(1))
+	}
+
+	msg.token = sid
+	msg.username = cmdUser(&cli.cfg, msg.username)
+
+	audit := newCmdAudit(cli, msg)
+
+	u, err := user.Lookup(msg.username)
+	if err != nil {
+		log.Error().Err(err).Msgf("exec %s: user %s not found", sid, msg.username)
+		audit.fail(cli, rttyCmdErrPermit)
+		return cli.WriteMsg(proto.MsgTypeLogin, sid, byte(1))
+	}
+
+	cmdPath, err := exec.LookPath(msg.name)
+	if cmdPath == "" {
+		log.Error().Err(err).Msgf("exec %s: command not found: %s", sid, msg.name)
+		audit.fail(cli, rttyCmdErrNotFound)
+		return cli.WriteMsg(proto.MsgTypeLogin, sid, byte(1))
+	}
+
+	audit.Path = cmdPath
+
+	if err := cmdAllowed(&cli.cfg, msg.name, cmdPath, msg.username); err != nil {
+		log.Warn().Err(err).Msgf("exec %s: refused command: %s, username: %s", sid, msg.name, msg.username)
+		audit.fail(cli, rttyCmdErrPermit)
+		return cli.WriteMsg(proto.MsgTypeLogin, sid, byte(1))
+	}
+
+	cli.mu.Lock()
+	full := cli.nexec >= rttyExecRunningLimit
+	if !full {
+		cli.nexec++
+	}
+	cli.mu.Unlock()
+
+	if full {
+		log.Error().Msgf("maximum number of exec sessions reached: %d", rttyExecRunningLimit)
+		audit.fail(cli, rttyCmdErrNoMem)
+		return cli.WriteMsg(proto.MsgTypeLogin, sid, byte(1))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	s := &execSession{
+		cli:    cli,
+		sid:    sid,
+		cmd:    exec.CommandContext(ctx, cmdPath, msg.params...),
+		cancel: cancel,
+		audit:  audit,
+		inputs: make(chan []byte, rttyExecInputQueue),
+	}
+
+	s.stdout = execOutput{s: s, sum: sha256.New()}
+	s.stderr = execOutput{s: s, stderr: true, sum: sha256.New()}
+
+	// The server's variables come last to take precedence
+	s.cmd.Env = append(append(cmdEnv(u), cli.cfg.cmdEnv...), env...)
+	s.cmd.Stdout = &s.stdout
+	s.cmd.Stderr = &s.stderr
+	s.cmd.WaitDelay = rttyExecWaitDelay
+
+	release, err := setSysProcAttr(s.cmd, u)
+	if err == nil {
+		s.stdin, err = s.cmd.StdinPipe()
+		if err == nil {
+			err = s.cmd.Start()
+		}
+		release()
+	}
+
+	if err != nil {
+		log.Error().Err(err).Msgf("exec %s: start %s failed", sid, cmdPath)
+		cancel()
+		cli.mu.Lock()
+		cli.nexec--
+		cli.mu.Unlock()
+		audit.fail(cli, rttyCmdErrSysErr)
+		return cli.WriteMsg(proto.MsgTypeLogin, sid, byte(1))
+	}
+
+	cli.execs.Store(sid, s)
+
+	log.Info().Msgf("new exec session %s, running %s, username: %s", sid, cmdPath, msg.username)
+
+	bb := bytebufferpool.Get()
+	defer bytebufferpool.Put(bb)
+
+	bb.WriteByte(0)
+
+	putMsgAttr(bb, proto.MsgLoginReplyAttrLabel, "backend=exec")
+	putMsgAttr(bb, proto.MsgLoginReplyAttrLabel, "cmd="+cmdPath)
+	putMsgAttr(bb, proto.MsgLoginReplyAttrLabel, "user="+msg.username)
+
+	cli.WriteMsg(proto.MsgTypeLogin, sid, bb)
+
+	go s.wait()
+	go s.writeInput(ctx.Done())
+
+	return nil
+}
+
+// wait sends the code of the command once it exited, then logs out unless
+// the server did already
+func (s *execSession) wait() {
+	cli := s.cli
+
+	s.cmd.Wait()
+	s.cancel()
+
+	code := s.cmd.ProcessState.ExitCode()
+
+	cli.mu.Lock()
+	cli.nexec--
+	cli.mu.Unlock()
+
+	s.audit.Stdout = s.stdout.auditOutput()
+	s.audit.Stderr = s.stderr.auditOutput()
+	s.audit.exit(cli, code)
+
+	if _, loaded := cli.execs.LoadAndDelete(s.sid); loaded {
+		cli.WriteMsg(proto.MsgTypeExec, s.sid, proto.MsgExecExit, uint32(int32(code)))
+		cli.WriteMsg(proto.MsgTypeLogout, s.sid)
+	}
+
+	log.Info().Msgf("delete exec session %s", s.sid)
+}
+
+func handleExecMsg(cli *RttyClient, data []byte) error {
+	sid := string(data[:32])
+
+	val, ok := cli.execs.Load(sid)
+	if !ok {
+		log.Error().Msgf("exec session %s not found", sid)
+		return nil
+	}
+
+	switch data[32] {
+	case proto.MsgExecEOF:
+		val.(*execSession).endInput()
+	default:
+		log.Error().Msgf("unexpected exec message %d for %s", data[32], sid)
+	}
+
+	return nil
+}
+
+// input queues data for the stdin of the command. The command is killed
+// once it leaves too much unread, the other sessions mustn't wait for it.
+func (s *execSession) input(data []byte) {
+	if s.eof {
+		return
+	}
+
+	select {
+	case s.inputs <- slices.Clone(data):
+	default:
+		log.Error().Msgf("exec %s: command not reading its input, killed", s.sid)
+		s.eof = true
+		s.cancel()
+	}
+}
+
+// endInput closes stdin once the input queued is written
+func (s *execSession) endInput() {
+	if !s.eof {
+		s.eof = true
+		close(s.inputs)
+	}
+}
+
+// writeInput writes the input queued to stdin until its end, or that of
+// the command
+func (s *execSession) writeInput(done <-chan struct{}) {
+	defer s.stdin.Close()
+
+	for {
+		select {
+		case data, ok := <-s.inputs:
+			if !ok {
+				return
+			}
+
+			if _, err := s.stdin.Write(data); err != nil {
+				log.Debug().Err(err).Msgf("exec %s: write stdin failed", s.sid)
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// close kills the command, the server logged out or is gone
+func (s *execSession) close() {
+	s.cli.execs.Delete(s.sid)
+	s.cancel()
+}
@@ -0,0 +1,1439 @@
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/zhaojh329/rtty-go/proto"
+	"github.com/zhaojh329/rtty-go/utils"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	MsgTypeFileCtlRequestAccept = byte(iota)
+	MsgTypeFileCtlProgress
+	MsgTypeFileCtlInfo
+	MsgTypeFileCtlBusy
+	MsgTypeFileCtlAbort
+	MsgTypeFileCtlNoSpace
+	MsgTypeFileCtlErrExist
+	MsgTypeFileCtlErr
+	MsgTypeFileCtlTooLarge
+	MsgTypeFileCtlExist      // Name of the file already there, rtty -R answers what to do
+	MsgTypeFileCtlSkipped    // The file was already there and left alone
+	MsgTypeFileCtlSaveDir    // Directory files are saved into rather than the current one
+	MsgTypeFileCtlConfirm    // Size and name of the file to receive, rtty -R answers whether to
+	MsgTypeFileCtlDeclined   // rtty -R didn't want the file
+	MsgTypeFileCtlNotAllowed // Name of a file file-allow refuses
+	MsgTypeFileCtlSymlink    // file-symlink refuses symbolic links
+	MsgTypeFileCtlBadName    // Name of a file that can't be saved under it
+	MsgTypeFileCtlChecksum   // SHA-256 of the data, before the last progress
+	MsgTypeFileCtlStalled    // Nothing came from the server for file-stall-timeout
+)
+
+const (
+	// Unless the server takes 64-bit sizes
+	fileSizeLimit int64 = 2 * 1024 * 1024 * 1024 // 2 GB
+
+	fileCtlMsgSize = 129
+
+	// How often the server is told how a transfer goes
+	fileProgressInterval = time.Second
+)
+
+var (
+	errFileTooLarge = errors.New("file too large")
+	errFileBusy     = errors.New("too many file transfers")
+	errFileSymlink  = errors.New("symbolic link")
+	errFileSpecial  = errors.New("not a regular file")
+	errFileName     = errors.New("invalid file name")
+)
+
+func handleFileMsg(cli *RttyClient, data []byte) error {
+	sid := string(data[:32])
+	typ := data[32]
+
+	var s *TermSession
+
+	if sid == proto.FileSyncSid && cli.sync != nil {
+		s = cli.sync.ses
+	} else {
+		val, ok := cli.sessions.Load(sid)
+		if !ok {
+			log.Error().Msgf("terminal session %s not found", sid)
+			return nil
+		}
+
+		s = val.(*TermSession)
+	}
+
+	data = data[33:]
+
+	var id byte
+
+	if cli.fileId.Load() {
+		if len(data) < 1 {
+			log.Error().Msgf("invalid file msg for %s", sid)
+			return nil
+		}
+
+		id = data[0]
+		data = data[1:]
+	}
+
+	ctx := s.files.get(id)
+	if ctx == nil {
+		log.Debug().Msgf("file transfer %d of %s not found", id, sid)
+		return nil
+	}
+
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	ctx.lastActive = time.Now()
+
+	switch typ {
+	case proto.MsgTypeFileInfo:
+		ctx.startDownload(data)
+
+	case proto.MsgTypeFileData:
+		if len(data) > 0 {
+			ctx.recvData(data)
+		} else {
+			ctx.reset()
+		}
+
+	case proto.MsgTypeFileAck:
+		ctx.acked()
+
+	case proto.MsgTypeFileAbort:
+		ctx.sendControlMsg(MsgTypeFileCtlAbort, nil)
+		ctx.reset()
+	}
+
+	return nil
+}
+
+// fileTransfers are the file transfers going on in a terminal
+type fileTransfers struct {
+	fileListener
+
+	ses  *TermSession
+	mu   sync.Mutex
+	ctxs map[byte]*RttyFileContext
+	next byte // Ids go round, so a late message of a transfer doesn't reach the next
+
+	// Told about the end of each transfer, with its context locked
+	ended func(*RttyFileContext)
+}
+
+// start returns the context of a new transfer, unless the terminal or the
+// device has too many going on already
+func (fs *fileTransfers) start() (*RttyFileContext, error) {
+	cli := fs.ses.cli
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	// Without ids, the server can't tell the transfers of a terminal apart
+	max := 1
+	if cli.fileId.Load() {
+		max = 256
+	}
+
+	if len(fs.ctxs) >= max {
+		return nil, errFileBusy
+	}
+
+	n := cli.fileTransfers.Add(1)
+	if cli.cfg.fileMaxTransfers > 0 && n > int32(cli.cfg.fileMaxTransfers) {
+		cli.fileTransfers.Add(-1)
+		return nil, errFileBusy
+	}
+
+	if fs.ctxs == nil {
+		fs.ctxs = make(map[byte]*RttyFileContext)
+	}
+
+	var id byte
+
+	if cli.fileId.Load() {
+		id = fs.next
+		for fs.ctxs[id] != nil {
+			id++
+		}
+		fs.next = id + 1
+	}
+
+	ctx := &RttyFileContext{ses: fs.ses, files: fs, id: id}
+
+	fs.ctxs[id] = ctx
+
+	return ctx, nil
+}
+
+func (fs *fileTransfers) get(id byte) *RttyFileContext {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return fs.ctxs[id]
+}
+
+func (fs *fileTransfers) end(ctx *RttyFileContext) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.ctxs[ctx.id] == ctx {
+		delete(fs.ctxs, ctx.id)
+		fs.ses.cli.fileTransfers.Add(-1)
+
+		if fs.ended != nil {
+			fs.ended(ctx)
+		}
+	}
+}
+
+// reset stops all the transfers
+func (fs *fileTransfers) reset() {
+	fs.mu.Lock()
+	ctxs := make([]*RttyFileContext, 0, len(fs.ctxs))
+	for _, ctx := range fs.ctxs {
+		ctxs = append(ctxs, ctx)
+	}
+	fs.mu.Unlock()
+
+	for _, ctx := range ctxs {
+		ctx.mu.Lock()
+		ctx.reset()
+		ctx.mu.Unlock()
+	}
+}
+
+type RttyFileContext struct {
+	fileRequest
+
+	mu         sync.Mutex // Held handling file messages, and the answer of rtty -R
+	ses        *TermSession
+	files      *fileTransfers
+	id         byte
+	file       *os.File
+	ctl        io.WriteCloser // Control messages to the rtty -R/-S process
+	uid        uint32
+	gid        uint32
+	totalSize  uint64
+	remainSize uint64
+	savepath   string
+	compress   byte // How the data frames of the transfer are compressed
+	meta       *fileMeta
+	partial    string // The file downloaded into until complete
+	overwrite  bool
+	buf        [1024 * 63]byte
+	zbuf       []byte
+
+	// What to do when the file is already there, and the name asked about
+	// until rtty -R answers, whether to receive it when confirming, with the
+	// data coming in meanwhile
+	exist      byte
+	asking     string
+	confirming bool
+	askTimer   *time.Timer
+	pending    [][]byte
+
+	sent     int  // Size of the last data frame uploaded
+	done     bool // The transfer is over, what was throttled doesn't go on
+	complete bool // All of the file was transferred
+
+	// Data frames uploaded the server didn't acknowledge yet, a frame of the
+	// stream being read, and the end of the file waiting for the rest to be
+	// acknowledged
+	inflight int
+	reading  bool
+	ending   bool
+
+	// Uploading what rtty -S - reads, of which totalSize is what was sent
+	// so far, until eof
+	stream bool
+	eof    bool
+
+	// The stdout of rtty -R -O - downloaded into rather than a file, and a
+	// frame being written to it, which may take its time
+	output  string
+	writing bool
+
+	// The data frames are encrypted under a key of their own with file-key
+	crypt *fileCrypt
+
+	// The file-storage rtty -R saves into rather than a directory, and the
+	// file going into it
+	store  fileStorage
+	stored *storedFile
+
+	// The file a delta download replaces, which the server copies blocks of
+	basis *os.File
+	block uint32
+
+	// What on-file-received/sent is told about: the name the file was
+	// transferred under, the file uploaded, - for a stream, and the checksum
+	// of the data, which rtty -R/-S shows as well
+	name   string
+	source string
+	sum    hash.Hash
+
+	// Waiting for rtty for file-max-rate, and signing the file a delta
+	// download replaces, which isn't a stall
+	throttled bool
+	signing   bool
+
+	// When a file message was last sent or received, see watchStall
+	stallTimer *time.Timer
+	lastActive time.Time
+
+	startTime  time.Time
+	lastReport time.Time
+}
+
+func (ctx *RttyFileContext) startDownload(data []byte) {
+	cli := ctx.ses.cli
+
+	if err := checkFileCrypt(cli); err != nil {
+		log.Error().Err(err).Msg("refused to download file")
+		ctx.send(proto.MsgTypeFileAbort, nil)
+		ctx.sendControlMsg(MsgTypeFileCtlErr, nil)
+		ctx.reset()
+		return
+	}
+
+	sizeLen := 4
+	if cli.file64.Load() {
+		sizeLen = 8
+	}
+
+	// The compression flag, the key of the transfer and the meta come ahead
+	// of the name
+	nameOff := sizeLen
+	if cli.fileCompress.Load() != uint32(proto.FileCompressNone) {
+		nameOff++
+	}
+
+	keyOff := nameOff
+	if cli.fileCrypt.Load() {
+		nameOff += proto.FileCryptSealedKeySize
+	}
+
+	metaOff := nameOff
+	if ctx.ses.cli.fileMeta.Load() {
+		nameOff += fileMetaMinSize
+	}
+
+	if len(data) < nameOff {
+		log.Error().Msg("invalid file info")
+		ctx.sendControlMsg(MsgTypeFileCtlErr, nil)
+		ctx.reset()
+		return
+	}
+
+	if keyOff > sizeLen {
+		ctx.compress = data[sizeLen]
+
+		if ctx.compress > proto.FileCompressZstd {
+			log.Error().Msgf("unsupported file compression: %d", ctx.compress)
+			ctx.sendControlMsg(MsgTypeFileCtlErr, nil)
+			ctx.reset()
+			return
+		}
+	}
+
+	if sizeLen == 8 {
+		ctx.totalSize = binary.BigEndian.Uint64(data)
+	} else {
+		ctx.totalSize = uint64(binary.BigEndian.Uint32(data))
+	}
+	ctx.remainSize = ctx.totalSize
+
+	var err error
+
+	if metaOff > keyOff {
+		ctx.crypt, err = openFileCryptKey(cli.cfg.fileKey, data[keyOff:metaOff])
+		if err != nil {
+			log.Error().Err(err).Msg("invalid file info")
+			ctx.send(proto.MsgTypeFileAbort, nil)
+			ctx.sendControlMsg(MsgTypeFileCtlErr, nil)
+			ctx.reset()
+			return
+		}
+	}
+
+	if ctx.output == "" && ctx.store == nil {
+		err = utils.CheckSpaceAvailable(ctx.savepath, ctx.totalSize)
+		if err != nil {
+			log.Error().Err(err).Msgf("download file fail for %s", ctx.savepath)
+			ctx.sendControlMsg(MsgTypeFileCtlNoSpace, nil)
+			ctx.reset()
+			return
+		}
+	}
+
+	name := string(data[nameOff:])
+
+	if nameOff > metaOff {
+		ctx.meta, data, err = parseFileMeta(data[metaOff:])
+		if err != nil {
+			log.Error().Err(err).Msg("invalid file info")
+			ctx.sendControlMsg(MsgTypeFileCtlErr, nil)
+			ctx.reset()
+			return
+		}
+
+		name = string(data)
+
+		// Only root may give files away
+		if ctx.meta.owner != "" && ctx.ses.cli.cfg.filePreserveOwner && ctx.uid == 0 {
+			uid, gid, err := lookupOwner(ctx.meta.owner)
+			if err != nil {
+				log.Warn().Err(err).Msgf("keeping the owner of file %s", name)
+			} else {
+				ctx.uid = uid
+				ctx.gid = gid
+			}
+		}
+	}
+
+	clean, err := sanitizeFileName(name)
+	if err != nil {
+		log.Error().Err(err).Msgf("refused file %q", name)
+		ctx.send(proto.MsgTypeFileAbort, nil)
+		ctx.sendControlMsg(MsgTypeFileCtlBadName, []byte(name))
+		ctx.reset()
+		return
+	}
+
+	name = clean
+
+	if ctx.output == "" && ctx.store == nil {
+		ctx.savepath = filepath.Join(ctx.savepath, name)
+	}
+
+	ctx.receive(name)
+}
+
+// sanitizeFileName returns the name to save a file the server sent under,
+// which lands in the directory it's saved into whatever the sender put in it.
+// Directories before the name are dropped, a name leading elsewhere, or
+// with control characters, which would get to the terminal, is refused.
+func sanitizeFileName(name string) (string, error) {
+	if strings.ContainsFunc(name, unicode.IsControl) {
+		return "", fmt.Errorf("%w: control characters", errFileName)
+	}
+
+	elems := strings.FieldsFunc(name, func(r rune) bool {
+		return r == '/' || r == '\\'
+	})
+
+	if slices.Contains(elems, "..") {
+		return "", fmt.Errorf("%w: parent directory", errFileName)
+	}
+
+	if len(elems) == 0 {
+		return "", fmt.Errorf("%w: empty", errFileName)
+	}
+
+	name = elems[len(elems)-1]
+
+	// Reserved names of Windows and drives aren't local either
+	if name == "." || !filepath.IsLocal(name) {
+		return "", fmt.Errorf("%w: not local", errFileName)
+	}
+
+	return name, nil
+}
+
+// startRecv asks the server for the file to save into dir, the directory
+// rtty -R runs in, unless download-dir forces another one, or file-storage
+// saves it elsewhere
+func (ctx *RttyFileContext) startRecv(dir string) {
+	cfg := &ctx.ses.cli.cfg
+	forced := cfg.downloadDir
+
+	// Checked with the config
+	ctx.store, _ = newFileStorage(cfg)
+
+	if ctx.store != nil {
+		forced = cfg.fileStorage
+	} else if forced != "" {
+		dir = forced
+	}
+
+	ctx.savepath = dir
+
+	ctx.sendControlMsg(MsgTypeFileCtlRequestAccept, nil)
+
+	if forced != "" {
+		ctx.sendControlMsg(MsgTypeFileCtlSaveDir, []byte(forced))
+	}
+
+	ctx.send(proto.MsgTypeFileRecv, nil)
+}
+
+// startOutput asks the server for the file to write into path, the stdout
+// of rtty -R -O -
+func (ctx *RttyFileContext) startOutput(path string) {
+	ctx.output = path
+	ctx.savepath = path
+
+	ctx.sendControlMsg(MsgTypeFileCtlRequestAccept, nil)
+
+	ctx.send(proto.MsgTypeFileRecv, nil)
+}
+
+// openOutput downloads name into the stdout of rtty -R -O -
+func (ctx *RttyFileContext) openOutput(name string) {
+	fd, err := os.OpenFile(ctx.output, os.O_WRONLY, 0)
+	if err != nil {
+		log.Error().Err(err).Msgf("failed to open %s for writing", ctx.output)
+		ctx.sendControlMsg(MsgTypeFileCtlErr, nil)
+		ctx.reset()
+		return
+	}
+
+	ctx.opened(fd, name)
+}
+
+// create opens a hidden file next to savepath to download into, which only
+// becomes savepath once complete, see finish. name is what rtty -R shows.
+func (ctx *RttyFileContext) create(name string, overwrite bool) {
+	dir, base := filepath.Split(ctx.savepath)
+
+	fd, err := os.CreateTemp(dir, "."+base+".rtty-*")
+	if err != nil {
+		log.Error().Err(err).Msgf("failed to open file %s for writing", ctx.savepath)
+		ctx.sendControlMsg(MsgTypeFileCtlErr, nil)
+		ctx.reset()
+		return
+	}
+
+	ctx.partial = fd.Name()
+	ctx.overwrite = overwrite
+
+	// The server can't find the changes to what it can't read
+	if overwrite && ctx.totalSize > 0 && ctx.ses.cli.fileDelta.Load() && ctx.crypt == nil {
+		ctx.basis, _ = os.Open(ctx.savepath)
+	}
+
+	fd.Chmod(0644)
+
+	log.Debug().Msgf("download file: %s, size: %d bytes, compression: %s", ctx.savepath, ctx.totalSize,
+		fileCompressName(ctx.compress))
+
+	ctx.setOwner(fd)
+
+	ctx.opened(fd, name)
+}
+
+// opened starts the download into fd, with the data that came meanwhile
+func (ctx *RttyFileContext) opened(fd *os.File, name string) {
+	ctx.startTime = time.Now()
+
+	ctx.file = fd
+	ctx.name = name
+	ctx.sum = sha256.New()
+
+	if ctx.totalSize == 0 {
+		if err := ctx.finish(); err != nil {
+			log.Error().Err(err).Msgf("failed to save file %s", ctx.savepath)
+			ctx.sendControlMsg(MsgTypeFileCtlErr, nil)
+			ctx.reset()
+			return
+		}
+
+		ctx.complete = true
+	}
+
+	data := binary.NativeEndian.AppendUint64(nil, ctx.totalSize)
+
+	data = append(data, []byte(name)...)
+
+	ctx.sendControlMsg(MsgTypeFileCtlInfo, data)
+
+	// No data comes for an empty file
+	if ctx.complete {
+		ctx.reset()
+		return
+	}
+
+	ctx.watchStall()
+
+	// The server waits for it to send the data
+	if ctx.ses.cli.fileDelta.Load() {
+		ctx.sendSignature()
+	}
+
+	// Data that came while asking rtty -R
+	ctx.replayPending()
+}
+
+// replayPending receives the frames that had to wait, those that still have
+// to wait are queued again in order
+func (ctx *RttyFileContext) replayPending() {
+	pending := ctx.pending
+	ctx.pending = nil
+
+	for _, frame := range pending {
+		if ctx.file == nil {
+			break
+		}
+		ctx.recvData(frame)
+	}
+}
+
+func (ctx *RttyFileContext) recvData(frame []byte) {
+	if ctx.asking != "" || ctx.writing {
+		ctx.pending = append(ctx.pending, bytes.Clone(frame))
+		return
+	}
+
+	if ctx.file == nil {
+		return
+	}
+
+	if ctx.crypt != nil {
+		var err error
+
+		frame, err = ctx.crypt.open(frame)
+		if err != nil {
+			log.Error().Err(err).Msgf("failed to decrypt file data for %s", ctx.savepath)
+			ctx.send(proto.MsgTypeFileAbort, nil)
+			ctx.sendControlMsg(MsgTypeFileCtlErr, nil)
+			ctx.reset()
+			return
+		}
+	}
+
+	if ctx.basis != nil {
+		n, err := ctx.applyDelta(frame)
+		ctx.written(n, len(frame), err)
+		return
+	}
+
+	data, err := ctx.decompress(frame)
+	if err != nil {
+		log.Error().Err(err).Msgf("invalid file data for %s", ctx.savepath)
+		ctx.send(proto.MsgTypeFileAbort, nil)
+		ctx.sendControlMsg(MsgTypeFileCtlErr, nil)
+		ctx.reset()
+		return
+	}
+
+	ctx.sum.Write(data)
+
+	// A pipe may keep the write waiting, which mustn't hold up the messages
+	// of the connection meanwhile
+	if ctx.output != "" || ctx.stored != nil {
+		file := ctx.file
+		data := bytes.Clone(data)
+		size := len(frame)
+
+		ctx.writing = true
+
+		go func() {
+			_, err := file.Write(data)
+
+			ctx.mu.Lock()
+			defer ctx.mu.Unlock()
+
+			ctx.writing = false
+
+			if !ctx.done {
+				ctx.written(len(data), size, err)
+				ctx.replayPending()
+			}
+		}()
+		return
+	}
+
+	_, err = ctx.file.Write(data)
+	ctx.written(len(data), len(frame), err)
+}
+
+// written goes on once n bytes of a frame of size were written
+func (ctx *RttyFileContext) written(n, size int, err error) {
+	if err != nil {
+		log.Error().Err(err).Msgf("failed to write file %s", ctx.savepath)
+		ctx.send(proto.MsgTypeFileAbort, nil)
+		ctx.sendControlMsg(MsgTypeFileCtlErr, nil)
+		ctx.reset()
+		return
+	}
+
+	ctx.remainSize -= uint64(n)
+
+	if ctx.remainSize == 0 {
+		if err := ctx.finish(); err != nil {
+			log.Error().Err(err).Msgf("failed to save file %s", ctx.savepath)
+			ctx.send(proto.MsgTypeFileAbort, nil)
+			ctx.sendControlMsg(MsgTypeFileCtlErr, nil)
+			ctx.reset()
+			return
+		}
+
+		ctx.complete = true
+		ctx.sendChecksum()
+	}
+
+	if ctx.notifyProgress() != nil {
+		ctx.reset()
+	} else {
+		if ctx.remainSize == 0 {
+			ctx.reset()
+		} else {
+			// The server sends the next frame once acknowledged
+			ctx.throttle(size, func() {
+				ctx.send(proto.MsgTypeFileAck, nil)
+			})
+		}
+	}
+}
+
+// finish moves the complete download to savepath, with the mode and mtime
+// it came with. A file that took the name meanwhile is only replaced when
+// overwriting.
+func (ctx *RttyFileContext) finish() error {
+	ctx.file.Close()
+	ctx.file = nil
+
+	if ctx.stored != nil {
+		return ctx.commitStorage()
+	}
+
+	if ctx.output != "" {
+		return nil
+	}
+
+	if !ctx.overwrite && utils.FileExists(ctx.savepath) {
+		return fmt.Errorf("file %s created meanwhile: %w", ctx.savepath, os.ErrExist)
+	}
+
+	if err := os.Rename(ctx.partial, ctx.savepath); err != nil {
+		return err
+	}
+
+	ctx.partial = ""
+
+	if ctx.meta != nil {
+		ctx.meta.apply(ctx.savepath)
+	}
+
+	return nil
+}
+
+// throttle runs next once n bytes of file data may pass file-max-rate
+func (ctx *RttyFileContext) throttle(n int, next func()) {
+	l := ctx.ses.cli.fileLimiter
+	if l == nil {
+		next()
+		return
+	}
+
+	delay := reserveRate(l, n)
+	if delay == 0 {
+		next()
+		return
+	}
+
+	ctx.throttled = true
+
+	time.AfterFunc(delay, func() {
+		ctx.mu.Lock()
+		defer ctx.mu.Unlock()
+
+		ctx.throttled = false
+
+		if !ctx.done {
+			next()
+		}
+	})
+}
+
+func (ctx *RttyFileContext) startUpload(path string) error {
+	return ctx.startUploadAs(path, filepath.Base(path))
+}
+
+// startUploadAs uploads the file at path as name
+func (ctx *RttyFileContext) startUploadAs(path, name string) error {
+	// Paths from rtty -S on Unix are those of its open file, never a link
+	if ctx.ses.cli.cfg.fileSymlink == fileSymlinkReject && isSymlink(path) {
+		return fmt.Errorf("file %s: %w", path, errFileSymlink)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open file %s: %w", path, err)
+	}
+
+	info, _ := file.Stat()
+
+	if !info.Mode().IsRegular() {
+		file.Close()
+		return fmt.Errorf("file %s: %w", path, errFileSpecial)
+	}
+
+	if info.Size() > fileSizeLimit && !ctx.ses.cli.file64.Load() {
+		file.Close()
+		return errFileTooLarge
+	}
+
+	return ctx.upload(file, uint64(info.Size()), newFileMeta(info, ctx.ses.cli.cfg.filePreserveOwner), name)
+}
+
+// startStream uploads what is read from path as name, until its end, which
+// may be a pipe rtty -S reads from
+func (ctx *RttyFileContext) startStream(path, name string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open stream %s: %w", path, err)
+	}
+
+	info, _ := file.Stat()
+
+	meta := newFileMeta(info, ctx.ses.cli.cfg.filePreserveOwner)
+
+	// The mode and mtime of a pipe say nothing of the data
+	if !info.Mode().IsRegular() {
+		meta.mode = 0644
+		meta.mtime = time.Now().Unix()
+	}
+
+	ctx.stream = true
+
+	return ctx.upload(file, 0, meta, name)
+}
+
+// upload tells the server about the file to send, which it acknowledges to
+// get the data
+func (ctx *RttyFileContext) upload(file *os.File, size uint64, meta *fileMeta, name string) error {
+	cli := ctx.ses.cli
+
+	ctx.file = file
+
+	if err := checkFileCrypt(cli); err != nil {
+		return err
+	}
+
+	ctx.totalSize = size
+	ctx.remainSize = size
+	ctx.startTime = time.Now()
+	ctx.name = name
+	ctx.source = file.Name()
+
+	if ctx.stream {
+		ctx.source = "-"
+	}
+
+	ctx.sum = sha256.New()
+
+	var data []byte
+
+	if alg := byte(cli.fileCompress.Load()); alg != proto.FileCompressNone {
+		// Compressing what is going to be compressed again is no use, unlike
+		// what is encrypted
+		if cli.msg.Compression() == 0 || cli.fileCrypt.Load() {
+			ctx.compress = alg
+		}
+		data = append(data, ctx.compress)
+	}
+
+	if cli.fileCrypt.Load() {
+		crypt, key, err := newFileCryptKey(cli.cfg.fileKey)
+		if err != nil {
+			return err
+		}
+
+		ctx.crypt = crypt
+
+		data = append(data, key...)
+	}
+
+	if cli.fileMeta.Load() {
+		data = meta.append(data)
+	}
+
+	data = append(data, name...)
+
+	ctx.send(proto.MsgTypeFileSend, data)
+
+	ctx.watchStall()
+
+	log.Debug().Msgf("upload file: %s, size: %d bytes, stream: %v, compression: %s", file.Name(), size,
+		ctx.stream, fileCompressName(ctx.compress))
+
+	return nil
+}
+
+// uploadErrorMsg returns the control message telling why startUpload failed
+func uploadErrorMsg(err error) byte {
+	if errors.Is(err, errFileTooLarge) {
+		return MsgTypeFileCtlTooLarge
+	}
+	if errors.Is(err, errFileSymlink) {
+		return MsgTypeFileCtlSymlink
+	}
+	return MsgTypeFileCtlErr
+}
+
+// reset ends the transfer
+func (ctx *RttyFileContext) reset() {
+	if ctx.complete && !ctx.done {
+		ctx.runFileHook()
+	}
+
+	if ctx.file != nil {
+		ctx.file.Close()
+		ctx.file = nil
+	}
+
+	if ctx.basis != nil {
+		ctx.basis.Close()
+		ctx.basis = nil
+	}
+
+	if ctx.stored != nil {
+		ctx.abortStorage()
+	}
+
+	// What was downloaded of an unfinished file
+	if ctx.partial != "" {
+		os.Remove(ctx.partial)
+		ctx.partial = ""
+	}
+
+	if ctx.ctl != nil {
+		ctx.ctl.Close()
+		ctx.ctl = nil
+	}
+
+	if ctx.askTimer != nil {
+		ctx.askTimer.Stop()
+		ctx.askTimer = nil
+	}
+
+	if ctx.stallTimer != nil {
+		ctx.stallTimer.Stop()
+		ctx.stallTimer = nil
+	}
+
+	ctx.done = true
+	ctx.asking = ""
+	ctx.confirming = false
+	ctx.pending = nil
+
+	ctx.files.end(ctx)
+}
+
+// send writes a file message of the transfer to the server
+func (ctx *RttyFileContext) send(typ byte, data []byte) error {
+	cli := ctx.ses.cli
+
+	ctx.lastActive = time.Now()
+
+	if cli.fileId.Load() {
+		return cli.writeFileMsg(ctx.ses.sid, typ, ctx.id, data)
+	}
+
+	return cli.SendFileMsg(ctx.ses.sid, typ, data)
+}
+
+// notifyProgress tells rtty -R/-S what is left, or for a stream what was
+// sent and whether that's all
+func (ctx *RttyFileContext) notifyProgress() error {
+	if ctx.stream {
+		buf := binary.NativeEndian.AppendUint64(nil, ctx.totalSize)
+		if ctx.eof {
+			buf = append(buf, 1)
+		}
+		return ctx.sendControlMsg(MsgTypeFileCtlProgress, buf)
+	}
+
+	ctx.reportProgress()
+
+	buf := binary.NativeEndian.AppendUint64(nil, ctx.remainSize)
+	return ctx.sendControlMsg(MsgTypeFileCtlProgress, buf)
+}
+
+// sendChecksum tells rtty -R/-S the checksum of all of the data, for it to
+// show once done
+func (ctx *RttyFileContext) sendChecksum() {
+	ctx.sendControlMsg(MsgTypeFileCtlChecksum, ctx.sum.Sum(nil))
+}
+
+// reportProgress tells the server how the transfer goes, every
+// fileProgressInterval and once it's done
+func (ctx *RttyFileContext) reportProgress() {
+	if !ctx.ses.cli.fileProgress.Load() || ctx.totalSize == 0 {
+		return
+	}
+
+	now := time.Now()
+
+	if ctx.remainSize > 0 && now.Sub(ctx.lastReport) < fileProgressInterval {
+		return
+	}
+
+	ctx.lastReport = now
+
+	transferred := ctx.totalSize - ctx.remainSize
+
+	var rate, eta uint64
+
+	if elapsed := now.Sub(ctx.startTime).Seconds(); elapsed > 0 {
+		rate = uint64(float64(transferred) / elapsed)
+	}
+
+	if rate > 0 {
+		eta = ctx.remainSize / rate
+	}
+
+	data := []byte{byte(transferred * 100 / ctx.totalSize)}
+	data = binary.BigEndian.AppendUint64(data, transferred)
+	data = binary.BigEndian.AppendUint64(data, ctx.totalSize)
+	data = binary.BigEndian.AppendUint32(data, uint32(min(rate, math.MaxUint32)))
+	data = binary.BigEndian.AppendUint32(data, uint32(min(eta, math.MaxUint32)))
+
+	ctx.send(proto.MsgTypeFileProgress, data)
+}
+
+// acked goes on with the upload once the server acknowledged the file info
+// or a data frame
+func (ctx *RttyFileContext) acked() {
+	if ctx.inflight > 0 {
+		ctx.inflight--
+	}
+
+	if ctx.ending {
+		if ctx.inflight == 0 {
+			ctx.sendFrame(0, io.EOF)
+		}
+		return
+	}
+
+	ctx.throttle(ctx.sent, ctx.fill)
+}
+
+// fill sends data frames until as many as the window are unacknowledged
+func (ctx *RttyFileContext) fill() {
+	window := int(ctx.ses.cli.fileWindow.Load())
+
+	for ctx.file != nil && !ctx.reading && !ctx.ending && ctx.inflight < window {
+		ctx.sendData()
+	}
+}
+
+func (ctx *RttyFileContext) sendData() {
+	if ctx.file == nil {
+		return
+	}
+
+	// A stream may keep the next frame waiting, which mustn't hold up the
+	// messages of the connection meanwhile
+	if ctx.stream {
+		file := ctx.file
+
+		ctx.reading = true
+
+		go func() {
+			n, err := file.Read(ctx.buf[:])
+
+			ctx.mu.Lock()
+			defer ctx.mu.Unlock()
+
+			ctx.reading = false
+
+			if !ctx.done {
+				ctx.sendFrame(n, err)
+				ctx.fill()
+			}
+		}()
+		return
+	}
+
+	n, err := ctx.file.Read(ctx.buf[:])
+	ctx.sendFrame(n, err)
+}
+
+// sendFrame sends the n bytes read into buf, the end of the file once none
+func (ctx *RttyFileContext) sendFrame(n int, err error) {
+	if err != nil {
+		if err != io.EOF {
+			log.Error().Err(err).Msgf("failed to read file %s", ctx.ses.sid)
+			ctx.send(proto.MsgTypeFileAbort, nil)
+			ctx.sendControlMsg(MsgTypeFileCtlErr, nil)
+			ctx.reset()
+			return
+		}
+	}
+
+	// The end waits for the frames before it, so that no acknowledgement
+	// of them comes after the transfer is over
+	if n == 0 && ctx.inflight > 0 {
+		ctx.ending = true
+		return
+	}
+
+	if ctx.stream {
+		ctx.totalSize += uint64(n)
+		ctx.eof = n == 0
+	} else {
+		ctx.remainSize -= uint64(n)
+	}
+
+	data := ctx.buf[:n]
+
+	ctx.sum.Write(data)
+
+	if n > 0 && ctx.compress != proto.FileCompressNone {
+		ctx.zbuf, err = compressFileData(ctx.compress, ctx.zbuf[:0], data)
+		if err != nil {
+			log.Error().Err(err).Msgf("failed to compress file %s", ctx.ses.sid)
+			ctx.send(proto.MsgTypeFileAbort, nil)
+			ctx.sendControlMsg(MsgTypeFileCtlErr, nil)
+			ctx.reset()
+			return
+		}
+		data = ctx.zbuf
+	}
+
+	// The end of the file stays empty
+	if n > 0 && ctx.crypt != nil {
+		data = ctx.crypt.seal(data)
+	}
+
+	ctx.send(proto.MsgTypeFileData, data)
+
+	ctx.sent = len(data)
+	ctx.inflight++
+
+	// rtty -S is told it's all sent once the transfer is over, so that the
+	// next file it sends doesn't find rtty busy
+	if n == 0 {
+		if ctx.totalSize > 0 || ctx.stream {
+			ctx.sendChecksum()
+			ctx.notifyProgress()
+		}
+		ctx.complete = true
+		ctx.reset()
+		return
+	}
+
+	if ctx.remainSize == 0 && !ctx.stream {
+		return
+	}
+
+	if ctx.notifyProgress() != nil {
+		ctx.send(proto.MsgTypeFileAbort, nil)
+		ctx.reset()
+		return
+	}
+}
+
+// decompress returns the data of a frame of the file being downloaded
+func (ctx *RttyFileContext) decompress(frame []byte) ([]byte, error) {
+	if ctx.compress == proto.FileCompressNone {
+		return frame, nil
+	}
+
+	var err error
+
+	ctx.zbuf, err = decompressFileData(ctx.compress, ctx.zbuf[:0], frame, ctx.remainSize)
+
+	return ctx.zbuf, err
+}
+
+func (ctx *RttyFileContext) sendControlMsg(typ byte, data []byte) error {
+	if ctx.ctl == nil {
+		return os.ErrClosed
+	}
+	return writeControlMsg(ctx.ctl, typ, data)
+}
+
+func writeControlMsg(w io.Writer, typ byte, data []byte) error {
+	buf := [fileCtlMsgSize]byte{typ}
+
+	copy(buf[1:], data)
+
+	if _, err := w.Write(buf[:]); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// rtty -S - names what it reads from stdin with this variable of its
+// environment, which rtty reads from there
+const fileNameEnv = "RTTY_FILE_NAME"
+
+// streamName returns the name to send stdin as
+func streamName(getenv func(string) string) string {
+	name := filepath.Base(getenv(fileNameEnv))
+	if name == "." || name == string(filepath.Separator) {
+		return "stdin"
+	}
+	return name
+}
+
+// sendFiles sends the files one after another, patterns are expanded unless
+// nothing matches. All of them are checked before sending any.
+func sendFiles(patterns []string) {
+	var paths []string
+
+	for _, pattern := range patterns {
+		if pattern == "-" {
+			if slices.Contains(paths, "-") {
+				fileFatal("stdin can only be sent once")
+			}
+			paths = append(paths, pattern)
+			continue
+		}
+
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			fileFatal("invalid pattern '%s'", pattern)
+		}
+
+		if matches == nil {
+			matches = []string{pattern}
+		}
+
+		for _, path := range matches {
+			info, err := os.Stat(path)
+			if err != nil {
+				if os.IsNotExist(err) {
+					fileFatal("open '%s' failed: No such file", path)
+				}
+				fileFatal("open '%s' failed: %s", path, err.Error())
+			}
+
+			if !info.Mode().IsRegular() {
+				// Whatever else a pattern matches is left out
+				if len(matches) > 1 || matches[0] != pattern {
+					continue
+				}
+				fileFatal("'%s' is not a regular file", path)
+			}
+
+			paths = append(paths, path)
+		}
+	}
+
+	for i, path := range paths {
+		if len(paths) > 1 && fileJSON == nil {
+			fmt.Printf("[%d/%d] ", i+1, len(paths))
+		}
+		requestTransferFile('S', path, fileExistDefault)
+	}
+}
+
+// handleFileControlMsg shows how the transfer goes, answer tells rtty what to
+// do with a file already there
+func handleFileControlMsg(ctlfd io.Reader, sfd *os.File, totalSize uint64, path string, answer func(byte)) {
+	var startTime time.Time
+
+	// Of an empty file unless rtty tells
+	sum := sha256.New().Sum(nil)
+
+	// rtty reads stdin itself, so it's left open
+	stream := path == "-"
+
+	// What is shown unless --json
+	show := func(format string, a ...any) {
+		if fileJSON == nil {
+			fmt.Printf(format, a...)
+		}
+	}
+
+	for {
+		buf := make([]byte, fileCtlMsgSize)
+
+		_, err := io.ReadFull(ctlfd, buf)
+		if err != nil {
+			return
+		}
+
+		typ := buf[0]
+		buf = buf[1:]
+
+		switch typ {
+		case MsgTypeFileCtlRequestAccept:
+			if stream {
+				startTime = time.Now()
+				show("Transferring '%s' from stdin...Press Ctrl+C to cancel\n", streamName(os.Getenv))
+
+				if fileJSON != nil {
+					fileEvent("start", "name", streamName(os.Getenv))
+				}
+			} else if sfd != nil {
+				sfd.Close()
+				startTime = time.Now()
+				show("Transferring '%s'...Press Ctrl+C to cancel\n", filepath.Base(path))
+
+				if fileJSON != nil {
+					fileEvent("start", "name", filepath.Base(path), "size", totalSize)
+				}
+
+				if totalSize == 0 {
+					show("  100%%    0 B     0s")
+					fileDone(startTime, 0, sum)
+				}
+			} else {
+				show("Waiting to receive. Press Ctrl+C to cancel\n")
+
+				if fileJSON != nil {
+					fileEvent("waiting")
+				}
+			}
+
+		case MsgTypeFileCtlInfo:
+			totalSize = binary.NativeEndian.Uint64(buf)
+			name := string(bytes.TrimRight(buf[8:], "\x00"))
+			startTime = time.Now()
+
+			show("Transferring '%s'...\n", name)
+
+			if fileJSON != nil {
+				fileEvent("start", "name", name, "size", totalSize)
+			}
+
+			if totalSize == 0 {
+				show("  100%%    0 B     0s")
+				fileDone(startTime, 0, sum)
+				return
+			}
+
+		case MsgTypeFileCtlProgress:
+			if stream {
+				sent := binary.NativeEndian.Uint64(buf)
+
+				if fileJSON != nil {
+					fileProgressEvent(startTime, sent, 0)
+				} else {
+					fmt.Printf("%100c\r", ' ')
+					fmt.Printf("  %s     %.3fs\r", utils.FormatSize(sent), time.Since(startTime).Seconds())
+					os.Stdout.Sync()
+				}
+
+				if buf[8] == 1 {
+					fileDone(startTime, sent, sum)
+					return
+				}
+				continue
+			}
+
+			remainSize := binary.NativeEndian.Uint64(buf)
+			updateProgress(startTime, totalSize, remainSize)
+			if remainSize == 0 {
+				fileDone(startTime, totalSize, sum)
+				return
+			}
+
+		case MsgTypeFileCtlChecksum:
+			sum = bytes.Clone(buf[:sha256.Size])
+
+		case MsgTypeFileCtlStalled:
+			fileEnd("stalled", "Transfer stalled, aborted", "\n\033[31mTransfer stalled, aborted\033[0m\n")
+			return
+
+		case MsgTypeFileCtlAbort:
+			fileEnd("aborted", "Transfer aborted", "\nTransfer aborted\n")
+			return
+
+		case MsgTypeFileCtlBusy:
+			fileEnd("busy", "Rtty is busy to transfer file", "\033[31mRtty is busy to transfer file\033[0m\n")
+			return
+
+		case MsgTypeFileCtlNoSpace:
+			fileEnd("no-space", "No enough space", "\033[31mNo enough space\033[0m\n")
+			return
+
+		case MsgTypeFileCtlErrExist:
+			fileEnd("exists", "The file already exists", "\033[31mThe file already exists\033[0m\n")
+			return
+
+		case MsgTypeFileCtlExist:
+			answer(askFileExist(string(bytes.TrimRight(buf, "\x00"))))
+
+		case MsgTypeFileCtlSkipped:
+			fileEnd("skipped", "The file already exists, skipped", "\033[33mThe file already exists, skipped\033[0m\n")
+			return
+
+		case MsgTypeFileCtlConfirm:
+			answer(askFileConfirm(string(bytes.TrimRight(buf[8:], "\x00")), binary.NativeEndian.Uint64(buf)))
+
+		case MsgTypeFileCtlDeclined:
+			fileEnd("declined", "The file was declined", "\033[33mThe file was declined\033[0m\n")
+			return
+
+		case MsgTypeFileCtlNotAllowed:
+			name := bytes.TrimRight(buf, "\x00")
+			fileEnd("not-allowed", fmt.Sprintf("'%s' is not allowed to be received", name),
+				fmt.Sprintf("\033[31m'%s' is not allowed to be received\033[0m\n", name))
+			return
+
+		case MsgTypeFileCtlSymlink:
+			fileEnd("symlink", "Symbolic links are refused", "\033[31mSymbolic links are refused\033[0m\n")
+			return
+
+		case MsgTypeFileCtlBadName:
+			name := bytes.TrimRight(buf, "\x00")
+			fileEnd("bad-name", fmt.Sprintf("Refused to save under %q", name),
+				fmt.Sprintf("\033[31mRefused to save under %q\033[0m\n", name))
+			return
+
+		case MsgTypeFileCtlSaveDir:
+			dir := string(bytes.TrimRight(buf, "\x00"))
+
+			show("Saving into '%s'\n", dir)
+
+			if fileJSON != nil {
+				fileEvent("save-dir", "dir", dir)
+			}
+
+		case MsgTypeFileCtlTooLarge:
+			fileEnd("too-large", fmt.Sprintf("The file is too large for the server(> %d Byte)", fileSizeLimit),
+				fmt.Sprintf("\033[31mThe file is too large for the server(> %d Byte)\033[0m\n", fileSizeLimit))
+			return
+		}
+	}
+}
+
+func updateProgress(startTime time.Time, totalSize uint64, remainSize uint64) {
+	elapsed := time.Since(startTime).Seconds()
+
+	transferred := totalSize - remainSize
+
+	if fileJSON != nil {
+		fileProgressEvent(startTime, transferred, totalSize)
+		return
+	}
+	percentage := transferred * 100 / totalSize
+
+	fmt.Printf("%100c\r", ' ')
+	fmt.Printf("  %d%%    %s     %.3fs\r", percentage, utils.FormatSize(transferred), elapsed)
+
+	os.Stdout.Sync()
+}
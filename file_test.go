@@ -0,0 +1,164 @@
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/zhaojh329/rtty-go/proto"
+)
+
+func TestSanitizeFileName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string // "" when refused
+		// Names only Windows can't save under, fine elsewhere
+		windows bool
+	}{
+		{name: "file.txt", want: "file.txt"},
+		{name: "dir/file.txt", want: "file.txt"},
+		{name: `dir\file.txt`, want: "file.txt"},
+		{name: "/etc/passwd", want: "passwd"},
+		{name: `C:\Windows\win.ini`, want: "win.ini"},
+		{name: "a/./b", want: "b"},
+		{name: "../x"},
+		{name: "a/../../x"},
+		{name: `..\x`},
+		{name: "x/.."},
+		{name: ".."},
+		{name: ""},
+		{name: "."},
+		{name: "dir/."},
+		{name: "/"},
+		{name: `\`},
+		{name: `//\\/`},
+		{name: "a\x00b"},
+		{name: "a\nb"},
+		{name: "a\rb"},
+		{name: "\x1b]0;title\x07"},
+		{name: "a\x7fb"},
+		{name: "a\u0085b"},
+		{name: "C:foo", want: "C:foo", windows: true},
+		{name: "NUL", want: "NUL", windows: true},
+		{name: "CON", want: "CON", windows: true},
+		{name: "dir/con.txt", want: "con.txt", windows: true},
+	}
+
+	for _, tt := range tests {
+		want := tt.want
+		if tt.windows && runtime.GOOS == "windows" {
+			want = ""
+		}
+
+		got, err := sanitizeFileName(tt.name)
+
+		if want == "" {
+			if !errors.Is(err, errFileName) {
+				t.Errorf("sanitizeFileName(%q) = %q, %v, want refused", tt.name, got, err)
+			}
+			continue
+		}
+
+		if err != nil || got != want {
+			t.Errorf("sanitizeFileName(%q) = %q, %v, want %q", tt.name, got, err, want)
+		}
+	}
+}
+
+type ctlRecorder struct {
+	bytes.Buffer
+}
+
+func (r *ctlRecorder) Close() error {
+	return nil
+}
+
+func TestDownloadRefusesBadName(t *testing.T) {
+	sid := "0123456789abcdef0123456789abcdef"
+
+	for _, name := range []string{"../x", "a/../../x", `..\x`, "", "/", "a\nb"} {
+		a, b := net.Pipe()
+
+		cli := &RttyClient{conn: a, msg: proto.NewMsgReaderWriter(proto.RoleRtty, a)}
+		srv := proto.NewMsgReaderWriter(proto.RoleRttys, b)
+
+		// The type of each file message sent
+		msgs := make(chan byte, 16)
+
+		go func() {
+			for {
+				typ, data, err := srv.Read()
+				if err != nil || typ != proto.MsgTypeFile || len(data) <= len(sid) {
+					close(msgs)
+					return
+				}
+				msgs <- data[len(sid)]
+			}
+		}()
+
+		ses := &TermSession{cli: cli, sid: sid}
+		ses.files = &fileTransfers{ses: ses}
+
+		ctx, err := ses.files.start()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Deep enough for the parents the names lead to
+		root := t.TempDir()
+		dir := filepath.Join(root, "a", "b")
+
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		ctl := &ctlRecorder{}
+
+		ctx.ctl = ctl
+		ctx.savepath = dir
+
+		info := binary.BigEndian.AppendUint32(nil, 5)
+		info = append(info, name...)
+
+		ctx.startDownload(info)
+
+		a.Close()
+
+		var sent []byte
+		for typ := range msgs {
+			sent = append(sent, typ)
+		}
+
+		if !bytes.Equal(sent, []byte{proto.MsgTypeFileAbort}) {
+			t.Errorf("%q: sent %v, want the abort", name, sent)
+		}
+
+		msg := ctl.Bytes()
+		if len(msg) != fileCtlMsgSize || msg[0] != MsgTypeFileCtlBadName ||
+			string(bytes.TrimRight(msg[1:], "\x00")) != name {
+			t.Errorf("%q: control message %q, want bad name", name, msg)
+		}
+
+		filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err == nil && !d.IsDir() {
+				t.Errorf("%q: created %s", name, path)
+			}
+			return nil
+		})
+
+		if ses.files.get(ctx.id) != nil {
+			t.Errorf("%q: transfer not ended", name)
+		}
+	}
+}
@@ -11,110 +11,128 @@ package main
 import (
 	"encoding/binary"
 	"fmt"
-	"io"
 	"os"
 	"os/signal"
+	"os/user"
 	"path/filepath"
+	"strconv"
 	"syscall"
 	"time"
 
-	"github.com/zhaojh329/rtty-go/proto"
 	"github.com/zhaojh329/rtty-go/utils"
 
 	"github.com/rs/zerolog/log"
 )
 
-const (
-	MsgTypeFileCtlRequestAccept = byte(iota)
-	MsgTypeFileCtlProgress
-	MsgTypeFileCtlInfo
-	MsgTypeFileCtlBusy
-	MsgTypeFileCtlAbort
-	MsgTypeFileCtlNoSpace
-	MsgTypeFileCtlErrExist
-	MsgTypeFileCtlErr
-)
+var RttyFileMagic = [12]byte{0xb6, 0xbc, 0xbd}
 
-const (
-	fileSizeLimit int64 = 2 * 1024 * 1024 * 1024 // 2 GB
+// rtty -R/-S creates its fifo in this directory if set, which file-fifo-dir
+// sets for the terminals, else in XDG_RUNTIME_DIR, else in TMPDIR or /tmp
+const fileFifoDirEnv = "RTTY_FIFO_DIR"
 
-	fileCtlMsgSize = 129
-)
+// Requests come in through the terminal output, see detect
+type fileListener struct{}
 
-var RttyFileMagic = [12]byte{0xb6, 0xbc, 0xbd}
+type fileRequest struct {
+	pid uint32 // rtty -R/-S, which answers whether to overwrite
+}
 
-func handleFileMsg(cli *RttyClient, data []byte) error {
-	sid := string(data[:32])
-	typ := data[32]
+func fileTransferEnv(cfg *Config, _ string) []string {
+	var env []string
 
-	val, ok := cli.sessions.Load(sid)
-	if !ok {
-		log.Error().Msgf("terminal session %s not found", sid)
-		return nil
+	if cfg.fileFifoDir != "" {
+		env = append(env, fileFifoDirEnv+"="+cfg.fileFifoDir)
 	}
 
-	s := val.(*TermSession)
-
-	data = data[33:]
-
-	switch typ {
-	case proto.MsgTypeFileInfo:
-		s.fc.startDownload(data)
-
-	case proto.MsgTypeFileData:
-		if len(data) > 0 {
-			if s.fc.file != nil {
-				s.fc.file.Write(data)
-				s.fc.remainSize -= uint32(len(data))
-				if s.fc.notifyProgress() != nil {
-					s.fc.reset()
-				} else {
-					if s.fc.remainSize == 0 {
-						s.fc.reset()
-					} else {
-						cli.SendFileMsg(s.sid, proto.MsgTypeFileAck, nil)
-					}
-				}
-			}
-		} else {
-			s.fc.reset()
-		}
+	if cfg.fileSymlink == fileSymlinkReject {
+		env = append(env, fileSymlinkEnv+"="+fileSymlinkReject)
+	}
+
+	return env
+}
 
-	case proto.MsgTypeFileAck:
-		s.fc.sendData()
+// fileFifo returns the fifo of rtty -R/-S run as pid, with its environment
+func fileFifo(getenv func(string) string, pid uint32) string {
+	dir := getenv(fileFifoDirEnv)
 
-	case proto.MsgTypeFileAbort:
-		s.fc.sendControlMsg(MsgTypeFileCtlAbort, nil)
-		s.fc.reset()
+	if dir == "" {
+		dir = getenv("XDG_RUNTIME_DIR")
 	}
 
-	return nil
+	if dir == "" {
+		dir = getenv("TMPDIR")
+	}
+
+	if dir == "" {
+		dir = "/tmp"
+	}
+
+	return filepath.Join(dir, fmt.Sprintf("rtty-fifo-%d.fifo", pid))
 }
 
-type RttyFileContext struct {
-	ses        *TermSession
-	file       *os.File
-	fifo       *os.File
-	busy       bool
-	uid        uint32
-	gid        uint32
-	totalSize  uint32
-	remainSize uint32
-	savepath   string
-	buf        [1024 * 63]byte
+func (fs *fileTransfers) listen() {
 }
 
-func (ctx *RttyFileContext) detect(data []byte) bool {
-	if len(data) != len(RttyFileMagic) {
-		return false
+func (fs *fileTransfers) close() {
+}
+
+func (ctx *RttyFileContext) setOwner(f *os.File) {
+	if err := f.Chown(int(ctx.uid), int(ctx.gid)); err != nil {
+		log.Warn().Err(err).Msgf("failed to change owner of file %s to uid=%d gid=%d", ctx.savepath, ctx.uid, ctx.gid)
 	}
+}
 
-	if data[0] != RttyFileMagic[0] || data[1] != RttyFileMagic[1] || data[2] != RttyFileMagic[2] {
+// fileOwner returns the owner of the file as user:group, by name if known
+func fileOwner(info os.FileInfo) string {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return ""
+	}
+
+	name := strconv.FormatUint(uint64(st.Uid), 10)
+	if u, err := user.LookupId(name); err == nil {
+		name = u.Username
+	}
+
+	group := strconv.FormatUint(uint64(st.Gid), 10)
+	if g, err := user.LookupGroupId(group); err == nil {
+		group = g.Name
+	}
+
+	return name + ":" + group
+}
+
+// Only the owner of the file, or root, may overwrite it
+func (ctx *RttyFileContext) mayOverwrite(info os.FileInfo) bool {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	return ok && (ctx.uid == 0 || st.Uid == ctx.uid)
+}
+
+// The answer comes in through the terminal output as well
+func (ctx *RttyFileContext) waitAnswer() {
+}
+
+// isFileMagic reports whether data may be the request of a file transfer,
+// which is always read on its own
+func isFileMagic(data []byte) bool {
+	return len(data) == len(RttyFileMagic) &&
+		data[0] == RttyFileMagic[0] && data[1] == RttyFileMagic[1] && data[2] == RttyFileMagic[2]
+}
+
+func (fs *fileTransfers) detect(data []byte) bool {
+	if !isFileMagic(data) {
 		return false
 	}
 
 	pid := binary.NativeEndian.Uint32(data[4:])
 
+	if data[3] == 'A' {
+		if ctx := fs.find(pid); ctx != nil {
+			ctx.answer(data[8])
+		}
+		return true
+	}
+
 	uid, err := utils.GetUidByPid(pid)
 	if err != nil {
 		syscall.Kill(int(pid), syscall.SIGTERM)
@@ -129,7 +147,14 @@ func (ctx *RttyFileContext) detect(data []byte) bool {
 		return true
 	}
 
-	fifoName := fmt.Sprintf("/tmp/rtty-fifo-%d.fifo", pid)
+	env, err := utils.GetEnvByPid(pid)
+	if err != nil {
+		syscall.Kill(int(pid), syscall.SIGTERM)
+		log.Error().Err(err).Msgf("failed to get environment for pid %d", pid)
+		return true
+	}
+
+	fifoName := fileFifo(func(name string) string { return env[name] }, pid)
 
 	fifo, err := os.OpenFile(fifoName, os.O_WRONLY, 0)
 	if err != nil {
@@ -138,32 +163,57 @@ func (ctx *RttyFileContext) detect(data []byte) bool {
 		return true
 	}
 
-	ctx.fifo = fifo
-
-	if ctx.busy {
-		ctx.sendControlMsg(MsgTypeFileCtlBusy, nil)
+	ctx, err := fs.start()
+	if err != nil {
+		writeControlMsg(fifo, MsgTypeFileCtlBusy, nil)
 		fifo.Close()
 		return true
 	}
 
-	log.Debug().Msgf("detected file operation: sid=%s pid=%d, uid=%d, gid=%d", ctx.ses.sid, pid, uid, gid)
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	ctx.ctl = fifo
+	ctx.pid = pid
+
+	log.Debug().Msgf("detected file operation: sid=%s id=%d pid=%d, uid=%d, gid=%d", fs.ses.sid, ctx.id, pid, uid, gid)
 
 	if data[3] == 'R' {
-		savepath, err := utils.GetCwdByPid(pid)
-		if err != nil {
-			ctx.sendControlMsg(MsgTypeFileCtlErr, nil)
-			fifo.Close()
-			log.Error().Err(err).Msgf("failed to get cwd for pid %d", pid)
-			return true
+		savepath := fs.ses.cli.cfg.downloadDir
+
+		if savepath == "" {
+			savepath, err = utils.GetCwdByPid(pid)
+			if err != nil {
+				ctx.sendControlMsg(MsgTypeFileCtlErr, nil)
+				ctx.reset()
+				log.Error().Err(err).Msgf("failed to get cwd for pid %d", pid)
+				return true
+			}
 		}
 
-		ctx.savepath = savepath
+		ctx.uid = uid
+		ctx.gid = gid
+		ctx.exist = data[8]
+
+		ctx.startRecv(savepath)
+	} else if data[3] == 'O' {
 		ctx.uid = uid
 		ctx.gid = gid
 
-		ctx.ses.cli.SendFileMsg(ctx.ses.sid, proto.MsgTypeFileRecv, nil)
+		ctx.startOutput(fmt.Sprintf("/proc/%d/fd/1", pid))
+	} else if data[3] == 'P' {
+		// The pipe is opened through the process reading it
+		link := fmt.Sprintf("/proc/%d/fd/%d", pid, binary.NativeEndian.Uint32(data[8:]))
 
 		ctx.sendControlMsg(MsgTypeFileCtlRequestAccept, nil)
+
+		err = ctx.startStream(link, streamName(func(name string) string { return env[name] }))
+		if err != nil {
+			log.Error().Err(err).Msgf("failed to start upload stdin of pid %d", pid)
+			ctx.sendControlMsg(uploadErrorMsg(err), nil)
+			ctx.reset()
+			return true
+		}
 	} else {
 		fd := binary.NativeEndian.Uint32(data[8:])
 		link := fmt.Sprintf("/proc/%d/fd/%d", pid, fd)
@@ -172,7 +222,7 @@ func (ctx *RttyFileContext) detect(data []byte) bool {
 		if err != nil {
 			log.Error().Err(err).Msgf("failed to read link %s", link)
 			ctx.sendControlMsg(MsgTypeFileCtlErr, nil)
-			fifo.Close()
+			ctx.reset()
 			return true
 		}
 
@@ -181,212 +231,121 @@ func (ctx *RttyFileContext) detect(data []byte) bool {
 		err = ctx.startUpload(path)
 		if err != nil {
 			log.Error().Err(err).Msgf("failed to start upload file for path %s", path)
-			ctx.sendControlMsg(MsgTypeFileCtlErr, nil)
-			fifo.Close()
+			ctx.sendControlMsg(uploadErrorMsg(err), nil)
+			ctx.reset()
 			return true
 		}
-
 	}
 
-	ctx.busy = true
-
 	return true
 }
 
-func (ctx *RttyFileContext) startDownload(data []byte) {
-	ctx.totalSize = binary.BigEndian.Uint32(data)
-	ctx.remainSize = ctx.totalSize
-
-	err := utils.CheckSpaceAvailable(ctx.savepath, uint64(ctx.totalSize))
-	if err != nil {
-		log.Error().Err(err).Msgf("download file fail for %s", ctx.savepath)
-		ctx.sendControlMsg(MsgTypeFileCtlNoSpace, nil)
-		ctx.reset()
-		return
-	}
-
-	name := string(data[4:])
-
-	ctx.savepath = filepath.Join(ctx.savepath, name)
-
-	if utils.FileExists(ctx.savepath) {
-		log.Error().Msgf("file %s already exists", ctx.savepath)
-		ctx.sendControlMsg(MsgTypeFileCtlErrExist, nil)
-		ctx.reset()
-		return
-	}
-
-	fd, err := os.OpenFile(ctx.savepath, os.O_WRONLY|os.O_CREATE, 0644)
-	if err != nil {
-		log.Error().Err(err).Msgf("failed to open file %s for writing", ctx.savepath)
-		ctx.sendControlMsg(MsgTypeFileCtlErr, nil)
-		ctx.reset()
-		return
-	}
-
-	log.Debug().Msgf("download file: %s, size: %d bytes", ctx.savepath, ctx.totalSize)
-
-	err = fd.Chown(int(ctx.uid), int(ctx.gid))
-	if err != nil {
-		log.Warn().Err(err).Msgf("failed to change owner of file %s to uid=%d gid=%d", ctx.savepath, ctx.uid, ctx.gid)
-	}
+// find returns the transfer requested by pid
+func (fs *fileTransfers) find(pid uint32) *RttyFileContext {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
 
-	if ctx.totalSize == 0 {
-		fd.Close()
-	} else {
-		ctx.file = fd
-	}
-
-	data = []byte{0, 0, 0, 0}
-
-	binary.NativeEndian.PutUint32(data, ctx.totalSize)
-
-	data = append(data, []byte(name)...)
-
-	ctx.sendControlMsg(MsgTypeFileCtlInfo, data)
-}
-
-func (ctx *RttyFileContext) startUpload(path string) error {
-	file, err := os.Open(path)
-	if err != nil {
-		return fmt.Errorf("failed to open file %s: %w", path, err)
-	}
-
-	info, _ := file.Stat()
-
-	ctx.file = file
-	ctx.totalSize = uint32(info.Size())
-	ctx.remainSize = ctx.totalSize
-
-	ctx.ses.cli.SendFileMsg(ctx.ses.sid, proto.MsgTypeFileSend, []byte(filepath.Base(path)))
-
-	log.Debug().Msgf("upload file: %s, size: %d bytes", path, ctx.totalSize)
-
-	return nil
-}
-
-func (ctx *RttyFileContext) reset() {
-	if ctx.file != nil {
-		ctx.file.Close()
-		ctx.file = nil
-	}
-
-	if ctx.fifo != nil {
-		ctx.fifo.Close()
-		ctx.fifo = nil
-	}
-
-	ctx.busy = false
-}
-
-func (ctx *RttyFileContext) notifyProgress() error {
-	buf := make([]byte, 4)
-	binary.NativeEndian.PutUint32(buf, ctx.remainSize)
-	return ctx.sendControlMsg(MsgTypeFileCtlProgress, buf)
-}
-
-func (ctx *RttyFileContext) sendData() {
-	if ctx.file == nil {
-		return
-	}
-
-	n, err := ctx.file.Read(ctx.buf[:])
-	if err != nil {
-		if err != io.EOF {
-			log.Error().Err(err).Msgf("failed to read file %s", ctx.ses.sid)
-			ctx.ses.cli.SendFileMsg(ctx.ses.sid, proto.MsgTypeFileAbort, nil)
-			ctx.sendControlMsg(MsgTypeFileCtlErr, nil)
-			ctx.reset()
-			return
+	for _, ctx := range fs.ctxs {
+		if ctx.pid == pid {
+			return ctx
 		}
 	}
 
-	ctx.remainSize -= uint32(n)
-
-	ctx.ses.cli.SendFileMsg(ctx.ses.sid, proto.MsgTypeFileData, ctx.buf[:n])
-
-	if n == 0 {
-		ctx.reset()
-		return
-	}
-
-	if ctx.notifyProgress() != nil {
-		ctx.ses.cli.SendFileMsg(ctx.ses.sid, proto.MsgTypeFileAbort, nil)
-		ctx.reset()
-		return
-	}
-}
-
-func (ctx *RttyFileContext) sendControlMsg(typ byte, data []byte) error {
-	buf := [fileCtlMsgSize]byte{typ}
-
-	copy(buf[1:], data)
-
-	if _, err := ctx.fifo.Write(buf[:]); err != nil {
-		return err
-	}
-
 	return nil
 }
 
-func requestTransferFile(typ byte, path string) {
-	var totalSize uint32
+func requestTransferFile(typ byte, path string, exist byte) {
+	var totalSize uint64
 	var sfd *os.File
 	var err error
 
 	pid := os.Getpid()
 
-	if typ == 'R' {
+	// rtty watches the terminal for the request
+	term := os.Stdout
+
+	if typ == 'O' {
+		info, err := os.Stdout.Stat()
+		if err != nil || info.Mode()&os.ModeCharDevice != 0 {
+			fileFatal("stdout is a terminal, pipe rtty -R -O - into what takes the file")
+		}
+
+		// The request and what is shown go to the terminal, which rtty
+		// watches, the file to stdout
+		tty, err := os.OpenFile("/dev/tty", os.O_WRONLY, 0)
+		if err != nil {
+			fileFatalTo(os.Stderr, "Could not open the terminal: %s", err.Error())
+		}
+		defer tty.Close()
+
+		os.Stdout = tty
+		term = tty
+	} else if typ == 'R' {
 		info, err := os.Stat(".")
 		if err != nil {
-			fmt.Println("Permission denied")
-			os.Exit(1)
+			fileFatal("Permission denied")
 		}
 
 		// Check the write and execute permissions of the current directory
 		if info.Mode().Perm()&0200 == 0 {
-			fmt.Println("Permission denied")
-			os.Exit(1)
+			fileFatal("Permission denied")
 		}
+	} else if path == "-" {
+		info, err := os.Stdin.Stat()
+		if err != nil || info.Mode()&os.ModeCharDevice != 0 {
+			fileFatal("stdin is a terminal, pipe what to send into rtty -S -")
+		}
+
+		sfd = os.Stdin
+		typ = 'P'
 	} else {
+		// rtty only sees the file opened, so refuses links through rtty -S
+		if os.Getenv(fileSymlinkEnv) == fileSymlinkReject && isSymlink(path) {
+			fileFatal("'%s' is a symbolic link, refused", path)
+		}
+
 		sfd, err = os.Open(path)
 		if err != nil {
 			if os.IsNotExist(err) {
-				fmt.Printf("open '%s' failed: No such file\n", path)
-			} else {
-				fmt.Printf("open '%s' failed: %s\n", path, err.Error())
+				fileFatal("open '%s' failed: No such file", path)
 			}
-			os.Exit(1)
+			fileFatal("open '%s' failed: %s", path, err.Error())
 		}
 		defer sfd.Close()
 
 		stat, err := sfd.Stat()
 		if err != nil {
-			fmt.Printf("stat '%s' failed: %s\n", path, err.Error())
-			os.Exit(1)
+			fileFatal("stat '%s' failed: %s", path, err.Error())
 		}
 
 		if !stat.Mode().IsRegular() {
-			fmt.Printf("'%s' is not a regular file\n", path)
-			os.Exit(1)
+			fileFatal("'%s' is not a regular file", path)
 		}
 
-		if stat.Size() > fileSizeLimit {
-			fmt.Printf("'%s' is too large(> %d Byte)\n", path, fileSizeLimit)
-			os.Exit(1)
-		}
+		totalSize = uint64(stat.Size())
+	}
+
+	// What --json writes may go to a pipe
+	if fileJSON != nil && term == os.Stdout {
+		if info, err := os.Stdout.Stat(); err == nil && info.Mode()&os.ModeCharDevice == 0 {
+			tty, err := os.OpenFile("/dev/tty", os.O_WRONLY, 0)
+			if err != nil {
+				fileFatalTo(os.Stderr, "Could not open the terminal: %s", err.Error())
+			}
+			defer tty.Close()
 
-		totalSize = uint32(stat.Size())
+			term = tty
+		}
 	}
 
-	fifoName := fmt.Sprintf("/tmp/rtty-fifo-%d.fifo", pid)
+	fifoName := fileFifo(os.Getenv, uint32(pid))
 
 	if err := syscall.Mkfifo(fifoName, 0644); err != nil {
-		fmt.Fprintf(os.Stderr, "Could not create fifo %s\n", fifoName)
-		os.Exit(1)
+		fileFatalTo(os.Stderr, "Could not create fifo %s", fifoName)
 	}
 
-	setupSignalHandler(fifoName)
+	stop := setupSignalHandler(fifoName)
+	defer stop()
 
 	defer os.Remove(fifoName)
 
@@ -396,109 +355,52 @@ func requestTransferFile(typ byte, path string) {
 
 	binary.NativeEndian.PutUint32(RttyFileMagic[4:], uint32(pid))
 
-	if typ == 'S' {
+	if typ == 'S' || typ == 'P' {
 		fd := uint32(sfd.Fd())
 		binary.NativeEndian.PutUint32(RttyFileMagic[8:], fd)
+	} else {
+		RttyFileMagic[8] = exist
 	}
 
-	os.Stdout.Write(RttyFileMagic[:])
-	os.Stdout.Sync()
+	term.Write(RttyFileMagic[:])
+	term.Sync()
 
 	ctlfd, err := os.OpenFile(fifoName, os.O_RDONLY, 0)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Could not open fifo %s\n", fifoName)
-		os.Exit(1)
+		fileFatalTo(os.Stderr, "Could not open fifo %s", fifoName)
 	}
 	defer ctlfd.Close()
 
-	handleFileControlMsg(ctlfd, sfd, totalSize, path)
-}
-
-func handleFileControlMsg(ctlfd *os.File, sfd *os.File, totalSize uint32, path string) {
-	var startTime time.Time
+	handleFileControlMsg(ctlfd, sfd, totalSize, path, func(choice byte) {
+		answer := RttyFileMagic
+		answer[3] = 'A'
+		answer[8] = choice
 
-	for {
-		buf := make([]byte, fileCtlMsgSize)
-
-		_, err := io.ReadFull(ctlfd, buf)
-		if err != nil {
-			return
-		}
-
-		typ := buf[0]
-		buf = buf[1:]
-
-		switch typ {
-		case MsgTypeFileCtlRequestAccept:
-			if sfd != nil {
-				sfd.Close()
-				startTime = time.Now()
-				fmt.Printf("Transferring '%s'...Press Ctrl+C to cancel\n", filepath.Base(path))
-
-				if totalSize == 0 {
-					fmt.Println("  100%%    0 B     0s")
-				}
-			} else {
-				fmt.Println("Waiting to receive. Press Ctrl+C to cancel")
-			}
-
-		case MsgTypeFileCtlInfo:
-			totalSize = binary.NativeEndian.Uint32(buf)
-			fmt.Printf("Transferring '%s'...\n", string(buf[4:]))
-			if totalSize == 0 {
-				fmt.Println("  100%%    0 B     0s")
-				return
-			}
-			startTime = time.Now()
-
-		case MsgTypeFileCtlProgress:
-			remainSize := binary.NativeEndian.Uint32(buf)
-			updateProgress(startTime, totalSize, remainSize)
-			if remainSize == 0 {
-				fmt.Println()
-				return
-			}
-
-		case MsgTypeFileCtlAbort:
-			fmt.Println("\nTransfer aborted")
-			return
-
-		case MsgTypeFileCtlBusy:
-			fmt.Println("\033[31mRtty is busy to transfer file\033[0m")
-			return
-
-		case MsgTypeFileCtlNoSpace:
-			fmt.Println("\033[31mNo enough space\033[0m")
-			return
-
-		case MsgTypeFileCtlErrExist:
-			fmt.Println("\033[31mThe file already exists\033[0m")
-			return
-		}
-	}
+		term.Write(answer[:])
+		term.Sync()
+	})
 }
 
-func setupSignalHandler(fifoName string) {
+// setupSignalHandler cancels the transfer on Ctrl+C until stop is called,
+// and the files still to send with it
+func setupSignalHandler(fifoName string) (stop func()) {
 	c := make(chan os.Signal, 1)
+	done := make(chan struct{})
 
 	signal.Notify(c, syscall.SIGINT)
 
 	go func() {
-		<-c
-		fmt.Println()
-		os.Remove(fifoName)
-		os.Exit(0)
+		select {
+		case <-c:
+			fileEnd("canceled", "Transfer canceled", "\n")
+			os.Remove(fifoName)
+			os.Exit(0)
+		case <-done:
+		}
 	}()
-}
-
-func updateProgress(startTime time.Time, totalSize uint32, remainSize uint32) {
-	elapsed := time.Since(startTime).Seconds()
-
-	transferred := totalSize - remainSize
-	percentage := uint64(transferred) * 100 / uint64(totalSize)
 
-	fmt.Printf("%100c\r", ' ')
-	fmt.Printf("  %d%%    %s     %.3fs\r", percentage, utils.FormatSize(uint64(transferred)), elapsed)
-
-	os.Stdout.Sync()
+	return func() {
+		signal.Stop(c)
+		close(done)
+	}
 }
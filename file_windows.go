@@ -9,23 +9,301 @@
 package main
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/sys/windows"
 )
 
-func handleFileMsg(cli *RttyClient, data []byte) error {
-	return fmt.Errorf("not supported on Windows")
+// ConPTY renders what programs print rather than pass it through, so there
+// is no magic in the output. Each terminal gets a named pipe instead, which
+// rtty -R/-S finds in its environment.
+const fileTransferPipeEnv = "RTTY_FILE_PIPE"
+
+// A request is the magic with R or S, what to do with a file already there,
+// then the length and the directory to save into, or the path of the file to
+// send. rtty -R answers whether to overwrite with a byte.
+var rttyFileMagic = [3]byte{0xb6, 0xbc, 0xbd}
+
+type fileListener struct {
+	pipe   string
+	closed atomic.Bool
+}
+
+type fileRequest struct {
+	conn *os.File
 }
 
-type RttyFileContext struct {
-	ses *TermSession
+func fileTransferEnv(_ *Config, sid string) []string {
+	return []string{fileTransferPipeEnv + "=" + fileTransferPipe(sid)}
 }
 
-func (ctx *RttyFileContext) detect(_ []byte) bool {
+func fileTransferPipe(sid string) string {
+	return `\\.\pipe\rtty-file-` + sid
+}
+
+func isFileMagic(_ []byte) bool {
 	return false
 }
 
-func (ctx *RttyFileContext) reset() {
+func (fs *fileTransfers) detect(_ []byte) bool {
+	return false
+}
+
+// listen serves the requests of the terminal one after another. The pipe gets
+// the default security of rtty, so only the account running it, which the
+// shell runs as as well, and administrators may connect.
+func (fs *fileTransfers) listen() {
+	fs.pipe = fileTransferPipe(fs.ses.sid)
+
+	name, err := windows.UTF16PtrFromString(fs.pipe)
+	if err != nil {
+		log.Error().Err(err).Msg("invalid file transfer pipe")
+		return
+	}
+
+	go func() {
+		for !fs.closed.Load() {
+			h, err := windows.CreateNamedPipe(name, windows.PIPE_ACCESS_DUPLEX,
+				windows.PIPE_TYPE_BYTE|windows.PIPE_READMODE_BYTE|windows.PIPE_WAIT|windows.PIPE_REJECT_REMOTE_CLIENTS,
+				windows.PIPE_UNLIMITED_INSTANCES, 4096, 4096, 0, nil)
+			if err != nil {
+				log.Error().Err(err).Msgf("failed to create pipe %s", fs.pipe)
+				return
+			}
+
+			err = windows.ConnectNamedPipe(h, nil)
+			if err != nil && !errors.Is(err, windows.ERROR_PIPE_CONNECTED) {
+				windows.CloseHandle(h)
+				log.Error().Err(err).Msgf("failed to connect pipe %s", fs.pipe)
+				return
+			}
+
+			if fs.closed.Load() {
+				windows.CloseHandle(h)
+				return
+			}
+
+			fs.serve(h)
+		}
+	}()
+}
+
+// close stops listen, which waits for a connection to notice
+func (fs *fileTransfers) close() {
+	if fs.pipe == "" || fs.closed.Swap(true) {
+		return
+	}
+
+	if f, err := os.OpenFile(fs.pipe, os.O_RDWR, 0); err == nil {
+		f.Close()
+	}
+}
+
+func (fs *fileTransfers) serve(h windows.Handle) {
+	var pid uint32
+	windows.GetNamedPipeClientProcessId(h, &pid)
+
+	conn := os.NewFile(uintptr(h), fs.pipe)
+
+	typ, exist, path, err := readFileRequest(conn)
+	if err != nil {
+		log.Error().Err(err).Msgf("invalid file transfer request from pid %d", pid)
+		conn.Close()
+		return
+	}
+
+	ctx, err := fs.start()
+	if err != nil {
+		writeControlMsg(conn, MsgTypeFileCtlBusy, nil)
+		conn.Close()
+		return
+	}
+
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	ctx.ctl = conn
+	ctx.conn = conn
+
+	log.Debug().Msgf("detected file operation: sid=%s id=%d pid=%d", fs.ses.sid, ctx.id, pid)
+
+	if typ == 'R' {
+		ctx.exist = exist
+		ctx.startRecv(path)
+	} else {
+		ctx.sendControlMsg(MsgTypeFileCtlRequestAccept, nil)
+
+		if err := ctx.startUpload(path); err != nil {
+			log.Error().Err(err).Msgf("failed to start upload file for path %s", path)
+			ctx.sendControlMsg(uploadErrorMsg(err), nil)
+			ctx.reset()
+		}
+	}
+}
+
+func readFileRequest(r io.Reader) (byte, byte, string, error) {
+	var head [7]byte
+
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return 0, 0, "", err
+	}
+
+	if head[0] != rttyFileMagic[0] || head[1] != rttyFileMagic[1] || head[2] != rttyFileMagic[2] {
+		return 0, 0, "", fmt.Errorf("bad magic")
+	}
+
+	typ := head[3]
+	if typ != 'R' && typ != 'S' {
+		return 0, 0, "", fmt.Errorf("unknown type %c", typ)
+	}
+
+	path := make([]byte, binary.BigEndian.Uint16(head[5:]))
+
+	if _, err := io.ReadFull(r, path); err != nil {
+		return 0, 0, "", err
+	}
+
+	if !filepath.IsAbs(string(path)) {
+		return 0, 0, "", fmt.Errorf("relative path %s", path)
+	}
+
+	return typ, head[4], string(path), nil
+}
+
+// Files get the owner Windows gives them
+func (ctx *RttyFileContext) setOwner(_ *os.File) {
+}
+
+// Windows files have no user:group to send
+func fileOwner(_ os.FileInfo) string {
+	return ""
 }
 
-func requestTransferFile(typ byte, path string) {
+// Whoever may write the file may overwrite it, which opening it checks
+func (ctx *RttyFileContext) mayOverwrite(_ os.FileInfo) bool {
+	return true
+}
+
+// waitAnswer reads the answer of rtty -R from its pipe, which closing skips
+// the file
+func (ctx *RttyFileContext) waitAnswer() {
+	conn := ctx.conn
+
+	go func() {
+		var choice [1]byte
+
+		if _, err := io.ReadFull(conn, choice[:]); err != nil {
+			choice[0] = fileExistSkip
+		}
+
+		ctx.answer(choice[0])
+	}()
+}
+
+func requestTransferFile(typ byte, path string, exist byte) {
+	var totalSize uint64
+	var sfd *os.File
+	var err error
+
+	pipe := os.Getenv(fileTransferPipeEnv)
+	if pipe == "" {
+		fileFatal("Not in a terminal of rtty")
+	}
+
+	if typ == 'O' {
+		// rtty can't write it through the pipe of the terminal
+		fileFatal("Receiving to stdout is not supported on Windows")
+	}
+
+	if typ == 'R' {
+		path, err = os.Getwd()
+		if err != nil {
+			fileFatal("Permission denied")
+		}
+	} else if path == "-" {
+		// rtty can't read it through the pipe of the terminal
+		fileFatal("Sending stdin is not supported on Windows")
+	} else {
+		path, err = filepath.Abs(path)
+		if err != nil {
+			fileFatal("open '%s' failed: %s", path, err.Error())
+		}
+
+		sfd, err = os.Open(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				fileFatal("open '%s' failed: No such file", path)
+			}
+			fileFatal("open '%s' failed: %s", path, err.Error())
+		}
+		defer sfd.Close()
+
+		stat, err := sfd.Stat()
+		if err != nil {
+			fileFatal("stat '%s' failed: %s", path, err.Error())
+		}
+
+		if !stat.Mode().IsRegular() {
+			fileFatal("'%s' is not a regular file", path)
+		}
+
+		totalSize = uint64(stat.Size())
+	}
+
+	if len(path) > 0xffff {
+		fileFatal("'%s' is too long", path)
+	}
+
+	conn, err := os.OpenFile(pipe, os.O_RDWR, 0)
+	if err != nil {
+		fileFatalTo(os.Stderr, "Could not open pipe %s", pipe)
+	}
+	defer conn.Close()
+
+	req := append(rttyFileMagic[:], typ, exist)
+	req = binary.BigEndian.AppendUint16(req, uint16(len(path)))
+	req = append(req, path...)
+
+	if _, err := conn.Write(req); err != nil {
+		fileFatalTo(os.Stderr, "Could not send request to %s", pipe)
+	}
+
+	stop := setupSignalHandler(conn)
+	defer stop()
+
+	handleFileControlMsg(conn, sfd, totalSize, path, func(choice byte) {
+		conn.Write([]byte{choice})
+	})
+}
+
+// Closing the pipe on Ctrl+C tells rtty to stop, until stop is called. The
+// files still to send are canceled as well.
+func setupSignalHandler(conn *os.File) (stop func()) {
+	c := make(chan os.Signal, 1)
+	done := make(chan struct{})
+
+	signal.Notify(c, os.Interrupt)
+
+	go func() {
+		select {
+		case <-c:
+			fileEnd("canceled", "Transfer canceled", "\n")
+			conn.Close()
+			os.Exit(0)
+		case <-done:
+		}
+	}()
+
+	return func() {
+		signal.Stop(c)
+		close(done)
+	}
 }
@@ -0,0 +1,183 @@
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/valyala/bytebufferpool"
+	"github.com/zhaojh329/rtty-go/proto"
+)
+
+// fileChannel is a connection of its own for the file messages, so that the
+// data of transfers doesn't queue up ahead of what terminals print. The
+// server hands out a token for it on registration, which the device
+// registers it with. It's compressed as the connection it belongs to.
+type fileChannel struct {
+	conn net.Conn
+	msg  *proto.MsgReaderWriter
+}
+
+// openFileChannel connects to the server again for the file messages, which
+// keep going through the connection until it's done
+func (cli *RttyClient) openFileChannel(token []byte) {
+	fc, err := cli.dialFileChannel(token)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to open file channel, file data goes through the connection")
+		return
+	}
+
+	if !cli.fileChannel.CompareAndSwap(nil, fc) {
+		fc.conn.Close()
+		return
+	}
+
+	log.Info().Msg("file channel opened")
+
+	for {
+		typ, data, err := fc.msg.Read()
+		if err != nil {
+			break
+		}
+
+		cli.stats.msgsIn[typ].Add(1)
+
+		if typ != proto.MsgTypeFile {
+			log.Error().Msgf("unexpected message '%s' on file channel", proto.MsgTypeName(typ))
+			break
+		}
+
+		handleFileMsg(cli, data)
+	}
+
+	// Unless closed along with the connection, the transfers on it are lost
+	if cli.fileChannel.CompareAndSwap(fc, nil) {
+		fc.conn.Close()
+
+		log.Error().Msg("file channel closed, file data goes through the connection")
+
+		cli.sessions.Range(func(key, value any) bool {
+			value.(*TermSession).files.reset()
+			return true
+		})
+
+		if cli.sync != nil {
+			cli.sync.ses.files.reset()
+		}
+	}
+}
+
+func (cli *RttyClient) dialFileChannel(token []byte) (*fileChannel, error) {
+	cfg := cli.cfg
+
+	resolver, err := newResolver(cfg.dnsServer)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer, tlsConfig, err := cli.transport(resolver)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := cli.dial(dialer, cli.addr, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	conn = newThrottledConn(conn, cfg.maxUploadRate, cfg.maxDownloadRate)
+	conn = &statsConn{Conn: conn, stats: &cli.stats}
+
+	fc := &fileChannel{
+		conn: conn,
+		msg:  proto.NewMsgReaderWriter(proto.RoleRtty, conn),
+	}
+
+	if err := fc.register(cli, token); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if alg := cli.msg.Compression(); alg != 0 {
+		fc.msg.SetCompression(alg)
+	}
+
+	return fc, nil
+}
+
+// register tells the server which device the connection is the file channel
+// of, it answers like to a registration
+func (fc *fileChannel) register(cli *RttyClient, token []byte) error {
+	bb := bytebufferpool.Get()
+	defer bytebufferpool.Put(bb)
+
+	bb.WriteByte(rttyProtoVer)
+
+	putMsgAttr(bb, proto.MsgRegAttrDevid, cli.cfg.id)
+	putMsgAttr(bb, proto.MsgRegAttrFileChannel, token)
+
+	if err := fc.writeMsg(cli, proto.MsgTypeRegister, bb); err != nil {
+		return err
+	}
+
+	fc.conn.SetReadDeadline(time.Now().Add(time.Duration(cli.cfg.readTimeout) * time.Second))
+	defer fc.conn.SetReadDeadline(time.Time{})
+
+	typ, data, err := fc.msg.Read()
+	if err != nil {
+		return err
+	}
+
+	if typ != proto.MsgTypeRegister {
+		return fmt.Errorf("register msg expected first, got %s", proto.MsgTypeName(typ))
+	}
+
+	if data[0] != 0 {
+		return fmt.Errorf("register failed: %s", string(data[1:]))
+	}
+
+	return nil
+}
+
+func (fc *fileChannel) writeMsg(cli *RttyClient, typ byte, data ...any) error {
+	if cli.cfg.writeTimeout > 0 {
+		fc.conn.SetWriteDeadline(time.Now().Add(time.Duration(cli.cfg.writeTimeout) * time.Second))
+	}
+
+	err := fc.msg.Write(typ, data...)
+	if err != nil {
+		// The read fails as well, which closes the channel
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			log.Error().Msgf("write %s stalled over %ds on file channel", proto.MsgTypeName(typ), cli.cfg.writeTimeout)
+			fc.conn.Close()
+		}
+		return err
+	}
+
+	cli.stats.msgsOut[typ].Add(1)
+
+	return nil
+}
+
+// writeFileMsg writes a file message through the file channel if open, else
+// through the connection
+func (cli *RttyClient) writeFileMsg(data ...any) error {
+	if fc := cli.fileChannel.Load(); fc != nil {
+		return fc.writeMsg(cli, proto.MsgTypeFile, data...)
+	}
+	return cli.WriteMsg(proto.MsgTypeFile, data...)
+}
+
+func (cli *RttyClient) closeFileChannel() {
+	if fc := cli.fileChannel.Swap(nil); fc != nil {
+		fc.conn.Close()
+	}
+}
@@ -0,0 +1,111 @@
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/zhaojh329/rtty-go/proto"
+)
+
+// Each data frame of a transfer is compressed on its own, so it can be
+// written out as soon as it comes, before acknowledging it.
+
+var (
+	zstdEncoder *zstd.Encoder
+	zstdOnce    sync.Once
+)
+
+func fileCompressName(alg byte) string {
+	switch alg {
+	case proto.FileCompressNone:
+		return "none"
+	case proto.FileCompressGzip:
+		return "gzip"
+	case proto.FileCompressZstd:
+		return "zstd"
+	default:
+		return fmt.Sprintf("unknown(%d)", alg)
+	}
+}
+
+// The encoder is shared by all the transfers, EncodeAll may be used at once
+func initZstd() {
+	zstdOnce.Do(func() {
+		zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	})
+}
+
+// compressFileData appends the frame of data compressed with alg to dst
+func compressFileData(alg byte, dst, data []byte) ([]byte, error) {
+	switch alg {
+	case proto.FileCompressGzip:
+		buf := bytes.NewBuffer(dst)
+		w := gzip.NewWriter(buf)
+
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+
+		return buf.Bytes(), nil
+
+	case proto.FileCompressZstd:
+		initZstd()
+		return zstdEncoder.EncodeAll(data, dst), nil
+
+	default:
+		return nil, fmt.Errorf("unsupported file compression: %d", alg)
+	}
+}
+
+// decompressFileData appends the frame decompressed with alg to dst, failing
+// when it's more than max bytes
+func decompressFileData(alg byte, dst, frame []byte, max uint64) ([]byte, error) {
+	var r io.Reader
+
+	switch alg {
+	case proto.FileCompressGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(frame))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		r = zr
+
+	case proto.FileCompressZstd:
+		zr, err := zstd.NewReader(bytes.NewReader(frame), zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		r = zr
+
+	default:
+		return nil, fmt.Errorf("unsupported file compression: %d", alg)
+	}
+
+	buf := bytes.NewBuffer(dst)
+
+	n, err := buf.ReadFrom(io.LimitReader(r, int64(max)+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if uint64(n) > max {
+		return nil, fmt.Errorf("decompressed data larger than the file")
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,140 @@
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/zhaojh329/rtty-go/proto"
+	"github.com/zhaojh329/rtty-go/utils"
+
+	"github.com/rs/zerolog/log"
+)
+
+// What rtty -R answers when asked to receive a file
+const (
+	fileConfirmNo = byte(iota)
+	fileConfirmYes
+)
+
+// rtty -R declines the file when not answering in time
+const fileConfirmTimeout = time.Minute
+
+func checkFileAllowConfig(cfg *Config) error {
+	for _, pattern := range cfg.fileAllow {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid file-allow '%s': %w", pattern, err)
+		}
+	}
+
+	return nil
+}
+
+// fileAllowed tells whether a file of the name may be received, any with no
+// file-allow patterns
+func fileAllowed(cfg *Config, name string) bool {
+	if len(cfg.fileAllow) == 0 {
+		return true
+	}
+
+	return slices.ContainsFunc(cfg.fileAllow, func(pattern string) bool {
+		ok, _ := filepath.Match(pattern, name)
+		return ok
+	})
+}
+
+// receive goes on with the download of name once the server told about it,
+// refusing it unless allowed, and asking rtty -R first under file-confirm
+func (ctx *RttyFileContext) receive(name string) {
+	cfg := &ctx.ses.cli.cfg
+
+	if !fileAllowed(cfg, name) {
+		log.Error().Msgf("file %s is not allowed", name)
+		ctx.send(proto.MsgTypeFileAbort, nil)
+		ctx.sendControlMsg(MsgTypeFileCtlNotAllowed, []byte(name))
+		ctx.reset()
+		return
+	}
+
+	// No one is there to ask about what directory sync pulls
+	if cfg.fileConfirm && ctx.ses.sid != proto.FileSyncSid {
+		ctx.confirming = true
+		ctx.asking = name
+		ctx.askTimer = time.AfterFunc(fileConfirmTimeout, func() { ctx.answer(fileConfirmNo) })
+
+		data := binary.NativeEndian.AppendUint64(nil, ctx.totalSize)
+		data = append(data, name...)
+
+		if ctx.sendControlMsg(MsgTypeFileCtlConfirm, data) == nil {
+			ctx.waitAnswer()
+		}
+		return
+	}
+
+	ctx.save(name)
+}
+
+// confirmed goes on with the download rtty -R was asked about by receive
+func (ctx *RttyFileContext) confirmed(name string, choice byte) {
+	if choice != fileConfirmYes {
+		log.Info().Msgf("file %s declined", ctx.savepath)
+		ctx.send(proto.MsgTypeFileAbort, nil)
+		ctx.sendControlMsg(MsgTypeFileCtlDeclined, nil)
+		ctx.reset()
+		return
+	}
+
+	ctx.save(name)
+}
+
+// save downloads name into savepath, unless already there
+func (ctx *RttyFileContext) save(name string) {
+	if ctx.output != "" {
+		ctx.openOutput(name)
+		return
+	}
+
+	if ctx.store != nil {
+		ctx.openStorage(name)
+		return
+	}
+
+	if !ctx.resolveSymlink() {
+		return
+	}
+
+	if utils.FileExists(ctx.savepath) {
+		ctx.fileExists(name)
+		return
+	}
+
+	ctx.create(name, false)
+}
+
+// askFileConfirm prompts the user of rtty -R about the file to receive
+func askFileConfirm(name string, size uint64) byte {
+	if fileJSON != nil {
+		fileEvent("confirm", "name", name, "size", size)
+	} else {
+		fmt.Printf("Receive '%s'(%s)? [y/N] ", name, utils.FormatSize(size))
+	}
+
+	line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+
+	switch strings.ToLower(strings.TrimSpace(line)) {
+	case "y", "yes":
+		return fileConfirmYes
+	default:
+		return fileConfirmNo
+	}
+}
@@ -0,0 +1,146 @@
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/zhaojh329/rtty-go/proto"
+)
+
+// AES-256 keys, file-key and those of the transfers
+const fileCryptKeySize = 32
+
+var errFileCrypt = errors.New("the server doesn't support encrypted file transfers")
+
+func parseFileKey(s string) ([]byte, error) {
+	key, err := hex.DecodeString(s)
+	if err != nil || len(key) != fileCryptKeySize {
+		return nil, fmt.Errorf("invalid file-key: must be %d hex digits", fileCryptKeySize*2)
+	}
+	return key, nil
+}
+
+func checkFileKeyConfig(cfg *Config) error {
+	if cfg.fileKey == "" {
+		return nil
+	}
+
+	_, err := parseFileKey(cfg.fileKey)
+	return err
+}
+
+// checkFileCrypt tells whether files may be transferred, which with file-key
+// they only may encrypted
+func checkFileCrypt(cli *RttyClient) error {
+	if cli.cfg.fileKey != "" && !cli.fileCrypt.Load() {
+		return errFileCrypt
+	}
+	return nil
+}
+
+// fileCrypt encrypts or decrypts the data frames of a transfer with AES-GCM,
+// under a key of the transfer of its own. The nonce of a frame is its number,
+// so that they can neither be reordered nor replayed.
+type fileCrypt struct {
+	aead cipher.AEAD
+	seq  uint64
+}
+
+func newFileCrypt(key []byte) (*fileCrypt, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileCrypt{aead: aead}, nil
+}
+
+// newFileCryptKey returns the encryption of a transfer under a random key,
+// and the key sealed with file-key, for the other end
+func newFileCryptKey(fileKey string) (*fileCrypt, []byte, error) {
+	kek, err := parseFileKey(fileKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key := make([]byte, fileCryptKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, nil, err
+	}
+
+	wrapper, err := newFileCrypt(kek)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	nonce := make([]byte, wrapper.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+
+	fc, err := newFileCrypt(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return fc, wrapper.aead.Seal(nonce, nonce, key, nil), nil
+}
+
+// openFileCryptKey returns the encryption of a transfer under the key the
+// other end sealed with file-key
+func openFileCryptKey(fileKey string, wrapped []byte) (*fileCrypt, error) {
+	kek, err := parseFileKey(fileKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(wrapped) != proto.FileCryptSealedKeySize {
+		return nil, fmt.Errorf("invalid file key size %d", len(wrapped))
+	}
+
+	wrapper, err := newFileCrypt(kek)
+	if err != nil {
+		return nil, err
+	}
+
+	n := wrapper.aead.NonceSize()
+
+	key, err := wrapper.aead.Open(nil, wrapped[:n], wrapped[n:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("file key not sealed with file-key: %w", err)
+	}
+
+	return newFileCrypt(key)
+}
+
+func (fc *fileCrypt) nonce() []byte {
+	nonce := make([]byte, fc.aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], fc.seq)
+	fc.seq++
+	return nonce
+}
+
+// seal encrypts the next frame
+func (fc *fileCrypt) seal(frame []byte) []byte {
+	return fc.aead.Seal(nil, fc.nonce(), frame, nil)
+}
+
+// open decrypts the next frame
+func (fc *fileCrypt) open(frame []byte) ([]byte, error) {
+	return fc.aead.Open(nil, fc.nonce(), frame, nil)
+}
@@ -0,0 +1,208 @@
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package main
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/zhaojh329/rtty-go/proto"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// Blocks of the signature are about the square root of the file in size,
+	// within these
+	fileDeltaMinBlock = 4 * 1024
+	fileDeltaMaxBlock = 1024 * 1024
+
+	// Weak and strong checksum of a block
+	fileDeltaSigSize = 4 + md5.Size
+
+	// Blocks in a FileSig message
+	fileDeltaSigBlocks = 3000
+)
+
+// fileDeltaBlockSize returns the size of the blocks a file of size is
+// signed in
+func fileDeltaBlockSize(size int64) uint32 {
+	block := uint32(fileDeltaMinBlock)
+
+	for int64(block)*int64(block) < size && block < fileDeltaMaxBlock {
+		block <<= 1
+	}
+
+	return block
+}
+
+// fileDeltaWeakSum is the rolling checksum of rsync, which the server
+// computes at every offset of the new file to find the blocks
+func fileDeltaWeakSum(data []byte) uint32 {
+	var a, b uint32
+
+	n := uint32(len(data))
+
+	for i, c := range data {
+		a += uint32(c)
+		b += (n - uint32(i)) * uint32(c)
+	}
+
+	return a&0xffff | b<<16
+}
+
+// fileSignature returns the block size and the checksums of the blocks of
+// the file
+func fileSignature(file *os.File) (uint32, []byte, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	block := fileDeltaBlockSize(info.Size())
+	blocks := (info.Size() + int64(block) - 1) / int64(block)
+
+	sig := make([]byte, 0, blocks*fileDeltaSigSize)
+	buf := make([]byte, block)
+
+	r := io.NewSectionReader(file, 0, info.Size())
+
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			sig = binary.BigEndian.AppendUint32(sig, fileDeltaWeakSum(buf[:n]))
+			sum := md5.Sum(buf[:n])
+			sig = append(sig, sum[:]...)
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+
+	return block, sig, nil
+}
+
+// sendSignature tells the server what the file the download replaces is
+// made of, in FileSig messages the first of which starts with the block size,
+// until an empty one. Without the file to go from there's only that, and the
+// server sends the file as usual. Signing a large file takes its time, which
+// mustn't hold up the messages of the connection meanwhile.
+func (ctx *RttyFileContext) sendSignature() {
+	basis := ctx.basis
+
+	if basis == nil {
+		ctx.send(proto.MsgTypeFileSig, nil)
+		return
+	}
+
+	ctx.signing = true
+
+	go func() {
+		block, sig, err := fileSignature(basis)
+
+		ctx.mu.Lock()
+		defer ctx.mu.Unlock()
+
+		ctx.signing = false
+
+		if ctx.done {
+			return
+		}
+
+		if err != nil {
+			log.Warn().Err(err).Msgf("failed to sign %s, downloading it all", ctx.savepath)
+			ctx.basis.Close()
+			ctx.basis = nil
+			ctx.send(proto.MsgTypeFileSig, nil)
+			return
+		}
+
+		ctx.block = block
+
+		log.Debug().Msgf("delta download: %s, block size: %d, blocks: %d", ctx.savepath, block,
+			len(sig)/fileDeltaSigSize)
+
+		data := binary.BigEndian.AppendUint32(nil, block)
+
+		for {
+			n := min(len(sig), fileDeltaSigBlocks*fileDeltaSigSize)
+
+			if ctx.send(proto.MsgTypeFileSig, append(data, sig[:n]...)) != nil {
+				return
+			}
+
+			sig = sig[n:]
+			data = nil
+
+			if len(sig) == 0 {
+				break
+			}
+		}
+
+		ctx.send(proto.MsgTypeFileSig, nil)
+	}()
+}
+
+// applyDelta writes what a frame of a delta download holds, data or blocks
+// of the file it replaces, and returns how much
+func (ctx *RttyFileContext) applyDelta(frame []byte) (int, error) {
+	if len(frame) < 1 {
+		return 0, fmt.Errorf("empty delta frame")
+	}
+
+	switch frame[0] {
+	case proto.FileDeltaLiteral:
+		data, err := ctx.decompress(frame[1:])
+		if err != nil {
+			return 0, err
+		}
+
+		ctx.sum.Write(data)
+
+		return ctx.file.Write(data)
+
+	case proto.FileDeltaCopy:
+		if len(frame) < 9 {
+			return 0, fmt.Errorf("invalid delta copy")
+		}
+
+		first := int64(binary.BigEndian.Uint32(frame[1:]))
+		count := int64(binary.BigEndian.Uint32(frame[5:]))
+
+		off := first * int64(ctx.block)
+		size := count * int64(ctx.block)
+
+		info, err := ctx.basis.Stat()
+		if err != nil {
+			return 0, err
+		}
+
+		// Only the last block may be short
+		size = min(size, info.Size()-off)
+
+		if size <= 0 || uint64(size) > ctx.remainSize {
+			return 0, fmt.Errorf("invalid delta copy of %d blocks from %d", count, first)
+		}
+
+		n, err := io.Copy(io.MultiWriter(ctx.file, ctx.sum), io.NewSectionReader(ctx.basis, off, size))
+		if err == nil && n < size {
+			err = io.ErrUnexpectedEOF
+		}
+
+		return int(n), err
+
+	default:
+		return 0, fmt.Errorf("unknown delta op %d", frame[0])
+	}
+}
@@ -0,0 +1,171 @@
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/zhaojh329/rtty-go/proto"
+	"github.com/zhaojh329/rtty-go/utils"
+
+	"github.com/rs/zerolog/log"
+)
+
+// What to do when a file of the same name is already there, rtty -R may
+// choose, fileExistDefault leaves it to the file-exist option
+const (
+	fileExistDefault = byte(iota)
+	fileExistError
+	fileExistOverwrite
+	fileExistRename
+	fileExistSkip
+	fileExistAsk
+)
+
+var fileExistPolicies = []string{"", "error", "overwrite", "rename", "skip", "ask"}
+
+// rtty -R skips the file when not answering in time
+const fileExistAskTimeout = time.Minute
+
+func parseFileExist(s string) (byte, error) {
+	for i, name := range fileExistPolicies[1:] {
+		if name == s {
+			return byte(i + 1), nil
+		}
+	}
+
+	return 0, fmt.Errorf("invalid file-exist: %s, must be one of error, overwrite, rename, skip, ask", s)
+}
+
+func checkFileExistConfig(cfg *Config) error {
+	_, err := parseFileExist(cfg.fileExist)
+	return err
+}
+
+// fileExists handles the download of name into savepath, where a file is
+// already there
+func (ctx *RttyFileContext) fileExists(name string) {
+	policy := ctx.exist
+	if policy == fileExistDefault {
+		policy, _ = parseFileExist(ctx.ses.cli.cfg.fileExist)
+	}
+
+	switch policy {
+	case fileExistOverwrite:
+		// A link left by resolveSymlink is replaced, as its owner may
+		info, err := os.Lstat(ctx.savepath)
+		if err != nil || !(info.Mode().IsRegular() || info.Mode()&os.ModeSymlink != 0) || !ctx.mayOverwrite(info) {
+			log.Error().Msgf("file %s already exists, not overwriting it", ctx.savepath)
+			ctx.sendControlMsg(MsgTypeFileCtlErrExist, nil)
+			ctx.reset()
+			return
+		}
+
+		log.Info().Msgf("overwriting file %s", ctx.savepath)
+		ctx.create(name, true)
+
+	case fileExistRename:
+		name, ok := freeFileName(filepath.Dir(ctx.savepath), name)
+		if !ok {
+			log.Error().Msgf("file %s already exists, found no name to rename it to", ctx.savepath)
+			ctx.sendControlMsg(MsgTypeFileCtlErrExist, nil)
+			ctx.reset()
+			return
+		}
+
+		ctx.savepath = filepath.Join(filepath.Dir(ctx.savepath), name)
+		ctx.create(name, false)
+
+	case fileExistSkip:
+		log.Info().Msgf("file %s already exists, skipped", ctx.savepath)
+		ctx.send(proto.MsgTypeFileAbort, nil)
+		ctx.sendControlMsg(MsgTypeFileCtlSkipped, nil)
+		ctx.reset()
+
+	case fileExistAsk:
+		ctx.asking = name
+		ctx.askTimer = time.AfterFunc(fileExistAskTimeout, func() { ctx.answer(fileExistSkip) })
+
+		if ctx.sendControlMsg(MsgTypeFileCtlExist, []byte(name)) == nil {
+			ctx.waitAnswer()
+		}
+
+	default:
+		log.Error().Msgf("file %s already exists", ctx.savepath)
+		ctx.sendControlMsg(MsgTypeFileCtlErrExist, nil)
+		ctx.reset()
+	}
+}
+
+// answer goes on with the download asked about by fileExists or receive, as
+// rtty -R chose
+func (ctx *RttyFileContext) answer(choice byte) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	if ctx.asking == "" {
+		return
+	}
+
+	name := ctx.asking
+
+	ctx.asking = ""
+	ctx.askTimer.Stop()
+
+	if ctx.confirming {
+		ctx.confirming = false
+		ctx.confirmed(name, choice)
+		return
+	}
+
+	if choice != fileExistOverwrite && choice != fileExistRename {
+		choice = fileExistSkip
+	}
+
+	ctx.exist = choice
+	ctx.fileExists(name)
+}
+
+// freeFileName returns name with a number added, e.g. a-1.txt for a.txt, so
+// that no file in dir has it
+func freeFileName(dir, name string) (string, bool) {
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+
+	for i := 1; i < 1000; i++ {
+		name := fmt.Sprintf("%s-%d%s", base, i, ext)
+		if !utils.FileExists(filepath.Join(dir, name)) {
+			return name, true
+		}
+	}
+
+	return "", false
+}
+
+// askFileExist prompts the user of rtty -R about the file of the same name
+func askFileExist(name string) byte {
+	if fileJSON != nil {
+		fileEvent("exist", "name", name)
+	} else {
+		fmt.Printf("'%s' already exists, [o]verwrite, [r]ename or [s]kip? ", name)
+	}
+
+	line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+
+	switch strings.ToLower(strings.TrimSpace(line)) {
+	case "o", "overwrite":
+		return fileExistOverwrite
+	case "r", "rename":
+		return fileExistRename
+	default:
+		return fileExistSkip
+	}
+}
@@ -0,0 +1,119 @@
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// fileMeta is what is kept of a file besides its data once the server takes
+// it. It's the permission bits, the mtime in seconds, 0 if unknown, then the
+// length and the owner as user:group, ahead of the name in the FileInfo and
+// FileSend messages.
+type fileMeta struct {
+	mode  os.FileMode
+	mtime int64
+	owner string
+}
+
+const fileMetaMinSize = 13
+
+func newFileMeta(info os.FileInfo, withOwner bool) *fileMeta {
+	m := &fileMeta{
+		mode:  info.Mode().Perm(),
+		mtime: info.ModTime().Unix(),
+	}
+
+	if withOwner {
+		m.owner = fileOwner(info)
+		if len(m.owner) > 0xff {
+			m.owner = ""
+		}
+	}
+
+	return m
+}
+
+func (m *fileMeta) append(b []byte) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(m.mode))
+	b = binary.BigEndian.AppendUint64(b, uint64(m.mtime))
+	b = append(b, byte(len(m.owner)))
+	return append(b, m.owner...)
+}
+
+// parseFileMeta returns the meta at the start of b, and what follows it
+func parseFileMeta(b []byte) (*fileMeta, []byte, error) {
+	if len(b) < fileMetaMinSize {
+		return nil, nil, fmt.Errorf("invalid file meta")
+	}
+
+	// Neither setuid nor setgid make it through
+	m := &fileMeta{
+		mode:  os.FileMode(binary.BigEndian.Uint32(b)).Perm(),
+		mtime: int64(binary.BigEndian.Uint64(b[4:])),
+	}
+
+	n := fileMetaMinSize + int(b[12])
+	if len(b) < n {
+		return nil, nil, fmt.Errorf("invalid file meta")
+	}
+
+	m.owner = string(b[fileMetaMinSize:n])
+
+	return m, b[n:], nil
+}
+
+// apply gives the file at path the mode and mtime of m
+func (m *fileMeta) apply(path string) {
+	if m.mode != 0 {
+		if err := os.Chmod(path, m.mode); err != nil {
+			log.Warn().Err(err).Msgf("failed to change mode of file %s", path)
+		}
+	}
+
+	if m.mtime != 0 {
+		mtime := time.Unix(m.mtime, 0)
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			log.Warn().Err(err).Msgf("failed to change mtime of file %s", path)
+		}
+	}
+}
+
+// lookupOwner returns the uid and gid of user:group, either may be numeric
+func lookupOwner(owner string) (uint32, uint32, error) {
+	name, group, ok := strings.Cut(owner, ":")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid owner '%s'", owner)
+	}
+
+	uid, err := strconv.ParseUint(name, 10, 32)
+	if err != nil {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return 0, 0, err
+		}
+		uid, _ = strconv.ParseUint(u.Uid, 10, 32)
+	}
+
+	gid, err := strconv.ParseUint(group, 10, 32)
+	if err != nil {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			return 0, 0, err
+		}
+		gid, _ = strconv.ParseUint(g.Gid, 10, 32)
+	}
+
+	return uint32(uid), uint32(gid), nil
+}
@@ -0,0 +1,107 @@
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/zhaojh329/rtty-go/utils"
+)
+
+// rtty -R/-S --json writes a JSON object per line here rather than show how
+// the transfer goes: start, progress and, whatever happens, end with its
+// result. nil without --json.
+var fileJSON io.Writer
+
+// fileEvent writes an event of rtty -R/-S --json, with the fields given as
+// key and value pairs
+func fileEvent(event string, fields ...any) {
+	obj := map[string]any{"event": event}
+
+	for i := 0; i+1 < len(fields); i += 2 {
+		obj[fields[i].(string)] = fields[i+1]
+	}
+
+	data, _ := json.Marshal(obj)
+
+	fileJSON.Write(append(data, '\n'))
+}
+
+// fileFatal tells why rtty -R/-S can't go on and exits
+func fileFatal(format string, a ...any) {
+	fileFatalTo(os.Stdout, format, a...)
+}
+
+// fileFatalTo is fileFatal showing it on w
+func fileFatalTo(w io.Writer, format string, a ...any) {
+	msg := fmt.Sprintf(format, a...)
+
+	if fileJSON != nil {
+		fileEvent("end", "result", "error", "message", msg)
+	} else {
+		fmt.Fprintln(w, msg)
+	}
+
+	os.Exit(1)
+}
+
+// fileEnd tells the transfer ended with result other than ok, showing text
+func fileEnd(result, msg, text string) {
+	if fileJSON != nil {
+		fileEvent("end", "result", result, "message", msg)
+		return
+	}
+
+	fmt.Print(text)
+}
+
+// fileDone tells all of the file was transferred, how long it took, how
+// fast on average and the checksum of the data
+func fileDone(startTime time.Time, size uint64, sum []byte) {
+	elapsed := time.Since(startTime).Seconds()
+
+	var rate uint64
+
+	if elapsed > 0 {
+		rate = uint64(float64(size) / elapsed)
+	}
+
+	if fileJSON != nil {
+		fileEvent("end", "result", "ok", "size", size, "elapsed", elapsed, "rate", rate,
+			"sha256", hex.EncodeToString(sum))
+		return
+	}
+
+	fmt.Printf("\n  %s (%d bytes) in %.3fs, %s/s, SHA-256 %x\n", utils.FormatSize(size), size, elapsed,
+		utils.FormatSize(rate), sum)
+}
+
+// fileProgressEvent tells how much was transferred of total, unknown for a
+// stream
+func fileProgressEvent(startTime time.Time, transferred, total uint64) {
+	elapsed := time.Since(startTime).Seconds()
+
+	fields := []any{"transferred", transferred, "elapsed", elapsed}
+
+	if elapsed > 0 {
+		fields = append(fields, "rate", uint64(float64(transferred)/elapsed))
+	}
+
+	if total > 0 {
+		fields = append(fields, "total", total, "percent", transferred*100/total)
+
+		if transferred > 0 {
+			fields = append(fields, "eta", elapsed*float64(total-transferred)/float64(transferred))
+		}
+	}
+
+	fileEvent("progress", fields...)
+}
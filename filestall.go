@@ -0,0 +1,62 @@
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package main
+
+import (
+	"time"
+
+	"github.com/zhaojh329/rtty-go/proto"
+
+	"github.com/rs/zerolog/log"
+)
+
+// watchStall aborts the transfer once it stalled: nothing came from the
+// server for file-stall-timeout while rtty waited on it. Without it, a
+// transfer the server forgot about would keep its slot and file forever.
+func (ctx *RttyFileContext) watchStall() {
+	timeout := time.Duration(ctx.ses.cli.cfg.fileStallTimeout) * time.Second
+	if timeout == 0 {
+		return
+	}
+
+	ctx.lastActive = time.Now()
+	ctx.stallTimer = time.AfterFunc(timeout, ctx.checkStall)
+}
+
+// busy tells whether the transfer waits on rtty rather than the server:
+// rtty -R answering, writing or reading a pipe, file-max-rate or the signature
+// of a delta download
+func (ctx *RttyFileContext) busy() bool {
+	return ctx.asking != "" || ctx.writing || ctx.reading || ctx.throttled || ctx.signing
+}
+
+func (ctx *RttyFileContext) checkStall() {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	if ctx.done {
+		return
+	}
+
+	timeout := time.Duration(ctx.ses.cli.cfg.fileStallTimeout) * time.Second
+
+	// The server is given the whole of it once rtty is done
+	if ctx.busy() {
+		ctx.lastActive = time.Now()
+	}
+
+	if idle := time.Since(ctx.lastActive); idle < timeout {
+		ctx.stallTimer.Reset(timeout - idle)
+		return
+	}
+
+	log.Error().Msgf("file transfer %d of %s stalled for %ds, aborting it", ctx.id, ctx.ses.sid,
+		ctx.ses.cli.cfg.fileStallTimeout)
+
+	ctx.send(proto.MsgTypeFileAbort, nil)
+	ctx.sendControlMsg(MsgTypeFileCtlStalled, nil)
+	ctx.reset()
+}
@@ -0,0 +1,411 @@
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Where rtty -R saves files, see file-storage
+const (
+	fileStorageFile   = "file"
+	fileStoragePipe   = "pipe:"
+	fileStorageDevice = "device:"
+	fileStorageS3     = "s3:"
+)
+
+var errFileIncomplete = errors.New("incomplete file")
+
+// fileStorage is where rtty -R saves files other than into the directory it
+// runs in. The file comes through a pipe, so that it isn't kept anywhere
+// meanwhile.
+type fileStorage interface {
+	// store saves the file of name and size read from r, giving up once ctx
+	// is done
+	store(ctx context.Context, r io.Reader, name string, size uint64) error
+
+	// target tells where the file of name ends up
+	target(name string) string
+}
+
+// newFileStorage returns the storage of file-storage, nil for files
+func newFileStorage(cfg *Config) (fileStorage, error) {
+	s := cfg.fileStorage
+
+	switch {
+	case s == fileStorageFile:
+		return nil, nil
+
+	case strings.HasPrefix(s, fileStoragePipe):
+		args := strings.Fields(strings.TrimPrefix(s, fileStoragePipe))
+		if len(args) == 0 {
+			return nil, fmt.Errorf("invalid file-storage: %s, no command", s)
+		}
+		return &pipeStorage{args: args}, nil
+
+	case strings.HasPrefix(s, fileStorageDevice):
+		dev := strings.TrimPrefix(s, fileStorageDevice)
+		if !strings.HasPrefix(dev, "/") {
+			return nil, fmt.Errorf("invalid file-storage: %s, device must be an absolute path", s)
+		}
+		return &deviceStorage{dev: dev}, nil
+
+	case strings.HasPrefix(s, fileStorageS3):
+		u, err := url.Parse(strings.TrimPrefix(s, fileStorageS3))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid file-storage: %s, must be s3:http(s)://host/bucket[/prefix]", s)
+		}
+
+		if (cfg.fileS3AccessKey == "") != (cfg.fileS3SecretKey == "") {
+			return nil, fmt.Errorf("file-s3-access-key and file-s3-secret-key go together")
+		}
+
+		return &s3Storage{
+			base:      u,
+			accessKey: cfg.fileS3AccessKey,
+			secretKey: cfg.fileS3SecretKey,
+			region:    cfg.fileS3Region,
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("invalid file-storage: %s, must be file, pipe:COMMAND, device:PATH or s3:URL", s)
+	}
+}
+
+func checkFileStorageConfig(cfg *Config) error {
+	_, err := newFileStorage(cfg)
+	return err
+}
+
+// storeReader reads the file off the pipe, which ends early when the
+// transfer fails, so that the storage doesn't take it for all of it
+type storeReader struct {
+	r    io.Reader
+	ctx  context.Context
+	left uint64
+}
+
+func (sr *storeReader) Read(p []byte) (int, error) {
+	n, err := sr.r.Read(p)
+
+	sr.left -= min(sr.left, uint64(n))
+
+	if err == io.EOF {
+		if sr.ctx.Err() != nil {
+			return n, sr.ctx.Err()
+		}
+
+		if sr.left > 0 {
+			return n, errFileIncomplete
+		}
+	}
+
+	return n, err
+}
+
+// storedFile is a download going into a fileStorage
+type storedFile struct {
+	cancel context.CancelFunc
+	result chan error
+}
+
+// openStorage downloads name into the file-storage, through a pipe whose
+// other end the storage reads in the background
+func (ctx *RttyFileContext) openStorage(name string) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		log.Error().Err(err).Msg("failed to create pipe for file storage")
+		ctx.sendControlMsg(MsgTypeFileCtlErr, nil)
+		ctx.reset()
+		return
+	}
+
+	c, cancel := context.WithCancel(context.Background())
+
+	sf := &storedFile{cancel: cancel, result: make(chan error, 1)}
+	store := ctx.store
+	size := ctx.totalSize
+
+	ctx.stored = sf
+	ctx.savepath = store.target(name)
+
+	go func() {
+		sf.result <- store.store(c, &storeReader{r: r, ctx: c, left: size}, name, size)
+
+		// Writes that come still fail rather than wait
+		r.Close()
+	}()
+
+	log.Debug().Msgf("download file: %s into %s, size: %d bytes, compression: %s", name, ctx.savepath,
+		ctx.totalSize, fileCompressName(ctx.compress))
+
+	ctx.opened(w, name)
+}
+
+// commitStorage waits for the storage to have all of the file, the pipe
+// already closed
+func (ctx *RttyFileContext) commitStorage() error {
+	sf := ctx.stored
+	ctx.stored = nil
+
+	err := <-sf.result
+	sf.cancel()
+
+	return err
+}
+
+// abortStorage tells the storage the file won't be complete, unless it
+// failed already, which is why
+func (ctx *RttyFileContext) abortStorage() {
+	select {
+	case err := <-ctx.stored.result:
+		if err != nil {
+			log.Error().Err(err).Msgf("failed to store file into %s", ctx.savepath)
+		}
+	default:
+	}
+
+	ctx.stored.cancel()
+	ctx.stored = nil
+}
+
+// pipeStorage writes files into the stdin of a command, which is told about
+// them in its environment, as the hooks are
+type pipeStorage struct {
+	args []string
+}
+
+func (s *pipeStorage) target(_ string) string {
+	return "|" + strings.Join(s.args, " ")
+}
+
+func (s *pipeStorage) store(ctx context.Context, r io.Reader, name string, size uint64) error {
+	cmd := exec.CommandContext(ctx, s.args[0], s.args[1:]...)
+	cmd.Stdin = r
+	cmd.Env = append(os.Environ(),
+		"RTTY_FILE_NAME="+name,
+		"RTTY_FILE_SIZE="+strconv.FormatUint(size, 10),
+	)
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("%s: %w: %s", s.args[0], err, strings.TrimSpace(string(out)))
+	}
+
+	if len(out) > 0 {
+		log.Info().Msgf("%s: %s", s.args[0], strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
+
+// deviceStorage writes files from the start of a block device or an MTD
+// partition, in place of what was there, e.g. a firmware image into the
+// partition it boots from
+type deviceStorage struct {
+	dev string
+}
+
+func (s *deviceStorage) target(_ string) string {
+	return s.dev
+}
+
+func (s *deviceStorage) store(ctx context.Context, r io.Reader, _ string, size uint64) error {
+	f, err := os.OpenFile(s.dev, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Some devices only take writes of whole pages
+	align, err := prepareDevice(f, size)
+	if err != nil {
+		return fmt.Errorf("%s: %w", s.dev, err)
+	}
+
+	w := bufio.NewWriterSize(f, max(align, 64*1024))
+
+	n, err := io.Copy(w, r)
+	if err != nil {
+		return err
+	}
+
+	if pad := int(n % int64(align)); pad > 0 {
+		// Erased flash reads 0xff
+		w.Write(bytes.Repeat([]byte{0xff}, align-pad))
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	return f.Sync()
+}
+
+// checkDeviceSize tells whether a file of size fits into the block device
+// f, whose size is found by seeking to its end. Files, which grow, always do.
+func checkDeviceSize(f *os.File, size uint64) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if info.Mode()&os.ModeDevice == 0 {
+		return nil
+	}
+
+	end, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	if size > uint64(end) {
+		return fmt.Errorf("%w: %d bytes, the device has %d", errFileTooLarge, size, end)
+	}
+
+	return nil
+}
+
+// s3Storage uploads files into a bucket of S3, or of a server speaking its
+// API, under its URL. Requests are signed with AWS Signature Version 4 when
+// there are keys, else they go as they are, to a bucket letting anyone
+// write into it.
+type s3Storage struct {
+	base      *url.URL
+	accessKey string
+	secretKey string
+	region    string
+}
+
+func (s *s3Storage) url(name string) *url.URL {
+	u := *s.base
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + name
+	u.RawPath = s3Escape(u.Path)
+	return &u
+}
+
+func (s *s3Storage) target(name string) string {
+	return s.url(name).String()
+}
+
+func (s *s3Storage) store(ctx context.Context, r io.Reader, name string, size uint64) error {
+	var body io.Reader = http.NoBody
+	if size > 0 {
+		body = r
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.url(name).String(), body)
+	if err != nil {
+		return err
+	}
+
+	// S3 takes no chunked uploads
+	req.ContentLength = int64(size)
+
+	if s.accessKey != "" {
+		s.sign(req, time.Now().UTC())
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	return nil
+}
+
+// sign adds the Authorization of AWS Signature Version 4 to req, leaving the
+// payload unsigned, as it's streamed
+func (s *s3Storage) sign(req *http.Request, now time.Time) {
+	const payload = "UNSIGNED-PAYLOAD"
+
+	amzDate := now.Format("20060102T150405Z")
+	date := amzDate[:8]
+
+	req.Header.Set("x-amz-content-sha256", payload)
+	req.Header.Set("x-amz-date", amzDate)
+
+	headers := "host;x-amz-content-sha256;x-amz-date"
+
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payload,
+		"x-amz-date:" + amzDate,
+		"",
+		headers,
+		payload,
+	}, "\n")
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonical))
+
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := []byte("AWS4" + s.secretKey)
+	for _, part := range []string{date, s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%x",
+		s.accessKey, scope, headers, hmacSHA256(key, toSign)))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Escape escapes a path as AWS signs it, all but the unreserved
+// characters and /
+func s3Escape(path string) string {
+	var sb strings.Builder
+
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~/", c) >= 0 {
+			sb.WriteByte(c)
+		} else {
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+
+	return sb.String()
+}
@@ -0,0 +1,83 @@
+//go:build linux
+// +build linux
+
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// MTD character devices, which take writes only once erased
+const (
+	mtdCharMajor = 90
+
+	memGetInfo = 0x80204d01 // MEMGETINFO, _IOR('M', 1, struct mtd_info_user)
+	memErase   = 0x40084d02 // MEMERASE, _IOW('M', 2, struct erase_info_user)
+)
+
+type mtdInfoUser struct {
+	typ       uint8
+	flags     uint32
+	size      uint32
+	erasesize uint32
+	writesize uint32
+	oobsize   uint32
+	padding   uint64
+}
+
+type eraseInfoUser struct {
+	start  uint32
+	length uint32
+}
+
+// prepareDevice checks the file of size fits into the device f, and returns
+// the size writes have to be a multiple of. The blocks of an MTD partition
+// the file goes into are erased first.
+func prepareDevice(f *os.File, size uint64) (int, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	st, ok := info.Sys().(*unix.Stat_t)
+	if !ok || info.Mode()&os.ModeCharDevice == 0 || unix.Major(uint64(st.Rdev)) != mtdCharMajor {
+		return 1, checkDeviceSize(f, size)
+	}
+
+	var mtd mtdInfoUser
+
+	if err := mtdIoctl(f, memGetInfo, unsafe.Pointer(&mtd)); err != nil {
+		return 0, fmt.Errorf("MEMGETINFO: %w", err)
+	}
+
+	if size > uint64(mtd.size) {
+		return 0, fmt.Errorf("%w: %d bytes, the partition has %d", errFileTooLarge, size, mtd.size)
+	}
+
+	for off := uint64(0); off < size; off += uint64(mtd.erasesize) {
+		erase := eraseInfoUser{start: uint32(off), length: mtd.erasesize}
+
+		if err := mtdIoctl(f, memErase, unsafe.Pointer(&erase)); err != nil {
+			return 0, fmt.Errorf("MEMERASE at %d: %w", off, err)
+		}
+	}
+
+	return int(max(mtd.writesize, 1)), nil
+}
+
+func mtdIoctl(f *os.File, req uintptr, arg unsafe.Pointer) error {
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), req, uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
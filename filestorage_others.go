@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package main
+
+import "os"
+
+// prepareDevice checks the file of size fits into the device f, and returns
+// the size writes have to be a multiple of
+func prepareDevice(f *os.File, size uint64) (int, error) {
+	return 1, checkDeviceSize(f, size)
+}
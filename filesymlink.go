@@ -0,0 +1,74 @@
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/zhaojh329/rtty-go/proto"
+
+	"github.com/rs/zerolog/log"
+)
+
+// What to do with a symbolic link where rtty -R saves a file, or given to
+// rtty -S
+const (
+	fileSymlinkReplace = "replace" // The link gives way to the file, what it points to is left alone
+	fileSymlinkFollow  = "follow"  // The file the link points to is written
+	fileSymlinkReject  = "reject"  // Links are neither written nor sent
+)
+
+// rtty -S refuses symbolic links when set to reject, which file-symlink sets
+// for the terminals
+const fileSymlinkEnv = "RTTY_FILE_SYMLINK"
+
+func checkFileSymlinkConfig(cfg *Config) error {
+	if !slices.Contains([]string{fileSymlinkReplace, fileSymlinkFollow, fileSymlinkReject}, cfg.fileSymlink) {
+		return fmt.Errorf("invalid file-symlink: %s, must be one of replace, follow, reject", cfg.fileSymlink)
+	}
+	return nil
+}
+
+func isSymlink(path string) bool {
+	info, err := os.Lstat(path)
+	return err == nil && info.Mode()&os.ModeSymlink != 0
+}
+
+// resolveSymlink applies file-symlink to savepath, which becomes the file
+// the link points to when following it. It returns false when the download
+// can't go on.
+func (ctx *RttyFileContext) resolveSymlink() bool {
+	if !isSymlink(ctx.savepath) {
+		return true
+	}
+
+	switch ctx.ses.cli.cfg.fileSymlink {
+	case fileSymlinkReject:
+		log.Error().Msgf("file %s is a symbolic link, refused", ctx.savepath)
+		ctx.send(proto.MsgTypeFileAbort, nil)
+		ctx.sendControlMsg(MsgTypeFileCtlSymlink, nil)
+		ctx.reset()
+		return false
+
+	case fileSymlinkFollow:
+		target, err := filepath.EvalSymlinks(ctx.savepath)
+		if err != nil {
+			log.Error().Err(err).Msgf("failed to follow symbolic link %s", ctx.savepath)
+			ctx.send(proto.MsgTypeFileAbort, nil)
+			ctx.sendControlMsg(MsgTypeFileCtlErr, nil)
+			ctx.reset()
+			return false
+		}
+
+		log.Debug().Msgf("following symbolic link %s to %s", ctx.savepath, target)
+		ctx.savepath = target
+	}
+
+	return true
+}
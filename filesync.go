@@ -0,0 +1,323 @@
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zhaojh329/rtty-go/proto"
+
+	"github.com/rs/zerolog/log"
+)
+
+func checkFileSyncConfig(cfg *Config) error {
+	for _, dir := range append(cfg.syncPush, cfg.syncPull...) {
+		if !filepath.IsAbs(dir) {
+			return fmt.Errorf("invalid sync directory: %s, must be absolute", dir)
+		}
+	}
+
+	if cfg.syncInterval == 0 {
+		return fmt.Errorf("invalid sync interval: must not be 0")
+	}
+
+	return nil
+}
+
+// syncCtl takes the control messages of the transfers of directory sync,
+// which no rtty -R/-S is there for
+type syncCtl struct{}
+
+func (syncCtl) Write(p []byte) (int, error) { return len(p), nil }
+func (syncCtl) Close() error                { return nil }
+
+// syncStamp tells whether a file changed since it was pushed
+type syncStamp struct {
+	size  int64
+	mtime time.Time
+}
+
+// syncTransfer is what a transfer of directory sync is about
+type syncTransfer struct {
+	path  string // The file pushed, or the directory pulled into
+	stamp syncStamp
+	pull  bool
+}
+
+type syncEnded struct {
+	ctx      *RttyFileContext
+	complete bool
+}
+
+// fileSync pushes the files of sync-push as they are written to the server,
+// and pulls those the server has for sync-pull, with transfers of a session
+// of its own. The server takes them as long as it echoed
+// MsgRegAttrFileSync.
+type fileSync struct {
+	cli   *RttyClient
+	ses   *TermSession
+	wake  chan struct{}
+	evMu  sync.Mutex // Guards what comes from the watches and transfers
+	paths []string
+	ended []syncEnded
+	scan  bool
+
+	// Only used by run
+	pushed    map[string]syncStamp
+	queue     []string
+	transfers map[*RttyFileContext]syncTransfer
+	pulling   map[string]bool
+	pullNow   map[string]bool
+}
+
+func newFileSync(cli *RttyClient) *fileSync {
+	fsync := &fileSync{
+		cli:       cli,
+		wake:      make(chan struct{}, 1),
+		scan:      true,
+		pushed:    make(map[string]syncStamp),
+		transfers: make(map[*RttyFileContext]syncTransfer),
+		pulling:   make(map[string]bool),
+		pullNow:   make(map[string]bool),
+	}
+
+	fsync.ses = &TermSession{cli: cli, sid: proto.FileSyncSid, cfg: &cli.cfg}
+	fsync.ses.files = &fileTransfers{ses: fsync.ses, ended: fsync.transferEnded}
+
+	for _, dir := range cli.cfg.syncPull {
+		fsync.pullNow[dir] = true
+	}
+
+	return fsync
+}
+
+// run starts directory sync, what can't be watched is found every
+// sync-interval
+func (fsync *fileSync) run() {
+	if err := watchSyncDirs(fsync.cli.cfg.syncPush, fsync.changed); err != nil {
+		log.Warn().Err(err).Msg("failed to watch sync directories, looking for changes periodically")
+	}
+
+	ticker := time.NewTicker(time.Duration(fsync.cli.cfg.syncInterval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-fsync.wake:
+		case <-ticker.C:
+			fsync.evMu.Lock()
+			fsync.scan = true
+			fsync.evMu.Unlock()
+
+			for _, dir := range fsync.cli.cfg.syncPull {
+				fsync.pullNow[dir] = true
+			}
+		}
+
+		fsync.step()
+	}
+}
+
+// online tells directory sync the device registered, what changed meanwhile
+// is pushed then
+func (fsync *fileSync) online() {
+	if !fsync.cli.fileSync.Load() {
+		log.Warn().Msg("the server doesn't support directory sync")
+		return
+	}
+
+	fsync.evMu.Lock()
+	fsync.scan = true
+	fsync.evMu.Unlock()
+
+	fsync.wakeUp()
+}
+
+func (fsync *fileSync) wakeUp() {
+	select {
+	case fsync.wake <- struct{}{}:
+	default:
+	}
+}
+
+// changed is told by the watches about the file at path written
+func (fsync *fileSync) changed(path string) {
+	fsync.evMu.Lock()
+	fsync.paths = append(fsync.paths, path)
+	fsync.evMu.Unlock()
+
+	fsync.wakeUp()
+}
+
+// transferEnded is told by the transfers of directory sync about their end,
+// with their context locked
+func (fsync *fileSync) transferEnded(ctx *RttyFileContext) {
+	fsync.evMu.Lock()
+	fsync.ended = append(fsync.ended, syncEnded{ctx, ctx.complete})
+	fsync.evMu.Unlock()
+
+	fsync.wakeUp()
+}
+
+func (fsync *fileSync) step() {
+	fsync.evMu.Lock()
+	paths, ended, scan := fsync.paths, fsync.ended, fsync.scan
+	fsync.paths, fsync.ended, fsync.scan = nil, nil, false
+	fsync.evMu.Unlock()
+
+	for _, e := range ended {
+		t, ok := fsync.transfers[e.ctx]
+		if !ok {
+			continue
+		}
+
+		delete(fsync.transfers, e.ctx)
+
+		if t.pull {
+			fsync.pulling[t.path] = false
+			// The server aborts the pull once there is nothing more
+			fsync.pullNow[t.path] = e.complete
+		} else if e.complete {
+			fsync.pushed[t.path] = t.stamp
+			// Unless it changed while pushed
+			paths = append(paths, t.path)
+		}
+	}
+
+	if !fsync.cli.fileSync.Load() {
+		return
+	}
+
+	if scan {
+		for _, dir := range fsync.cli.cfg.syncPush {
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				log.Warn().Err(err).Msgf("failed to read sync directory %s", dir)
+				continue
+			}
+
+			for _, entry := range entries {
+				paths = append(paths, filepath.Join(dir, entry.Name()))
+			}
+		}
+	}
+
+	fsync.enqueue(paths)
+	fsync.push()
+	fsync.pull()
+}
+
+// enqueue adds the files to push, but those hidden, which includes the
+// partial files of downloads
+func (fsync *fileSync) enqueue(paths []string) {
+	for _, p := range paths {
+		if strings.HasPrefix(filepath.Base(p), ".") || slices.Contains(fsync.queue, p) {
+			continue
+		}
+
+		fsync.queue = append(fsync.queue, p)
+	}
+}
+
+// push uploads the files queued, as many as there may be transfers, named
+// after the directory they are in
+func (fsync *fileSync) push() {
+	for len(fsync.queue) > 0 {
+		p := fsync.queue[0]
+
+		info, err := os.Lstat(p)
+		if err != nil || !info.Mode().IsRegular() {
+			fsync.queue = fsync.queue[1:]
+			continue
+		}
+
+		stamp := syncStamp{info.Size(), info.ModTime()}
+
+		if fsync.pushed[p] == stamp || fsync.busy(p) {
+			fsync.queue = fsync.queue[1:]
+			continue
+		}
+
+		ctx, err := fsync.ses.files.start()
+		if err != nil {
+			return
+		}
+
+		fsync.queue = fsync.queue[1:]
+		fsync.transfers[ctx] = syncTransfer{path: p, stamp: stamp}
+
+		name := path.Join(filepath.Base(filepath.Dir(p)), filepath.Base(p))
+
+		ctx.mu.Lock()
+
+		ctx.ctl = syncCtl{}
+
+		if err := ctx.startUploadAs(p, name); err != nil {
+			log.Error().Err(err).Msgf("failed to push file %s", p)
+
+			// Pushed as far as it ever will be
+			if !errors.Is(err, os.ErrNotExist) {
+				fsync.pushed[p] = stamp
+			}
+
+			ctx.reset()
+		} else {
+			log.Debug().Msgf("pushing file %s as %s", p, name)
+		}
+
+		ctx.mu.Unlock()
+	}
+}
+
+func (fsync *fileSync) busy(p string) bool {
+	for _, t := range fsync.transfers {
+		if !t.pull && t.path == p {
+			return true
+		}
+	}
+	return false
+}
+
+// pull asks the server for a file to save into each directory of sync-pull,
+// by its name. Files already there are overwritten.
+func (fsync *fileSync) pull() {
+	for _, dir := range fsync.cli.cfg.syncPull {
+		if !fsync.pullNow[dir] || fsync.pulling[dir] {
+			continue
+		}
+
+		ctx, err := fsync.ses.files.start()
+		if err != nil {
+			return
+		}
+
+		fsync.pullNow[dir] = false
+		fsync.pulling[dir] = true
+		fsync.transfers[ctx] = syncTransfer{path: dir, pull: true}
+
+		ctx.mu.Lock()
+
+		ctx.ctl = syncCtl{}
+		ctx.savepath = dir
+		ctx.exist = fileExistOverwrite
+		ctx.uid = uint32(os.Getuid())
+		ctx.gid = uint32(os.Getgid())
+
+		if err := ctx.send(proto.MsgTypeFileRecv, []byte(filepath.Base(dir))); err != nil {
+			ctx.reset()
+		}
+
+		ctx.mu.Unlock()
+	}
+}
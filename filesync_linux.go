@@ -0,0 +1,84 @@
+//go:build linux
+// +build linux
+
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"unsafe"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/sys/unix"
+)
+
+// watchSyncDirs tells changed about the files written into the directories,
+// once closed or moved there, so that none is pushed half written
+func watchSyncDirs(dirs []string, changed func(string)) error {
+	if len(dirs) == 0 {
+		return nil
+	}
+
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC)
+	if err != nil {
+		return fmt.Errorf("inotify: %w", err)
+	}
+
+	watches := make(map[int32]string)
+
+	for _, dir := range dirs {
+		wd, err := unix.InotifyAddWatch(fd, dir, unix.IN_CLOSE_WRITE|unix.IN_MOVED_TO)
+		if err != nil {
+			unix.Close(fd)
+			return fmt.Errorf("failed to watch %s: %w", dir, err)
+		}
+
+		watches[int32(wd)] = dir
+	}
+
+	go func() {
+		defer unix.Close(fd)
+
+		buf := make([]byte, 64*1024)
+
+		for {
+			n, err := unix.Read(fd, buf)
+			if err != nil {
+				if err == unix.EINTR {
+					continue
+				}
+				log.Error().Err(err).Msg("failed to read inotify events")
+				return
+			}
+
+			for off := 0; off+unix.SizeofInotifyEvent <= n; {
+				ev := (*unix.InotifyEvent)(unsafe.Pointer(&buf[off]))
+				name := buf[off+unix.SizeofInotifyEvent : off+unix.SizeofInotifyEvent+int(ev.Len)]
+
+				off += unix.SizeofInotifyEvent + int(ev.Len)
+
+				dir, ok := watches[ev.Wd]
+				if !ok || ev.Mask&unix.IN_ISDIR != 0 {
+					continue
+				}
+
+				// The name is padded with NULs
+				for i, c := range name {
+					if c == 0 {
+						name = name[:i]
+						break
+					}
+				}
+
+				changed(filepath.Join(dir, string(name)))
+			}
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package main
+
+// Changes are only found looking every sync-interval
+func watchSyncDirs(_ []string, _ func(string)) error {
+	return nil
+}
@@ -0,0 +1,143 @@
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"unicode/utf8"
+)
+
+// commandFilter decides which command lines may be run in a terminal. Deny
+// rules win, and when there are allow rules a line must match one of them.
+type commandFilter struct {
+	allow []*regexp.Regexp
+	deny  []*regexp.Regexp
+}
+
+func newCommandFilter(allow, deny []string) (*commandFilter, error) {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+
+	f := &commandFilter{}
+
+	for _, expr := range allow {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid command-allow '%s': %w", expr, err)
+		}
+		f.allow = append(f.allow, re)
+	}
+
+	for _, expr := range deny {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid command-deny '%s': %w", expr, err)
+		}
+		f.deny = append(f.deny, re)
+	}
+
+	return f, nil
+}
+
+func (f *commandFilter) allowed(line string) bool {
+	for _, re := range f.deny {
+		if re.MatchString(line) {
+			return false
+		}
+	}
+
+	if len(f.allow) == 0 {
+		return true
+	}
+
+	for _, re := range f.allow {
+		if re.MatchString(line) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// inputFilter follows what is typed into a terminal to check each line when
+// Enter is pressed. Only plain typing, backspace, Ctrl-C, Ctrl-D and Ctrl-U
+// get through, anything that would let the shell change the line behind its
+// back, like Tab completion, history or cursor keys, is dropped.
+type inputFilter struct {
+	*commandFilter
+	line []byte
+	esc  int
+}
+
+const (
+	keyCtrlC     = 0x03
+	keyCtrlD     = 0x04
+	keyBackspace = 0x08
+	keyEnter     = '\r'
+	keyCtrlU     = 0x15
+	keyEscape    = 0x1b
+	keyDelete    = 0x7f
+)
+
+// filter returns what may be passed to the shell, a denied line is cancelled
+// with Ctrl-C instead of being run, denied gets each of them.
+func (f *inputFilter) filter(data []byte, denied func(line string)) []byte {
+	out := make([]byte, 0, len(data))
+
+	for _, c := range data {
+		// Escape sequences: ESC, then [ or O, then up to a final byte
+		if f.esc > 0 {
+			if f.esc == 1 && (c == '[' || c == 'O') {
+				f.esc = 2
+			} else if f.esc == 1 || (c >= 0x40 && c <= 0x7e) {
+				f.esc = 0
+			}
+			continue
+		}
+
+		switch {
+		case c == keyEscape:
+			f.esc = 1
+
+		case c == keyEnter:
+			line := string(f.line)
+			f.line = f.line[:0]
+
+			if line != "" && !f.allowed(line) {
+				denied(line)
+				out = append(out, keyCtrlC)
+				continue
+			}
+
+			out = append(out, c)
+
+		case c == keyCtrlC || c == keyCtrlU:
+			f.line = f.line[:0]
+			out = append(out, c)
+
+		case c == keyCtrlD:
+			out = append(out, c)
+
+		case c == keyBackspace || c == keyDelete:
+			if len(f.line) > 0 {
+				_, size := utf8.DecodeLastRune(f.line)
+				f.line = f.line[:len(f.line)-size]
+			}
+			out = append(out, c)
+
+		case c < 0x20:
+			// Other control keys edit the line in ways not followed here
+
+		default:
+			f.line = append(f.line, c)
+			out = append(out, c)
+		}
+	}
+
+	return out
+}
@@ -3,21 +3,30 @@ module github.com/zhaojh329/rtty-go
 go 1.24.4
 
 require (
+	github.com/coder/websocket v1.8.14
 	github.com/creack/pty v1.1.24
 	github.com/dwdcth/consoleEx v0.0.0-20180521133551-f56f6eb78b76
+	github.com/eclipse/paho.mqtt.golang v1.5.0
+	github.com/google/go-tpm v0.9.5
+	github.com/klauspost/compress v1.18.0
 	github.com/kylelemons/go-gypsy v1.0.0
 	github.com/mattn/go-colorable v0.1.14
-	github.com/qsocket/conpty-go v0.0.0-20230315180542-d8f8596877dc
 	github.com/rs/zerolog v1.34.0
 	github.com/sevlyar/go-daemon v0.1.6
 	github.com/shirou/gopsutil/v3 v3.24.5
 	github.com/urfave/cli/v3 v3.3.8
 	github.com/valyala/bytebufferpool v1.0.0
+	golang.org/x/crypto v0.40.0
+	golang.org/x/net v0.42.0
+	golang.org/x/sys v0.34.0
 	golang.org/x/term v0.33.0
+	golang.org/x/text v0.27.0
+	golang.org/x/time v0.12.0
 )
 
 require (
 	github.com/go-ole/go-ole v1.2.6 // indirect
+	github.com/gorilla/websocket v1.5.3 // indirect
 	github.com/kardianos/osext v0.0.0-20190222173326-2bc1f35cddc0 // indirect
 	github.com/lufia/plan9stats v0.0.0-20211012122336-39d0f177ccd0 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
@@ -26,5 +35,5 @@ require (
 	github.com/tklauser/go-sysconf v0.3.12 // indirect
 	github.com/tklauser/numcpus v0.6.1 // indirect
 	github.com/yusufpapurcu/wmi v1.2.4 // indirect
-	golang.org/x/sys v0.34.0 // indirect
+	golang.org/x/sync v0.16.0 // indirect
 )
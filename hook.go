@@ -0,0 +1,104 @@
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// A hook running longer than this is killed
+const rttyHookTimeout = 30 * time.Second
+
+// runHook runs the session hook script in the background with the details of
+// the session in its environment
+func (s *TermSession) runHook(script, event string) {
+	if script == "" {
+		return
+	}
+
+	cfg := s.cfg
+
+	env := append(os.Environ(),
+		"RTTY_EVENT="+event,
+		"RTTY_ID="+cfg.id,
+		"RTTY_SID="+s.sid,
+		"RTTY_USER="+terminalUser(cfg),
+		"RTTY_PID="+strconv.Itoa(s.term.Pid()),
+		"RTTY_TIME="+time.Now().Format(time.RFC3339),
+	)
+
+	go runHookScript(script, "session "+event, env)
+}
+
+// runFileHook runs on-file-received or on-file-sent in the background once
+// a transfer is complete, with the file in its environment
+func (ctx *RttyFileContext) runFileHook() {
+	cfg := &ctx.ses.cli.cfg
+
+	script, event, path := cfg.onFileReceived, "file-received", ctx.savepath
+	if ctx.source != "" {
+		script, event, path = cfg.onFileSent, "file-sent", ctx.source
+	}
+
+	if script == "" {
+		return
+	}
+
+	size := ctx.totalSize
+	if ctx.output != "" {
+		path = "-"
+	}
+
+	env := append(os.Environ(),
+		"RTTY_EVENT="+event,
+		"RTTY_ID="+cfg.id,
+		"RTTY_SID="+ctx.ses.sid,
+		"RTTY_FILE="+path,
+		"RTTY_FILE_NAME="+ctx.name,
+		"RTTY_FILE_SIZE="+strconv.FormatUint(size, 10),
+		"RTTY_FILE_SHA256="+hex.EncodeToString(ctx.sum.Sum(nil)),
+		"RTTY_TIME="+time.Now().Format(time.RFC3339),
+	)
+
+	go runHookScript(script, event, env)
+}
+
+func runHookScript(script, event string, env []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), rttyHookTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, script)
+	cmd.Env = env
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		log.Error().Err(err).Msgf("%s hook %s failed: %s", event, script, out)
+	}
+}
+
+// terminalUser returns who terminals are run as, as far as rtty knows
+func terminalUser(cfg *Config) string {
+	if cfg.runAs != "" {
+		return cfg.runAs
+	}
+
+	if cfg.username != "" {
+		return cfg.username
+	}
+
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+
+	return ""
+}
@@ -7,6 +7,7 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"os"
 	"runtime"
 	"runtime/debug"
@@ -61,10 +62,10 @@ func main() {
 				Aliases: []string{"I"},
 				Usage:   "Set an ID for the device(max 32 chars, no spaces allowed)",
 			},
-			&cli.StringFlag{
+			&cli.StringSliceFlag{
 				Name:    "host",
 				Aliases: []string{"h"},
-				Usage:   "Server's host or ipaddr(Default is localhost)",
+				Usage:   "Server's host or ipaddr, optionally with a port, a DNS SRV name like _rtty._tcp.example.com or a unix socket like unix:///var/run/rttys.sock. Repeat to add fallback servers(Default is localhost)",
 			},
 			&cli.Uint16Flag{
 				Name:    "port",
@@ -76,11 +77,179 @@ func main() {
 				Aliases: []string{"d"},
 				Usage:   "Add a description to the device(Maximum 126 bytes)",
 			},
+			&cli.StringFlag{
+				Name:  "shell",
+				Usage: "Shell to run for terminals instead of login. On Windows also cmd, powershell, pwsh or a command line(Default is cmd.exe on Windows)",
+			},
+			&cli.StringSliceFlag{
+				Name:  "shell-args",
+				Usage: "Argument passed to the shell, repeat for more",
+			},
+			&cli.StringFlag{
+				Name:  "shell-wrapper",
+				Usage: "Command the shell is run through, e.g. 'tmux new -A -s rtty'",
+			},
+			&cli.StringSliceFlag{
+				Name:  "env",
+				Usage: "Environment variable(KEY=VALUE) set for terminals, repeat for more",
+			},
+			&cli.StringSliceFlag{
+				Name:  "session-label",
+				Usage: "Label(KEY=VALUE) sent to the server with each terminal, repeat for more",
+			},
+			&cli.StringFlag{
+				Name:  "run-as",
+				Usage: "Start terminals as this user, switching to it directly instead of through login",
+			},
+			&cli.BoolFlag{
+				Name:  "no-root",
+				Usage: "Refuse to start root terminals and log privilege elevation in them",
+			},
+			&cli.StringFlag{
+				Name:  "chroot",
+				Usage: "Confine terminals to this directory",
+			},
+			&cli.StringSliceFlag{
+				Name:  "command-allow",
+				Usage: "Regular expression of the command lines allowed in terminals, repeat for more",
+			},
+			&cli.StringSliceFlag{
+				Name:  "command-deny",
+				Usage: "Regular expression of the command lines denied in terminals, repeat for more",
+			},
+			&cli.StringFlag{
+				Name:  "term",
+				Usage: "TERM set for terminals(Default is xterm-256color)",
+			},
+			&cli.StringFlag{
+				Name:  "charset",
+				Usage: "Charset terminals use if not UTF-8: gbk, gb18030, big5, latin1, windows-1252",
+			},
+			&cli.StringFlag{
+				Name:  "clipboard",
+				Usage: "Clipboard sequences(OSC 52) in terminal output: allow, strip(Default is allow)",
+			},
+			&cli.Uint16Flag{
+				Name:  "clipboard-max-size",
+				Usage: "KB of the largest clipboard sequence let through, 0 is unlimited(Default is 0)",
+			},
+			&cli.StringFlag{
+				Name:  "serial",
+				Usage: "Connect terminals to this serial port instead of a shell(Linux only)",
+			},
+			&cli.UintFlag{
+				Name:  "serial-baud",
+				Usage: "Baud rate of the serial port(Default is 115200)",
+			},
+			&cli.StringFlag{
+				Name:  "serial-parity",
+				Usage: "Parity of the serial port: none, odd, even(Default is none)",
+			},
+			&cli.Uint8Flag{
+				Name:  "max-ttys",
+				Usage: "Maximum number of terminals open at the same time(Default is 10)",
+			},
+			&cli.UintFlag{
+				Name:  "term-timeout",
+				Usage: "Seconds of inactivity after which a terminal is closed, 0 for never(Default is 600s)",
+			},
+			&cli.Uint16Flag{
+				Name:  "term-timeout-warning",
+				Usage: "Warn this many seconds before closing an inactive terminal, 0 for no warning(Default is 60s)",
+			},
+			&cli.Uint16Flag{
+				Name:  "term-cols",
+				Usage: "Columns of a terminal until the server sends its size(Default is 80)",
+			},
+			&cli.Uint16Flag{
+				Name:  "term-rows",
+				Usage: "Rows of a terminal until the server sends its size(Default is 24)",
+			},
+			&cli.Uint16Flag{
+				Name:  "term-kill-delay",
+				Usage: "Seconds a closed terminal's shell gets to exit after SIGHUP before it's killed(Default is 3s)",
+			},
+			&cli.Uint16Flag{
+				Name:  "session-grace",
+				Usage: "Seconds to keep terminals running after losing the server, resumed when their session logs in again(Default is 0, kill them at once)",
+			},
+			&cli.Uint16Flag{
+				Name:  "scrollback",
+				Usage: "KB of recent output kept per terminal, replayed when it is resumed or observed(Default is 0)",
+			},
+			&cli.StringFlag{
+				Name:  "record-dir",
+				Usage: "Record each terminal session to an asciinema cast file in this directory",
+			},
+			&cli.BoolFlag{
+				Name:  "record-input",
+				Usage: "Record what is typed as well, passwords included",
+			},
+			&cli.StringFlag{
+				Name:  "audit-dir",
+				Usage: "Log what is typed in each terminal, and the commands run, to files in this directory",
+			},
+			&cli.BoolFlag{
+				Name:  "audit-output",
+				Usage: "Log what terminals print to the audit log as well",
+			},
+			&cli.BoolFlag{
+				Name:  "utmp",
+				Usage: "Register terminals in utmp, wtmp and lastlog, so that who and last show them(Linux only)",
+			},
+			&cli.StringFlag{
+				Name:  "on-session-start",
+				Usage: "Script run when a terminal is opened",
+			},
+			&cli.StringFlag{
+				Name:  "on-session-end",
+				Usage: "Script run when a terminal is closed",
+			},
+			&cli.StringFlag{
+				Name:  "on-file-received",
+				Usage: "Script run when a file was received",
+			},
+			&cli.StringFlag{
+				Name:  "on-file-sent",
+				Usage: "Script run when a file was sent",
+			},
+			&cli.StringFlag{
+				Name:  "banner",
+				Usage: "Text shown at the top of every new terminal, \\n starts a new line",
+			},
+			&cli.StringFlag{
+				Name:  "banner-file",
+				Usage: "File whose content is shown at the top of every new terminal, after banner",
+			},
 			&cli.BoolFlag{
 				Name:    "reconnect",
 				Aliases: []string{"a"},
 				Usage:   "Auto reconnect to the server",
 			},
+			&cli.Uint16Flag{
+				Name:  "reconnect-delay",
+				Usage: "Initial delay in seconds before reconnecting, doubled on each failure(Default is 10s)",
+			},
+			&cli.Uint16Flag{
+				Name:  "reconnect-max-delay",
+				Usage: "Upper bound in seconds of the reconnect delay(Default is 120s)",
+			},
+			&cli.Uint8Flag{
+				Name:  "reconnect-jitter",
+				Usage: "Randomize the reconnect delay by up to this percent(Default is 50)",
+			},
+			&cli.Uint16Flag{
+				Name:  "dial-timeout",
+				Usage: "Timeout in seconds for connecting to the server, including the TLS handshake(Default is 5s)",
+			},
+			&cli.Uint16Flag{
+				Name:  "read-timeout",
+				Usage: "Timeout in seconds for the server to answer the registration(Default is 5s)",
+			},
+			&cli.Uint16Flag{
+				Name:  "write-timeout",
+				Usage: "Disconnect when a message can't be sent to the server within this many seconds, 0 to wait forever(Default is 30s)",
+			},
 			&cli.Uint8Flag{
 				Name:        "heartbeat",
 				Aliases:     []string{"i"},
@@ -97,6 +266,10 @@ func main() {
 				Aliases: []string{"C"},
 				Usage:   "CA certificate to verify peer against",
 			},
+			&cli.BoolFlag{
+				Name:  "system-ca",
+				Usage: "Trust the system certificate store in addition to cacert, which it requires",
+			},
 			&cli.BoolFlag{
 				Name:    "insecure",
 				Aliases: []string{"x"},
@@ -110,7 +283,235 @@ func main() {
 			&cli.StringFlag{
 				Name:    "key",
 				Aliases: []string{"k"},
-				Usage:   "Private key file to use",
+				Usage:   "Private key file to use, or tpm:<handle> for a key stored in the TPM",
+			},
+			&cli.StringFlag{
+				Name:  "tpm-device",
+				Usage: "TPM device used by a tpm:<handle> key(Default is /dev/tpmrm0)",
+			},
+			&cli.StringFlag{
+				Name:  "transport",
+				Usage: "Transport used to connect to the server: tcp, ws, wss or mqtt(Default is tcp)",
+			},
+			&cli.StringFlag{
+				Name:  "ws-path",
+				Usage: "Request path used by the ws and wss transport(Default is /)",
+			},
+			&cli.StringFlag{
+				Name:  "mqtt-topic",
+				Usage: "Topic prefix used by the mqtt transport(Default is rtty)",
+			},
+			&cli.StringFlag{
+				Name:  "mqtt-username",
+				Usage: "Username to log in to the MQTT broker",
+			},
+			&cli.StringFlag{
+				Name:  "mqtt-password",
+				Usage: "Password to log in to the MQTT broker",
+			},
+			&cli.StringFlag{
+				Name:  "ssh-jump",
+				Usage: "Reach the server through an SSH jump host([user@]host[:port])",
+			},
+			&cli.StringFlag{
+				Name:  "ssh-key",
+				Usage: "Private key file to log in to the SSH jump host",
+			},
+			&cli.StringFlag{
+				Name:  "ssh-known-hosts",
+				Usage: "known_hosts file to verify the SSH jump host against, required with ssh-jump",
+			},
+			&cli.StringFlag{
+				Name:  "proxy",
+				Usage: "Connect to the server through a proxy(http|socks5://[user:password@]host:port)",
+			},
+			&cli.BoolFlag{
+				Name:  "auto-proxy",
+				Usage: "Pick the proxy from the HTTP_PROXY, HTTPS_PROXY, ALL_PROXY and NO_PROXY environment variables",
+			},
+			&cli.StringFlag{
+				Name:  "bind-interface",
+				Usage: "Connect to the server through this network interface",
+			},
+			&cli.StringFlag{
+				Name:  "bind-address",
+				Usage: "Connect to the server from this local ip address",
+			},
+			&cli.StringFlag{
+				Name:  "backup-interface",
+				Usage: "Backup uplink interface, the connection is moved to it right away once lost over the other one, sessions end",
+			},
+			&cli.StringFlag{
+				Name:  "dns-server",
+				Usage: "Resolve the server with this DNS server on every reconnect(ip[:port], tcp://ip[:port], tls://host[:port] or https://host/dns-query)",
+			},
+			&cli.Uint16Flag{
+				Name:  "tcp-keepalive-idle",
+				Usage: "Seconds the connection stays idle before TCP keepalive probes are sent(Default is 15s)",
+			},
+			&cli.Uint16Flag{
+				Name:  "tcp-keepalive-interval",
+				Usage: "Seconds between TCP keepalive probes(Default is 15s)",
+			},
+			&cli.Uint8Flag{
+				Name:  "tcp-keepalive-count",
+				Usage: "Unanswered TCP keepalive probes before the connection is dropped(Default is 9)",
+			},
+			&cli.Uint16Flag{
+				Name:  "happy-eyeballs-delay",
+				Usage: "Milliseconds before the other address family of dual-stack servers is raced, 0 to try addresses one by one(Default is 250ms)",
+			},
+			&cli.UintFlag{
+				Name:  "max-upload-rate",
+				Usage: "Limit the traffic sent to the server in KB/s(Default is unlimited)",
+			},
+			&cli.UintFlag{
+				Name:  "max-download-rate",
+				Usage: "Limit the traffic received from the server in KB/s(Default is unlimited)",
+			},
+			&cli.UintFlag{
+				Name:  "max-term-rate",
+				Usage: "Limit the output of each terminal in KB/s(Default is unlimited)",
+			},
+			&cli.UintFlag{
+				Name:  "file-max-rate",
+				Usage: "Limit the data of all file transfers together in KB/s(Default is unlimited)",
+			},
+			&cli.Uint8Flag{
+				Name:  "file-max-transfers",
+				Usage: "File transfers going on at once in all terminals, 0 is unlimited(Default is 0)",
+			},
+			&cli.Uint8Flag{
+				Name:  "file-window",
+				Usage: "Data frames of a file sent ahead of the acknowledgements, 1 waits for each(Default is 8)",
+			},
+			&cli.Uint16Flag{
+				Name:  "file-stall-timeout",
+				Usage: "Seconds without file data from the server before a transfer is aborted, 0 never(Default is 60)",
+			},
+			&cli.BoolFlag{
+				Name:  "file-preserve-owner",
+				Usage: "Send the owner of files, and give received files theirs when rtty -R runs as root",
+			},
+			&cli.StringFlag{
+				Name:  "file-fifo-dir",
+				Usage: "Directory rtty -R/-S in terminals create their fifo in(Default is XDG_RUNTIME_DIR, else TMPDIR or /tmp)",
+			},
+			&cli.StringFlag{
+				Name:  "download-dir",
+				Usage: "Directory rtty -R saves files into(Default is the directory it runs in)",
+			},
+			&cli.BoolFlag{
+				Name:  "file-confirm",
+				Usage: "rtty -R shows the name and size of each file and asks before receiving it",
+			},
+			&cli.StringSliceFlag{
+				Name:  "file-allow",
+				Usage: "Pattern(e.g. *.ipk) of the names of files rtty -R may receive, repeat for more(Default is any)",
+			},
+			&cli.StringFlag{
+				Name:  "file-symlink",
+				Usage: "What to do with symbolic links rtty -R saves to or rtty -S sends: replace, follow, reject(Default is replace)",
+			},
+			&cli.BoolFlag{
+				Name:  "file-channel",
+				Usage: "Transfer files over a connection of their own, when the server offers one",
+			},
+			&cli.BoolFlag{
+				Name:  "file-delta",
+				Usage: "Download only the changes to files overwritten, when the server supports it",
+			},
+			&cli.StringFlag{
+				Name:  "file-key",
+				Usage: "Key in hex encrypting the contents of files end to end, which the server must relay encrypted",
+			},
+			&cli.StringFlag{
+				Name:  "file-storage",
+				Usage: "Where rtty -R saves files: file, pipe:COMMAND, device:PATH, s3:URL(Default is file)",
+			},
+			&cli.StringFlag{
+				Name:  "file-s3-access-key",
+				Usage: "Access key signing the uploads of file-storage s3",
+			},
+			&cli.StringFlag{
+				Name:  "file-s3-secret-key",
+				Usage: "Secret key signing the uploads of file-storage s3",
+			},
+			&cli.StringFlag{
+				Name:  "file-s3-region",
+				Usage: "Region of the bucket of file-storage s3(Default is us-east-1)",
+			},
+			&cli.StringSliceFlag{
+				Name:  "sync-push",
+				Usage: "Directory whose files are uploaded to the server as they are written, repeat for more",
+			},
+			&cli.StringSliceFlag{
+				Name:  "sync-pull",
+				Usage: "Directory the files the server has for it are downloaded into, repeat for more",
+			},
+			&cli.Uint16Flag{
+				Name:  "sync-interval",
+				Usage: "Seconds between looking for files to sync that weren't noticed(Default is 60)",
+			},
+			&cli.BoolFlag{
+				Name:  "sftp",
+				Usage: "Let the server browse, download, upload and delete files over SFTP, as the user rtty runs as",
+			},
+			&cli.StringFlag{
+				Name:  "sftp-root",
+				Usage: "Directory SFTP is confined to(Default is /)",
+			},
+			&cli.StringSliceFlag{
+				Name:  "cmd-allow",
+				Usage: "Command the server may run: name, absolute path, directory ending with / or re:regexp, repeat for more(Default is any)",
+			},
+			&cli.StringSliceFlag{
+				Name:  "cmd-deny",
+				Usage: "Command the server may not run, as cmd-allow, repeat for more",
+			},
+			&cli.StringSliceFlag{
+				Name:  "cmd-users",
+				Usage: "User the server may run commands as, repeat for more(Default is any)",
+			},
+			&cli.StringFlag{
+				Name:  "cmd-user",
+				Usage: "User commands run as, unless the server asks for one in cmd-users",
+			},
+			&cli.StringSliceFlag{
+				Name:  "cmd-env",
+				Usage: "Environment variable(KEY=VALUE) set for the commands the server runs, repeat for more",
+			},
+			&cli.StringFlag{
+				Name:  "cmd-schedule",
+				Usage: "File keeping the commands the server schedules, which it may not unless set",
+			},
+			&cli.Uint16Flag{
+				Name:  "term-coalesce",
+				Usage: "Milliseconds to gather terminal output into one message, 0 sends each read at once(Default is 5ms)",
+			},
+			&cli.Uint16Flag{
+				Name:  "term-read-buffer",
+				Usage: "KB read from a terminal at once, 1 to 63(Default is 32)",
+			},
+			&cli.Uint16Flag{
+				Name:  "term-ack-window",
+				Usage: "KB of terminal output the server may leave unacknowledged before reading stops(Default is 4)",
+			},
+			&cli.BoolFlag{
+				Name:  "compress",
+				Usage: "Compress terminal, file and http data if the server supports it",
+			},
+			&cli.BoolFlag{
+				Name:  "file-compress",
+				Usage: "Compress the data of file transfers with zstd or gzip if the server supports it",
+			},
+			&cli.StringFlag{
+				Name:  "file-exist",
+				Usage: "Received file already there: error, overwrite, rename, skip, ask(Default is error)",
+			},
+			&cli.Uint16Flag{
+				Name:  "stats-interval",
+				Usage: "Interval in seconds to log traffic and command statistics at debug level, 0 to disable(Default is 60s)",
 			},
 			&cli.BoolFlag{
 				Name:  "D",
@@ -126,8 +527,20 @@ func main() {
 				Usage: "Receive file",
 			},
 			&cli.StringFlag{
+				Name:  "exist",
+				Usage: "With -R, the file already there: error, overwrite, rename, skip, ask(Default is file-exist of rtty)",
+			},
+			&cli.StringFlag{
+				Name:  "O",
+				Usage: "With -R, - writes the file to stdout, to pipe it into tar, gunzip or dd",
+			},
+			&cli.StringSliceFlag{
 				Name:  "S",
-				Usage: "Send file",
+				Usage: "Send file, may be repeated or a pattern like '*.log', files following it are sent too. - sends stdin, named by RTTY_FILE_NAME(Default is stdin)",
+			},
+			&cli.BoolFlag{
+				Name:  "json",
+				Usage: "With -R/-S, write how the transfer goes as a JSON object per line rather than show it, to stderr with -O -",
 			},
 			&cli.BoolFlag{
 				Name:    "verbose",
@@ -155,20 +568,87 @@ func main() {
 func cmdAction(c context.Context, cmd *cli.Command) error {
 	defer logPanic()
 
+	if cmd.Bool("json") {
+		fileJSON = os.Stdout
+
+		// stdout takes the file
+		if cmd.IsSet("O") {
+			fileJSON = os.Stderr
+		}
+	}
+
 	if cmd.Bool("R") {
-		requestTransferFile('R', "")
+		exist := fileExistDefault
+
+		if cmd.IsSet("exist") {
+			var err error
+
+			exist, err = parseFileExist(cmd.String("exist"))
+			if err != nil {
+				return err
+			}
+		}
+
+		if cmd.IsSet("O") {
+			if cmd.String("O") != "-" {
+				return fmt.Errorf("only - for stdout may be given to -O")
+			}
+			requestTransferFile('O', "", exist)
+			return nil
+		}
+
+		requestTransferFile('R', "", exist)
 		return nil
 	}
 
 	if cmd.IsSet("S") {
-		requestTransferFile('S', cmd.String("S"))
+		sendFiles(append(cmd.StringSlice("S"), cmd.Args().Slice()...))
 		return nil
 	}
 
 	cfg := Config{
-		host:      "localhost",
+		hosts:     []string{"localhost"},
 		heartbeat: 30,
 		port:      5912,
+
+		reconnectDelay:    10,
+		reconnectMaxDelay: 120,
+		reconnectJitter:   50,
+
+		dialTimeout:  5,
+		readTimeout:  5,
+		writeTimeout: 30,
+
+		tpmDevice: "/dev/tpmrm0",
+		transport: "tcp",
+		wsPath:    "/",
+		mqttTopic: "rtty",
+
+		happyEyeballsDelay: 250,
+
+		term:               "xterm-256color",
+		serialBaud:         115200,
+		serialParity:       "none",
+		clipboard:          "allow",
+		fileExist:          "error",
+		fileSymlink:        "replace",
+		fileWindow:         8,
+		fileStallTimeout:   60,
+		fileStorage:        "file",
+		fileS3Region:       "us-east-1",
+		syncInterval:       60,
+		maxTtys:            10,
+		termTimeout:        600,
+		termTimeoutWarning: 60,
+		termCols:           80,
+		termRows:           24,
+		termKillDelay:      3,
+
+		termCoalesce:   5,
+		termReadBuffer: 32,
+		termAckWindow:  4,
+
+		statsInterval: 60,
 	}
 
 	err := cfg.Parse(cmd)
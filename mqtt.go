@@ -0,0 +1,192 @@
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// mqttConn carries the rtty protocol over a pair of MQTT topics, each
+// message written to the connection becomes one publish on <topic>/<id>/up
+// and the server replies on <topic>/<id>/down.
+type mqttConn struct {
+	client  mqtt.Client
+	upTopic string
+	data    chan []byte
+	pending []byte
+	closed  chan struct{}
+	once    sync.Once
+
+	mu            sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+type mqttAddr string
+
+func (a mqttAddr) Network() string { return "mqtt" }
+func (a mqttAddr) String() string  { return string(a) }
+
+func dialMQTT(ctx context.Context, dialer contextDialer, addr string, tlsConfig *tls.Config, cfg *Config) (net.Conn, error) {
+	host, _, _ := net.SplitHostPort(addr)
+
+	c := &mqttConn{
+		upTopic: fmt.Sprintf("%s/%s/up", cfg.mqttTopic, cfg.id),
+		data:    make(chan []byte, 1024),
+		closed:  make(chan struct{}),
+	}
+
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker("tcp://" + addr)
+	opts.SetClientID("rtty-" + cfg.id)
+	opts.SetUsername(cfg.mqttUsername)
+	opts.SetPassword(cfg.mqttPassword)
+	opts.SetCleanSession(true)
+	opts.SetAutoReconnect(false)
+	opts.SetConnectTimeout(time.Duration(cfg.dialTimeout) * time.Second)
+	opts.SetCustomOpenConnectionFn(func(_ *url.URL, _ mqtt.ClientOptions) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		if err == nil && tlsConfig != nil {
+			conn, err = tlsHandshake(ctx, conn, host, tlsConfig)
+		}
+		return conn, err
+	})
+	opts.SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+		c.Close()
+	})
+
+	c.client = mqtt.NewClient(opts)
+
+	if token := c.client.Connect(); token.Wait() && token.Error() != nil {
+		return nil, fmt.Errorf("mqtt connect: %w", token.Error())
+	}
+
+	downTopic := fmt.Sprintf("%s/%s/down", cfg.mqttTopic, cfg.id)
+
+	token := c.client.Subscribe(downTopic, 1, func(_ mqtt.Client, m mqtt.Message) {
+		select {
+		case c.data <- m.Payload():
+		case <-c.closed:
+		}
+	})
+	if token.Wait() && token.Error() != nil {
+		c.client.Disconnect(0)
+		return nil, fmt.Errorf("mqtt subscribe %s: %w", downTopic, token.Error())
+	}
+
+	return c, nil
+}
+
+func (c *mqttConn) Read(b []byte) (int, error) {
+	if len(c.pending) == 0 {
+		var timeout <-chan time.Time
+
+		c.mu.Lock()
+		deadline := c.readDeadline
+		c.mu.Unlock()
+
+		if !deadline.IsZero() {
+			timer := time.NewTimer(time.Until(deadline))
+			defer timer.Stop()
+			timeout = timer.C
+		}
+
+		select {
+		case c.pending = <-c.data:
+		case <-c.closed:
+			return 0, io.EOF
+		case <-timeout:
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+
+	return n, nil
+}
+
+func (c *mqttConn) Write(b []byte) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	c.mu.Lock()
+	deadline := c.writeDeadline
+	c.mu.Unlock()
+
+	// The client keeps the payload until acknowledged, which may be after
+	// the deadline
+	payload := b
+	if !deadline.IsZero() {
+		payload = slices.Clone(b)
+	}
+
+	token := c.client.Publish(c.upTopic, 1, false, payload)
+
+	if deadline.IsZero() {
+		token.Wait()
+	} else if !token.WaitTimeout(time.Until(deadline)) {
+		return 0, os.ErrDeadlineExceeded
+	}
+
+	if token.Error() != nil {
+		return 0, token.Error()
+	}
+
+	return len(b), nil
+}
+
+func (c *mqttConn) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+		go c.client.Disconnect(250)
+	})
+	return nil
+}
+
+func (c *mqttConn) LocalAddr() net.Addr {
+	return mqttAddr(c.upTopic)
+}
+
+func (c *mqttConn) RemoteAddr() net.Addr {
+	return mqttAddr(c.upTopic)
+}
+
+func (c *mqttConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.writeDeadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *mqttConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *mqttConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+	return nil
+}
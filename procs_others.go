@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package main
+
+// sessionProcs needs /proc, the processes of a session aren't known elsewhere
+func sessionProcs(sid int) map[int]string {
+	return nil
+}
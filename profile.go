@@ -0,0 +1,151 @@
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+
+	"github.com/kylelemons/go-gypsy/yaml"
+)
+
+// termProfile overrides how terminals are started, for the devices of its
+// groups or the logins asking for it by name
+type termProfile struct {
+	name   string
+	groups []string
+	cfg    Config
+}
+
+// The options a profile may override
+func profileFields(cfg *Config) map[string]any {
+	return map[string]any{
+		"shell":        &cfg.shell,
+		"shell-args":   &cfg.shellArgs,
+		"run-as":       &cfg.runAs,
+		"env":          &cfg.env,
+		"term-timeout": &cfg.termTimeout,
+	}
+}
+
+// parseProfiles reads the profiles of the config file, each one starting
+// from the global options
+func (cfg *Config) parseProfiles(yamlCfg *yaml.File) error {
+	node, err := yaml.Child(yamlCfg.Root, "profiles")
+	if err != nil || node == nil {
+		return nil
+	}
+
+	profiles, ok := node.(yaml.Map)
+	if !ok {
+		return fmt.Errorf(`invalid "profiles": expected a map`)
+	}
+
+	cfg.profiles = make(map[string]*termProfile)
+
+	for name, node := range profiles {
+		p := &termProfile{name: name, cfg: *cfg}
+
+		p.cfg.profiles = nil
+		p.cfg.env = nil
+
+		f := &yaml.File{Root: node}
+
+		for field, opt := range profileFields(&p.cfg) {
+			if err := getConfigOpt(f, field, opt); err != nil {
+				return fmt.Errorf("profile %s: %w", name, err)
+			}
+		}
+
+		if err := getConfigOpt(f, "groups", &p.groups); err != nil {
+			return fmt.Errorf("profile %s: %w", name, err)
+		}
+
+		if err := p.check(cfg); err != nil {
+			return fmt.Errorf("profile %s: %w", name, err)
+		}
+
+		cfg.profiles[name] = p
+	}
+
+	var matched []string
+
+	for name, p := range cfg.profiles {
+		if slices.Contains(p.groups, cfg.group) {
+			matched = append(matched, name)
+		}
+	}
+
+	if len(matched) > 1 {
+		slices.Sort(matched)
+		return fmt.Errorf("group %s is in more than one profile: %s", cfg.group, strings.Join(matched, ", "))
+	}
+
+	return nil
+}
+
+func (p *termProfile) check(global *Config) error {
+	cfg := &p.cfg
+
+	if cfg.env == nil {
+		cfg.env = global.env
+	} else if err := checkEnv(cfg.env); err != nil {
+		return err
+	}
+
+	if cfg.runAs != "" && runtime.GOOS == "windows" {
+		return fmt.Errorf("run-as is not supported on Windows")
+	}
+
+	if cfg.chroot != "" && cfg.shell != "" && !filepath.IsAbs(cfg.shell) {
+		return fmt.Errorf("invalid shell: %s, must be an absolute path with chroot", cfg.shell)
+	}
+
+	if err := checkNoRoot(cfg); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// checkEnv checks env is made of KEY=VALUE, and expands the variables of
+// rtty's own environment in it
+func checkEnv(env []string) error {
+	for i, kv := range env {
+		if name, _, ok := strings.Cut(kv, "="); !ok || name == "" {
+			return fmt.Errorf("invalid env '%s', expected KEY=VALUE", kv)
+		}
+
+		// Allows extending variables, e.g. PATH=$PATH:/opt/bin
+		env[i] = os.ExpandEnv(kv)
+	}
+
+	return nil
+}
+
+// termConfig returns the options to start a terminal with, those of the named
+// profile, else of the profile of the device's group, else the global ones.
+func (cfg *Config) termConfig(profile string) (*Config, string, error) {
+	if profile != "" {
+		p, ok := cfg.profiles[profile]
+		if !ok {
+			return nil, "", fmt.Errorf("unknown profile '%s'", profile)
+		}
+		return &p.cfg, p.name, nil
+	}
+
+	for _, p := range cfg.profiles {
+		if slices.Contains(p.groups, cfg.group) {
+			return &p.cfg, p.name, nil
+		}
+	}
+
+	return cfg, "", nil
+}
@@ -0,0 +1,127 @@
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package proto
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/valyala/bytebufferpool"
+)
+
+const (
+	CompressDeflate = byte(iota + 1)
+	CompressZstd
+)
+
+// MsgTypeFlagCompressed is set in the type of a message whose payload is compressed
+const MsgTypeFlagCompressed = byte(0x80)
+
+// Payloads smaller than this are not worth compressing
+const compressMinSize = 64
+
+var compressibleMsgTypes = map[byte]bool{
+	MsgTypeTermData: true,
+	MsgTypeFile:     true,
+	MsgTypeHttp:     true,
+	MsgTypeSftp:     true,
+	MsgTypeExec:     true,
+}
+
+func CompressName(alg byte) string {
+	switch alg {
+	case CompressDeflate:
+		return "deflate"
+	case CompressZstd:
+		return "zstd"
+	default:
+		return fmt.Sprintf("unknown(%d)", alg)
+	}
+}
+
+type codec struct {
+	alg byte
+
+	mu sync.Mutex
+	fw *flate.Writer
+	fr io.ReadCloser
+
+	zenc *zstd.Encoder
+	zdec *zstd.Decoder
+}
+
+func newCodec(alg byte) (*codec, error) {
+	c := &codec{alg: alg}
+
+	switch alg {
+	case CompressDeflate:
+		c.fw, _ = flate.NewWriter(nil, flate.DefaultCompression)
+		c.fr = flate.NewReader(nil)
+
+	case CompressZstd:
+		var err error
+
+		c.zenc, err = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+
+		c.zdec, err = zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(0xffff))
+		if err != nil {
+			return nil, err
+		}
+
+	default:
+		return nil, fmt.Errorf("unsupported compression: %d", alg)
+	}
+
+	return c, nil
+}
+
+// compress appends the compressed src to dst, it's safe for concurrent use
+func (c *codec) compress(dst *bytebufferpool.ByteBuffer, src []byte) error {
+	if c.zenc != nil {
+		dst.B = c.zenc.EncodeAll(src, dst.B)
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.fw.Reset(dst)
+
+	if _, err := c.fw.Write(src); err != nil {
+		return err
+	}
+
+	return c.fw.Close()
+}
+
+// decompress appends the decompressed src to dst, it's only called by the reader
+func (c *codec) decompress(dst, src []byte) ([]byte, error) {
+	if c.zdec != nil {
+		return c.zdec.DecodeAll(src, dst)
+	}
+
+	c.fr.(flate.Resetter).Reset(bytes.NewReader(src), nil)
+
+	buf := bytes.NewBuffer(dst)
+
+	n, err := buf.ReadFrom(io.LimitReader(c.fr, 0xffff+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if n > 0xffff {
+		return nil, fmt.Errorf("decompressed message too long")
+	}
+
+	return buf.Bytes(), nil
+}
@@ -33,6 +33,8 @@ const (
 	MsgTypeFile
 	MsgTypeHttp
 	MsgTypeAck
+	MsgTypeSftp
+	MsgTypeExec
 )
 
 const (
@@ -41,12 +43,59 @@ const (
 	MsgRegAttrDescription
 	MsgRegAttrToken
 	MsgRegAttrGroup
+	MsgRegAttrCompress
+	MsgRegAttrFile64       // Empty, echoed by servers taking 64-bit file sizes
+	MsgRegAttrFileCompress // Algorithms for file data, the server answers with the one it picked
+	MsgRegAttrFileId       // Empty, echoed by servers taking the id of the transfer after the type of file messages
+	MsgRegAttrFileMeta     // Empty, echoed by servers taking the mode, mtime and owner of files
+	MsgRegAttrFileProgress // Empty, echoed by servers taking FileProgress messages
+	MsgRegAttrSftp         // Empty, sent by devices serving SFTP through Sftp messages
+	MsgRegAttrFileChannel  // Empty from devices, the server answers with the token of a connection for file messages
+	MsgRegAttrFileWindow   // Data frames of a file unacknowledged at most, the server answers with its own
+	MsgRegAttrFileDelta    // Empty, echoed by servers sending the changes to the file a download replaces
+	MsgRegAttrFileSync     // Empty, echoed by servers keeping the files devices sync, see FileSyncSid
+	MsgRegAttrFileCrypt    // Empty, echoed by servers relaying file data encrypted end to end, see FileCryptSealedKeySize
+	MsgRegAttrCmdEnv       // Empty, sent by devices taking environment variables, then attributes, after the params of Cmd messages
+	MsgRegAttrExec         // Empty, sent by devices opening exec sessions, see MsgLoginAttrExec
 )
 
 const (
 	MsgHeartbeatAttrUptime = byte(iota)
 )
 
+// Optional attributes following the sid of a login message
+const (
+	MsgLoginAttrEnv     = byte(iota) // KEY=VALUE, may be repeated
+	MsgLoginAttrObserve              // sid of a session to watch read-only instead of opening a terminal
+	MsgLoginAttrProfile              // name of the terminal profile to start the terminal with
+	MsgLoginAttrExec                 // username, command and its args, each ending with a NUL, to run without a terminal
+)
+
+// Optional attributes following the environment variables of a cmd message
+const (
+	MsgCmdAttrCwd       = byte(iota) // Directory to run the command in, relative to the home of the user
+	MsgCmdAttrJob                    // Run the command as a background job, 1 to be sent its output as it comes
+	MsgCmdAttrJobStatus              // ID of a job to report the status of, instead of running a command
+	MsgCmdAttrShell                  // The command is a line for the shell, the params its positional parameters
+	MsgCmdAttrChunked                // The result may be replied in chunks when too big for a message
+	MsgCmdAttrCancel                 // Job ID, or token of a command, to cancel instead of running a command
+	MsgCmdAttrScript                 // Script run by the command, its interpreter, with the params as its args
+	MsgCmdAttrSchedule               // JSON array of commands to run on a schedule, replacing the previous ones
+)
+
+// Exec messages carry the sid of an exec session, then one of these and its
+// data. stdin and stdout go through TermData messages.
+const (
+	MsgExecStderr = byte(iota) // Output of the command to stderr
+	MsgExecExit                // Code the command exited with, 4 bytes signed, followed by a Logout
+	MsgExecEOF                 // Empty, from the server once done with stdin
+)
+
+// Optional attributes following the code of a successful login reply
+const (
+	MsgLoginReplyAttrLabel = byte(iota) // KEY=VALUE describing the terminal, may be repeated
+)
+
 const (
 	MsgTypeFileSend = byte(iota)
 	MsgTypeFileRecv
@@ -54,6 +103,37 @@ const (
 	MsgTypeFileData
 	MsgTypeFileAck
 	MsgTypeFileAbort
+	MsgTypeFileProgress // Percentage, bytes transferred and in total, bytes per second and seconds left
+	MsgTypeFileSig      // Block size and checksums of the blocks of the file a download replaces, until empty
+)
+
+// Directory sync transfers files in the session of this sid, FileSend naming
+// them after the directory they are in, FileRecv giving the name of the
+// directory to send a file for, which the server aborts once none is left
+const FileSyncSid = "00000000000000000000000000000000"
+
+// What a data frame of a download holds, given by its first byte once
+// MsgRegAttrFileDelta was agreed on and the signature of a file sent
+const (
+	FileDeltaLiteral = byte(iota) // Data of the file, compressed as the transfer
+	FileDeltaCopy                 // Index of the first block and number of blocks to copy
+)
+
+// Once MsgRegAttrFileCrypt was agreed on, data frames of files are encrypted
+// with AES-256-GCM, after compression, under a random key of the transfer. It
+// comes sealed with the key shared by the ends, nonce ahead, in the FileInfo
+// and FileSend messages, after the compression flag. The nonce of a frame is
+// its number from 0, big endian in the last 8 of its 12 bytes. The empty frame
+// ending an upload isn't encrypted.
+const FileCryptSealedKeySize = 12 + 32 + 16
+
+// How the data of a file transfer is compressed, given by a byte ahead of the
+// name in the FileInfo and FileSend messages once MsgRegAttrFileCompress was
+// agreed on
+const (
+	FileCompressNone = byte(iota)
+	FileCompressGzip
+	FileCompressZstd
 )
 
 const (
@@ -71,6 +151,8 @@ var minimumMsgLensRtty = map[byte]int{
 	MsgTypeFile:     33,
 	MsgTypeAck:      34,
 	MsgTypeHttp:     25,
+	MsgTypeSftp:     4,
+	MsgTypeExec:     33,
 }
 
 var minimumMsgLensRttys = map[byte]int{
@@ -80,6 +162,8 @@ var minimumMsgLensRttys = map[byte]int{
 	MsgTypeTermData: 33,
 	MsgTypeFile:     33,
 	MsgTypeHttp:     18,
+	MsgTypeSftp:     4,
+	MsgTypeExec:     33,
 }
 
 func MsgTypeName(typ byte) string {
@@ -104,6 +188,10 @@ func MsgTypeName(typ byte) string {
 		return "http"
 	case MsgTypeAck:
 		return "ack"
+	case MsgTypeSftp:
+		return "sftp"
+	case MsgTypeExec:
+		return "exec"
 	default:
 		return fmt.Sprintf("unknown(%d)", typ)
 	}
@@ -127,10 +215,34 @@ func NewMsgReaderWriter(role Role, conn net.Conn) *MsgReaderWriter {
 type MsgReaderWriter struct {
 	minimumMsgLens map[byte]int
 
-	conn net.Conn
-	br   *bufio.Reader
-	head [3]byte
-	buf  []byte
+	conn  net.Conn
+	br    *bufio.Reader
+	head  [3]byte
+	buf   []byte
+	dbuf  []byte
+	codec *codec
+}
+
+// SetCompression enables compression of the payloads of TermData, File, Http,
+// Sftp and Exec messages once both peers agreed on alg. Compressed messages are
+// always accepted afterwards, regardless of their type.
+func (msg *MsgReaderWriter) SetCompression(alg byte) error {
+	c, err := newCodec(alg)
+	if err != nil {
+		return err
+	}
+
+	msg.codec = c
+
+	return nil
+}
+
+// Compression returns the algorithm agreed on by SetCompression, 0 if none
+func (msg *MsgReaderWriter) Compression() byte {
+	if msg.codec == nil {
+		return 0
+	}
+	return msg.codec.alg
 }
 
 func (msg *MsgReaderWriter) Read() (byte, []byte, error) {
@@ -145,13 +257,6 @@ func (msg *MsgReaderWriter) Read() (byte, []byte, error) {
 	typ := head[0]
 	msgLen := binary.BigEndian.Uint16(head[1:])
 
-	if fixedMsgLen, ok := msg.minimumMsgLens[typ]; ok {
-		if msgLen < uint16(fixedMsgLen) {
-			return 0, nil, fmt.Errorf("invalid message length for %s: at least %d, got %d",
-				MsgTypeName(typ), fixedMsgLen, msgLen)
-		}
-	}
-
 	if cap(msg.buf) < int(msgLen) {
 		msg.buf = make([]byte, msgLen)
 	} else {
@@ -163,7 +268,31 @@ func (msg *MsgReaderWriter) Read() (byte, []byte, error) {
 		return 0, nil, err
 	}
 
-	return typ, msg.buf, nil
+	data := msg.buf
+
+	if typ&MsgTypeFlagCompressed != 0 {
+		typ &^= MsgTypeFlagCompressed
+
+		if msg.codec == nil {
+			return 0, nil, fmt.Errorf("unexpected compressed message %s", MsgTypeName(typ))
+		}
+
+		msg.dbuf, err = msg.codec.decompress(msg.dbuf[:0], data)
+		if err != nil {
+			return 0, nil, fmt.Errorf("decompress message %s: %w", MsgTypeName(typ), err)
+		}
+
+		data = msg.dbuf
+	}
+
+	if fixedMsgLen, ok := msg.minimumMsgLens[typ]; ok {
+		if len(data) < fixedMsgLen {
+			return 0, nil, fmt.Errorf("invalid message length for %s: at least %d, got %d",
+				MsgTypeName(typ), fixedMsgLen, len(data))
+		}
+	}
+
+	return typ, data, nil
 }
 
 func (msg *MsgReaderWriter) Write(typ byte, data ...any) error {
@@ -216,6 +345,20 @@ func (msg *MsgReaderWriter) Write(typ byte, data ...any) error {
 
 	binary.BigEndian.PutUint16(bb.B[1:], uint16(total))
 
+	if msg.codec != nil && compressibleMsgTypes[typ] && total >= compressMinSize {
+		cb := bytebufferpool.Get()
+		defer bytebufferpool.Put(cb)
+
+		cb.B = append(cb.B, typ|MsgTypeFlagCompressed, 0, 0)
+
+		// Fall back to the plain message when it doesn't shrink
+		if err := msg.codec.compress(cb, bb.B[3:]); err == nil && cb.Len()-3 < total {
+			binary.BigEndian.PutUint16(cb.B[1:], uint16(cb.Len()-3))
+			_, err := cb.WriteTo(msg.conn)
+			return err
+		}
+	}
+
 	_, err := bb.WriteTo(msg.conn)
 
 	return err
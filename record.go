@@ -0,0 +1,156 @@
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// castRecorder writes a terminal session to an asciinema v2 cast file,
+// see https://docs.asciinema.org/manual/asciicast/v2/
+type castRecorder struct {
+	mu     sync.Mutex
+	f      *os.File
+	start  time.Time
+	input  bool
+	closed bool
+
+	// Incomplete UTF-8 sequences are held back until the rest arrives
+	pending map[string][]byte
+}
+
+type castHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title"`
+	Env       map[string]string `json:"env"`
+}
+
+// newRecorder returns nil when recording is off
+func (cli *RttyClient) newRecorder(sid string, term *Terminal) (*castRecorder, error) {
+	if cli.cfg.recordDir == "" {
+		return nil, nil
+	}
+
+	return newCastRecorder(cli.cfg.recordDir, cli.cfg.id, sid, term.backend, cli.cfg.recordInput,
+		cli.cfg.term, cli.cfg.termCols, cli.cfg.termRows)
+}
+
+func newCastRecorder(dir, devid, sid, shell string, input bool, termName string, cols, rows uint16) (*castRecorder, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+
+	name := fmt.Sprintf("%s-%s-%s.cast", devid, start.Format("20060102-150405"), sid)
+
+	f, err := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &castRecorder{
+		f:       f,
+		start:   start,
+		input:   input,
+		pending: make(map[string][]byte),
+	}
+
+	// The real size is only known once the first winsize message arrives
+	header, _ := json.Marshal(castHeader{
+		Version:   2,
+		Width:     int(cols),
+		Height:    int(rows),
+		Timestamp: start.Unix(),
+		Title:     fmt.Sprintf("%s %s", devid, sid),
+		Env:       map[string]string{"SHELL": shell, "TERM": termName},
+	})
+
+	f.Write(append(header, '\n'))
+
+	return r, nil
+}
+
+func (r *castRecorder) output(data []byte) {
+	r.event("o", data)
+}
+
+func (r *castRecorder) recordInput(data []byte) {
+	if r != nil && r.input {
+		r.event("i", data)
+	}
+}
+
+func (r *castRecorder) resize(cols, rows uint16) {
+	r.event("r", fmt.Appendf(nil, "%dx%d", cols, rows))
+}
+
+// A nil recorder records nothing
+func (r *castRecorder) event(code string, data []byte) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return
+	}
+
+	data = append(r.pending[code], data...)
+
+	// Cut before a trailing sequence that isn't complete yet
+	n := len(data)
+	for i := n - 1; i >= max(0, n-utf8.UTFMax+1); i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				n = i
+			}
+			break
+		}
+	}
+
+	r.pending[code] = append([]byte(nil), data[n:]...)
+
+	if n == 0 {
+		return
+	}
+
+	line, _ := json.Marshal([]any{
+		float64(time.Since(r.start).Microseconds()) / 1e6,
+		code,
+		string(data[:n]),
+	})
+
+	r.f.Write(append(line, '\n'))
+}
+
+func (r *castRecorder) Close() error {
+	if r == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return nil
+	}
+
+	r.closed = true
+
+	return r.f.Close()
+}
@@ -0,0 +1,210 @@
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// parseDNSServer accepts a bare ip[:port], udp://, tcp://, tls://(DoT) and https://(DoH)
+func parseDNSServer(server string) (*url.URL, error) {
+	if !strings.Contains(server, "://") {
+		server = "udp://" + server
+	}
+
+	u, err := url.Parse(server)
+	if err != nil {
+		return nil, fmt.Errorf("invalid dns server: %w", err)
+	}
+
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid dns server: %s", server)
+	}
+
+	switch u.Scheme {
+	case "udp", "tcp":
+		if u.Port() == "" {
+			u.Host = net.JoinHostPort(u.Hostname(), "53")
+		}
+	case "tls":
+		if u.Port() == "" {
+			u.Host = net.JoinHostPort(u.Hostname(), "853")
+		}
+	case "https":
+	default:
+		return nil, fmt.Errorf("invalid dns server: unsupported scheme '%s', must be one of udp, tcp, tls, https", u.Scheme)
+	}
+
+	return u, nil
+}
+
+// newResolver returns a resolver which queries server directly, bypassing the
+// system resolver and whatever it has cached. Go's resolver keeps no cache of
+// its own, so every reconnect resolves the server afresh.
+func newResolver(server string) (*net.Resolver, error) {
+	if server == "" {
+		return net.DefaultResolver, nil
+	}
+
+	u, err := parseDNSServer(server)
+	if err != nil {
+		return nil, err
+	}
+
+	var dial func(ctx context.Context) (net.Conn, error)
+
+	switch u.Scheme {
+	case "udp", "tcp":
+		dial = func(ctx context.Context) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, u.Scheme, u.Host)
+		}
+
+	case "tls":
+		dial = func(ctx context.Context) (net.Conn, error) {
+			d := tls.Dialer{Config: &tls.Config{ServerName: u.Hostname()}}
+			return d.DialContext(ctx, "tcp", u.Host)
+		}
+
+	case "https":
+		client := &http.Client{Timeout: 10 * time.Second}
+		dial = func(ctx context.Context) (net.Conn, error) {
+			return &dohConn{ctx: ctx, client: client, url: u.String()}, nil
+		}
+	}
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dial(ctx)
+		},
+	}, nil
+}
+
+// dohConn carries the length prefixed DNS messages the resolver exchanges over
+// stream connections as RFC 8484 POST requests. It isn't a net.PacketConn, so
+// the resolver treats it like a TCP connection.
+type dohConn struct {
+	ctx      context.Context
+	client   *http.Client
+	url      string
+	req      bytes.Buffer
+	resp     bytes.Buffer
+	deadline time.Time
+}
+
+type dohAddr string
+
+func (a dohAddr) Network() string { return "https" }
+func (a dohAddr) String() string  { return string(a) }
+
+func (c *dohConn) Write(b []byte) (int, error) {
+	c.req.Write(b)
+
+	for c.req.Len() >= 2 {
+		size := int(binary.BigEndian.Uint16(c.req.Bytes()))
+		if c.req.Len() < size+2 {
+			break
+		}
+
+		msg := c.req.Next(size + 2)[2:]
+
+		if err := c.exchange(msg); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(b), nil
+}
+
+func (c *dohConn) exchange(msg []byte) error {
+	ctx := c.ctx
+
+	// The resolver gives each attempt a deadline, which then bounds the
+	// whole request
+	if !c.deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, c.deadline)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(msg))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("doh server replied: %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 0xffff+1))
+	if err != nil {
+		return err
+	}
+
+	if len(body) > 0xffff {
+		return fmt.Errorf("doh response too long")
+	}
+
+	c.resp.Write(binary.BigEndian.AppendUint16(nil, uint16(len(body))))
+	c.resp.Write(body)
+
+	return nil
+}
+
+func (c *dohConn) Read(b []byte) (int, error) {
+	if c.resp.Len() == 0 {
+		return 0, io.EOF
+	}
+	return c.resp.Read(b)
+}
+
+func (c *dohConn) Close() error {
+	return nil
+}
+
+func (c *dohConn) LocalAddr() net.Addr {
+	return dohAddr(c.url)
+}
+
+func (c *dohConn) RemoteAddr() net.Addr {
+	return dohAddr(c.url)
+}
+
+func (c *dohConn) SetDeadline(t time.Time) error {
+	c.deadline = t
+	return nil
+}
+
+// SetReadDeadline does nothing, responses are read once the requests written
+// got them
+func (c *dohConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *dohConn) SetWriteDeadline(t time.Time) error {
+	c.deadline = t
+	return nil
+}
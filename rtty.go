@@ -6,43 +6,98 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"math/rand/v2"
 	"net"
 	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/rs/zerolog/log"
 	"github.com/shirou/gopsutil/v3/host"
 	"github.com/valyala/bytebufferpool"
 	"github.com/zhaojh329/rtty-go/proto"
+	"golang.org/x/time/rate"
 )
 
 const (
-	rttyProtoVer         = byte(5)
-	rttyTermLimit        = 10
-	rttyTermTimeout      = 600 * time.Second
-	rttyHeartbeatTimeout = 3 * time.Second
+	rttyProtoVer = byte(5)
+
+	// Output kept for a detached session, the oldest is dropped beyond it
+	rttySessionBacklog = 64 * 1024
+
+	// The heartbeat timeout adapts to the measured round-trip time within these bounds
+	rttyHeartbeatTimeout    = 3 * time.Second
+	rttyHeartbeatMaxTimeout = 60 * time.Second
 )
 
 type RttyClient struct {
-	sessions sync.Map
-	httpCons sync.Map
+	sessions  sync.Map
+	observers sync.Map
+	httpCons  sync.Map
+	sftpChans sync.Map
+	execs     sync.Map
 
 	conn             net.Conn
+	addr             string // Of the server connected to
 	cfg              Config
+	server           int
+	onBackup         bool
 	ntty             int
+	nexec            int
 	heartbeatTimer   *time.Timer
 	lastHeartbeat    time.Time
 	waitingHeartbeat bool
+	msgReceived      atomic.Bool // since the heartbeat timer last looked
+	srtt             time.Duration
+	rttvar           time.Duration
 	mu               sync.Mutex
 
-	msg *proto.MsgReaderWriter
+	msg      *proto.MsgReaderWriter
+	stats    trafficStats
+	cmdStats cmdStats
+
+	// The server sends file sizes in 64 bits rather than 32
+	file64 atomic.Bool
+	// Compression of file data agreed on with the server, FileCompressNone if none
+	fileCompress atomic.Uint32
+	// Shared by the file transfers of all the terminals
+	fileLimiter *rate.Limiter
+	// File messages carry the id of the transfer, a terminal may then run several
+	fileId        atomic.Bool
+	fileTransfers atomic.Int32
+	// The file info carries the mode, mtime and owner of the file
+	fileMeta atomic.Bool
+	// The server shows how the transfers go
+	fileProgress atomic.Bool
+	// Data frames of a file sent ahead of the acknowledgements, 1 if the
+	// server waits for each
+	fileWindow atomic.Uint32
+	// The server sends the changes to files downloads replace
+	fileDelta atomic.Bool
+	// The server keeps the files of directory sync
+	fileSync atomic.Bool
+	// The server relays file data encrypted with file-key
+	fileCrypt atomic.Bool
+
+	// Directory sync, nil unless configured
+	sync *fileSync
+	// Commands the server scheduled, nil unless cmd-schedule is set
+	schedule *cmdSchedule
+	// The connection file messages go through when the server opened one
+	fileChannel atomic.Pointer[fileChannel]
 }
 
 var msgHandlers = map[byte]func(*RttyClient, []byte) error{
@@ -55,58 +110,236 @@ var msgHandlers = map[byte]func(*RttyClient, []byte) error{
 	proto.MsgTypeFile:      handleFileMsg,
 	proto.MsgTypeCmd:       handleCmdMsg,
 	proto.MsgTypeHttp:      handleHttpMsg,
+	proto.MsgTypeSftp:      handleSftpMsg,
+	proto.MsgTypeExec:      handleExecMsg,
 }
 
 func (cli *RttyClient) Run() {
+	initialDelay := time.Duration(cli.cfg.reconnectDelay) * time.Second
+	maxDelay := time.Duration(cli.cfg.reconnectMaxDelay) * time.Second
+	delay := initialDelay
+	failover := false
+
+	if cli.cfg.statsInterval > 0 {
+		go cli.logStats(time.Duration(cli.cfg.statsInterval) * time.Second)
+	}
+
+	if cli.cfg.fileMaxRate > 0 {
+		cli.fileLimiter = newRateLimiter(cli.cfg.fileMaxRate)
+	}
+
+	if len(cli.cfg.syncPush) > 0 || len(cli.cfg.syncPull) > 0 {
+		cli.sync = newFileSync(cli)
+		go cli.sync.run()
+	}
+
+	if cli.cfg.cmdSchedule != "" {
+		cli.schedule = newCmdSchedule(cli)
+		go cli.schedule.run()
+	}
+
 	for {
-		cli.run()
+		registered := cli.run()
+
+		if !registered && len(cli.cfg.hosts) > 1 {
+			cli.server = (cli.server + 1) % len(cli.cfg.hosts)
+			log.Info().Msgf("Switching to server %s", cli.cfg.hosts[cli.server])
+		}
 
 		if !cli.cfg.reconnect {
 			break
 		}
 
-		delay := rand.IntN(10) + 5
-		log.Error().Msgf("Reconnecting in %d seconds...", delay)
-		time.Sleep(time.Duration(delay) * time.Second)
+		// Either uplink failing moves to the other one, a connection that was
+		// up is resumed over the other uplink right away.
+		if cli.cfg.backupInterface != "" {
+			cli.onBackup = !cli.onBackup
+
+			if uplink := cli.uplink(); uplink != "" {
+				log.Info().Msgf("Switching to uplink %s", uplink)
+			} else {
+				log.Info().Msg("Switching to the default route")
+			}
+
+			// Back to the usual delay if that connection drops too
+			if registered && !failover {
+				failover = true
+				cli.stats.reconnects.Add(1)
+				delay = initialDelay
+				continue
+			}
+		}
+
+		failover = false
+
+		// Start over once the server accepted us, otherwise back off further
+		if registered {
+			delay = initialDelay
+		}
+
+		wait := reconnectJitter(delay, cli.cfg.reconnectJitter)
+		log.Error().Msgf("Reconnecting in %v...", wait)
+		time.Sleep(wait)
+
+		cli.stats.reconnects.Add(1)
+
+		delay = min(delay*2, maxDelay)
 	}
 }
 
-func (cli *RttyClient) run() {
+// reconnectJitter randomizes delay by up to ±percent so that devices which
+// lost the server at the same moment don't come back all at once.
+func reconnectJitter(delay time.Duration, percent uint8) time.Duration {
+	spread := int64(delay) * int64(percent) / 100
+	if spread <= 0 {
+		return delay
+	}
+
+	delay += time.Duration(rand.Int64N(2*spread+1) - spread)
+
+	return delay.Round(time.Millisecond)
+}
+
+// run returns whether the server was reached and accepted the registration,
+// so that Run only moves on to the next server when this one is unusable.
+func (cli *RttyClient) run() bool {
 	defer cli.Close()
 
 	err := cli.Connect()
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to connect to server")
-		return
+		return false
 	}
 
 	err = cli.Register()
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to register with server")
-		return
+		return false
 	}
 
-	cli.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	cli.conn.SetReadDeadline(time.Now().Add(time.Duration(cli.cfg.readTimeout) * time.Second))
 
 	typ, data, err := cli.ReadMsg()
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to read register msg")
-		return
+		return false
 	}
 
 	if typ != proto.MsgTypeRegister {
 		log.Error().Msgf("register msg expected first, got %s", proto.MsgTypeName(typ))
-		return
+		return false
 	}
 
 	regCode := data[0]
 	if regCode != 0 {
 		log.Error().Msgf("register failed: %s", string(data[1:]))
-		return
+		return false
 	}
 
 	log.Info().Msg("registered successfully")
 
+	cli.file64.Store(false)
+	cli.fileId.Store(false)
+	cli.fileMeta.Store(false)
+	cli.fileProgress.Store(false)
+	cli.fileCompress.Store(uint32(proto.FileCompressNone))
+	cli.fileWindow.Store(1)
+	cli.fileDelta.Store(false)
+	cli.fileSync.Store(false)
+	cli.fileCrypt.Store(false)
+
+	var fileChannelToken []byte
+
+	// Servers not negotiating anything may follow the code with a text
+	// rather than attributes, which agrees on nothing
+	attrs := data[1:]
+	if err := parseMsgAttrs(attrs, func(byte, []byte) error { return nil }); err != nil {
+		log.Warn().Err(err).Msgf("register reply not followed by attributes, nothing negotiated: %q", attrs)
+		attrs = nil
+	}
+
+	err = parseMsgAttrs(attrs, func(attrType byte, val []byte) error {
+		switch attrType {
+		case proto.MsgRegAttrCompress:
+			if len(val) < 1 {
+				return fmt.Errorf("invalid compress attr")
+			}
+
+			if err := cli.msg.SetCompression(val[0]); err != nil {
+				return err
+			}
+
+			log.Info().Msgf("compression enabled: %s", proto.CompressName(val[0]))
+
+		case proto.MsgRegAttrFile64:
+			cli.file64.Store(true)
+
+		case proto.MsgRegAttrFileId:
+			cli.fileId.Store(true)
+
+		case proto.MsgRegAttrFileMeta:
+			cli.fileMeta.Store(true)
+
+		case proto.MsgRegAttrFileProgress:
+			cli.fileProgress.Store(true)
+
+		case proto.MsgRegAttrFileCompress:
+			if len(val) < 1 || (val[0] != proto.FileCompressGzip && val[0] != proto.FileCompressZstd) {
+				return fmt.Errorf("invalid file compress attr")
+			}
+
+			cli.fileCompress.Store(uint32(val[0]))
+
+			log.Info().Msgf("file compression enabled: %s", fileCompressName(val[0]))
+
+		case proto.MsgRegAttrFileDelta:
+			cli.fileDelta.Store(true)
+
+		case proto.MsgRegAttrFileSync:
+			cli.fileSync.Store(true)
+
+		case proto.MsgRegAttrFileCrypt:
+			cli.fileCrypt.Store(true)
+
+		case proto.MsgRegAttrFileWindow:
+			if len(val) < 1 || val[0] == 0 {
+				return fmt.Errorf("invalid file window attr")
+			}
+
+			cli.fileWindow.Store(uint32(min(val[0], cli.cfg.fileWindow)))
+
+			log.Info().Msgf("file window: %d frames", cli.fileWindow.Load())
+
+		case proto.MsgRegAttrFileChannel:
+			if len(val) < 1 {
+				return fmt.Errorf("invalid file channel attr")
+			}
+
+			fileChannelToken = bytes.Clone(val)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("invalid register msg")
+		return false
+	}
+
+	if fileChannelToken != nil {
+		go cli.openFileChannel(fileChannelToken)
+	}
+
+	if cli.cfg.fileKey != "" && !cli.fileCrypt.Load() {
+		log.Warn().Msg("the server doesn't support encrypted file transfers, files are refused")
+	}
+
+	if cli.sync != nil {
+		cli.sync.online()
+	}
+
+	if cli.schedule != nil {
+		cli.schedule.online()
+	}
+
 	cli.conn.SetReadDeadline(time.Time{})
 
 	cli.startHeartbeat()
@@ -115,7 +348,7 @@ func (cli *RttyClient) run() {
 		typ, data, err = cli.ReadMsg()
 		if err != nil {
 			log.Error().Err(err).Msg("Failed to read message")
-			return
+			return true
 		}
 
 		log.Debug().Msgf("recv msg: %s", proto.MsgTypeName(typ))
@@ -123,16 +356,16 @@ func (cli *RttyClient) run() {
 		handler, ok := msgHandlers[typ]
 		if !ok {
 			log.Error().Msgf("unexpected message '%s'", proto.MsgTypeName(typ))
-			return
+			return true
 		}
 
 		err = handler(cli, data)
 		if err != nil {
 			log.Error().Err(err).Msgf("failed to handle message '%s'", proto.MsgTypeName(typ))
-			return
+			return true
 		}
 
-		cli.waitingHeartbeat = false
+		cli.msgReceived.Store(true)
 	}
 }
 
@@ -141,62 +374,182 @@ func (cli *RttyClient) Connect() error {
 	var conn net.Conn
 	var err error
 
-	addr := net.JoinHostPort(cfg.host, fmt.Sprintf("%d", cfg.port))
+	resolver, err := newResolver(cfg.dnsServer)
+	if err != nil {
+		return err
+	}
 
-	if cfg.ssl {
-		dialer := &net.Dialer{
-			Timeout: 5 * time.Second,
-		}
+	addrs := []string{cfg.hosts[cli.server]}
 
-		tlsConfig := &tls.Config{
-			InsecureSkipVerify: cfg.insecure,
+	if isSRVName(addrs[0]) {
+		addrs, err = lookupSRV(resolver, addrs[0])
+		if err != nil {
+			return err
 		}
+	}
 
-		if cfg.cacert != "" {
-			caCert, err := os.ReadFile(cfg.cacert)
-			if err != nil {
-				return fmt.Errorf("load cacert fail: %w", err)
-			}
+	dialer, tlsConfig, err := cli.transport(resolver)
+	if err != nil {
+		return err
+	}
+
+	// SRV targets are tried in the order given by their priority and weight
+	for _, addr := range addrs {
+		conn, err = cli.dial(dialer, addr, tlsConfig)
+		if err == nil {
+			conn = newThrottledConn(conn, cfg.maxUploadRate, cfg.maxDownloadRate)
+			conn = &statsConn{Conn: conn, stats: &cli.stats}
 
-			caCertPool := x509.NewCertPool()
-			caCertPool.AppendCertsFromPEM(caCert)
+			cli.msg = proto.NewMsgReaderWriter(proto.RoleRtty, conn)
+			cli.conn = conn
+			cli.addr = addr
 
-			tlsConfig.RootCAs = caCertPool
+			log.Info().Msgf("Connected to %s", addr)
 
+			return nil
 		}
 
-		if cfg.sslcert != "" && cfg.sslkey != "" {
-			cert, err := tls.LoadX509KeyPair(cfg.sslcert, cfg.sslkey)
-			if err != nil {
-				return fmt.Errorf("load cert and key fail: %w", err)
-			}
+		if len(addrs) > 1 {
+			log.Error().Err(err).Msg("Failed to connect to server")
+		}
+	}
+
+	return err
+}
+
+// transport returns how to reach the server, through a proxy or jump host
+// and over TLS as configured
+func (cli *RttyClient) transport(resolver *net.Resolver) (contextDialer, *tls.Config, error) {
+	var tlsConfig *tls.Config
+	var err error
 
-			tlsConfig.Certificates = []tls.Certificate{cert}
+	if cli.cfg.ssl || cli.cfg.transport == "wss" {
+		tlsConfig, err = cli.tlsConfig()
+		if err != nil {
+			return nil, nil, err
 		}
+	}
 
-		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
-	} else {
-		conn, err = net.DialTimeout("tcp", addr, 5*time.Second)
+	dialer, err := cli.dialer(resolver)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return dialer, tlsConfig, nil
+}
+
+func (cli *RttyClient) dial(dialer contextDialer, addr string, tlsConfig *tls.Config) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+
+	cfg := cli.cfg
+
+	// A local server is reached over its unix socket and neither a proxy
+	// nor a jump host is involved, the rest of the transport is unchanged.
+	if path, ok := strings.CutPrefix(addr, unixHostPrefix); ok {
+		dialer = unixDialer(path)
+		addr = net.JoinHostPort("localhost", strconv.Itoa(int(cfg.port)))
+	}
+
+	host, _, _ := net.SplitHostPort(addr)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.dialTimeout)*time.Second)
+	defer cancel()
+
+	switch cfg.transport {
+	case "ws", "wss":
+		conn, err = dialWebsocket(ctx, dialer, addr, cfg.transport, cfg.wsPath, tlsConfig)
+	case "mqtt":
+		conn, err = dialMQTT(ctx, dialer, addr, tlsConfig, &cfg)
+	default:
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+		if err == nil && tlsConfig != nil {
+			conn, err = tlsHandshake(ctx, conn, host, tlsConfig)
+		}
 	}
 
 	if err != nil {
-		return fmt.Errorf("failed to connect to %s: %w", addr, err)
+		return nil, fmt.Errorf("failed to connect to %s: %w", addr, err)
 	}
 
-	cli.msg = proto.NewMsgReaderWriter(proto.RoleRtty, conn)
-	cli.conn = conn
+	return conn, nil
+}
 
-	log.Info().Msgf("Connected to %s:%d", cfg.host, cfg.port)
+func (cli *RttyClient) tlsConfig() (*tls.Config, error) {
+	cfg := cli.cfg
 
-	return nil
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: cfg.insecure,
+	}
+
+	if cfg.cacert != "" {
+		caCert, err := os.ReadFile(cfg.cacert)
+		if err != nil {
+			return nil, fmt.Errorf("load cacert fail: %w", err)
+		}
+
+		caCertPool := x509.NewCertPool()
+
+		// On Windows and macOS the system pool verifies with the platform
+		// APIs and falls back to the certificates added to it
+		if cfg.systemCA {
+			caCertPool, err = x509.SystemCertPool()
+			if err != nil {
+				return nil, fmt.Errorf("load system cert pool fail: %w", err)
+			}
+		}
+
+		caCertPool.AppendCertsFromPEM(caCert)
+
+		tlsConfig.RootCAs = caCertPool
+	}
+
+	if cfg.sslcert != "" && cfg.sslkey != "" {
+		var cert tls.Certificate
+		var err error
+
+		if handle, ok := strings.CutPrefix(cfg.sslkey, "tpm:"); ok {
+			cert, err = loadTPMKeyPair(cfg.sslcert, cfg.tpmDevice, handle)
+		} else {
+			cert, err = tls.LoadX509KeyPair(cfg.sslcert, cfg.sslkey)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("load cert and key fail: %w", err)
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
 }
 
 func (cli *RttyClient) ReadMsg() (byte, []byte, error) {
-	return cli.msg.Read()
+	typ, data, err := cli.msg.Read()
+	if err == nil {
+		cli.stats.msgsIn[typ].Add(1)
+	}
+	return typ, data, err
 }
 
 func (cli *RttyClient) WriteMsg(typ byte, data ...any) error {
-	return cli.msg.Write(typ, data...)
+	if cli.cfg.writeTimeout > 0 {
+		cli.conn.SetWriteDeadline(time.Now().Add(time.Duration(cli.cfg.writeTimeout) * time.Second))
+	}
+
+	err := cli.msg.Write(typ, data...)
+	if err != nil {
+		// The peer stopped reading, tear the connection down so that the
+		// reader fails and the reconnect logic kicks in
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			log.Error().Msgf("write %s stalled over %ds, disconnecting", proto.MsgTypeName(typ), cli.cfg.writeTimeout)
+			cli.conn.Close()
+		}
+		return err
+	}
+
+	cli.stats.msgsOut[typ].Add(1)
+
+	return nil
 }
 
 func (cli *RttyClient) Register() error {
@@ -222,10 +575,58 @@ func (cli *RttyClient) Register() error {
 		putMsgAttr(bb, proto.MsgRegAttrToken, cfg.token)
 	}
 
+	if cfg.compress {
+		// In order of preference, the server answers with the one it picked
+		putMsgAttr(bb, proto.MsgRegAttrCompress, []byte{proto.CompressZstd, proto.CompressDeflate})
+	}
+
+	// Older servers ignore it and keep to 32-bit sizes
+	putMsgAttr(bb, proto.MsgRegAttrFile64, []byte{})
+
+	if cfg.fileCompress {
+		putMsgAttr(bb, proto.MsgRegAttrFileCompress, []byte{proto.FileCompressZstd, proto.FileCompressGzip})
+	}
+
+	// Older servers ignore it and keep to a transfer per terminal
+	putMsgAttr(bb, proto.MsgRegAttrFileId, []byte{})
+	putMsgAttr(bb, proto.MsgRegAttrFileMeta, []byte{})
+	putMsgAttr(bb, proto.MsgRegAttrFileProgress, []byte{})
+
+	// Older servers ignore it and wait for each frame to be acknowledged
+	if cfg.fileWindow > 1 {
+		putMsgAttr(bb, proto.MsgRegAttrFileWindow, cfg.fileWindow)
+	}
+
+	if cfg.fileDelta {
+		putMsgAttr(bb, proto.MsgRegAttrFileDelta, []byte{})
+	}
+
+	if len(cfg.syncPush) > 0 || len(cfg.syncPull) > 0 {
+		putMsgAttr(bb, proto.MsgRegAttrFileSync, []byte{})
+	}
+
+	if cfg.fileKey != "" {
+		putMsgAttr(bb, proto.MsgRegAttrFileCrypt, []byte{})
+	}
+
+	if cfg.sftp {
+		putMsgAttr(bb, proto.MsgRegAttrSftp, []byte{})
+	}
+
+	putMsgAttr(bb, proto.MsgRegAttrCmdEnv, []byte{})
+	putMsgAttr(bb, proto.MsgRegAttrExec, []byte{})
+
+	// Another MQTT connection would take the place of this one
+	if cfg.fileChannel && cfg.transport != "mqtt" {
+		putMsgAttr(bb, proto.MsgRegAttrFileChannel, []byte{})
+	}
+
 	return cli.WriteMsg(proto.MsgTypeRegister, bb)
 }
 
 func (cli *RttyClient) Close() {
+	cli.closeFileChannel()
+
 	cli.mu.Lock()
 	cli.waitingHeartbeat = false
 	if cli.heartbeatTimer != nil {
@@ -234,9 +635,24 @@ func (cli *RttyClient) Close() {
 	}
 	cli.mu.Unlock()
 
+	// Observers belong to the connection which is gone
+	cli.observers.Range(func(key, value any) bool {
+		value.(*TermSession).unobserve(key.(string))
+		cli.observers.Delete(key)
+		return true
+	})
+
+	grace := time.Duration(cli.cfg.sessionGrace) * time.Second
+
 	cli.sessions.Range(func(key, value any) bool {
 		s := value.(*TermSession)
 
+		if grace > 0 {
+			s.files.reset()
+			s.detach(grace)
+			return true
+		}
+
 		s.mu.Lock()
 		if s.timer != nil {
 			s.timer.Stop()
@@ -245,16 +661,35 @@ func (cli *RttyClient) Close() {
 		s.mu.Unlock()
 
 		s.term.Close()
-		s.fc.reset()
+		s.files.reset()
 		cli.sessions.Delete(key)
 		return true
 	})
 
+	if cli.sync != nil {
+		cli.sync.ses.files.reset()
+	}
+
+	if cli.schedule != nil {
+		cli.schedule.offline()
+	}
+
 	cli.httpCons.Range(func(key, value any) bool {
 		con := value.(*RttyHttpConn)
 		con.cancel()
 		return true
 	})
+
+	cli.sftpChans.Range(func(key, value any) bool {
+		c := value.(*RttySftpChannel)
+		c.cancel()
+		return true
+	})
+
+	cli.execs.Range(func(key, value any) bool {
+		value.(*execSession).close()
+		return true
+	})
 }
 
 func (cli *RttyClient) startHeartbeat() {
@@ -262,11 +697,20 @@ func (cli *RttyClient) startHeartbeat() {
 	defer cli.mu.Unlock()
 
 	cli.lastHeartbeat = time.Time{}
+	cli.srtt = 0
+	cli.rttvar = 0
 
 	heartbeatInterval := time.Duration(cli.cfg.heartbeat) * time.Second
 
 	cli.heartbeatTimer = time.AfterFunc(heartbeatInterval, func() {
 		if cli.waitingHeartbeat {
+			// The reply may be queued behind other messages, which tell the
+			// connection is alive still
+			if cli.msgReceived.Swap(false) {
+				cli.heartbeatTimer.Reset(cli.heartbeatTimeout())
+				return
+			}
+
 			log.Error().Msg("heartbeat timeout")
 			cli.conn.Close()
 			return
@@ -287,67 +731,297 @@ func (cli *RttyClient) startHeartbeat() {
 
 			cli.lastHeartbeat = time.Now()
 			cli.waitingHeartbeat = true
-			cli.heartbeatTimer.Reset(rttyHeartbeatTimeout)
+			cli.msgReceived.Store(false)
+			cli.heartbeatTimer.Reset(cli.heartbeatTimeout())
 			log.Debug().Msg("send msg: heartbeat")
 		}
 	})
 }
 
+// updateRTT keeps a smoothed round-trip time and its variation the way TCP
+// does(RFC 6298), which the heartbeat timeout is derived from.
+func (cli *RttyClient) updateRTT(rtt time.Duration) {
+	cli.mu.Lock()
+	defer cli.mu.Unlock()
+
+	if cli.srtt == 0 {
+		cli.srtt = rtt
+		cli.rttvar = rtt / 2
+	} else {
+		if rtt > 2*cli.srtt && rtt > time.Second {
+			log.Warn().Msgf("heartbeat round-trip time went up to %v, average is %v", rtt, cli.srtt)
+		}
+
+		cli.rttvar = (3*cli.rttvar + (cli.srtt - rtt).Abs()) / 4
+		cli.srtt = (7*cli.srtt + rtt) / 8
+	}
+
+	log.Debug().Msgf("heartbeat rtt: %v, srtt: %v, rttvar: %v", rtt, cli.srtt, cli.rttvar)
+}
+
+func (cli *RttyClient) heartbeatTimeout() time.Duration {
+	cli.mu.Lock()
+	defer cli.mu.Unlock()
+
+	return min(max(cli.srtt+4*cli.rttvar, rttyHeartbeatTimeout), rttyHeartbeatMaxTimeout)
+}
+
 func (cli *RttyClient) SendFileMsg(sid string, typ byte, data []byte) error {
-	return cli.WriteMsg(proto.MsgTypeFile, sid, typ, data)
+	return cli.writeFileMsg(sid, typ, data)
 }
 
 func (cli *RttyClient) SendHttpMsg(saddr [18]byte, data []byte) error {
 	return cli.WriteMsg(proto.MsgTypeHttp, saddr[:], data)
 }
 
+// handleHeartbeatMsg takes the round-trip time of the heartbeat replied to
 func handleHeartbeatMsg(cli *RttyClient, data []byte) error {
+	if cli.waitingHeartbeat {
+		cli.updateRTT(time.Since(cli.lastHeartbeat))
+		cli.waitingHeartbeat = false
+	}
 	return nil
 }
 
 func handleLoginMsg(cli *RttyClient, data []byte) error {
+	sid := string(data[:32])
 
-	sid := string(data)
+	var env []string
+	var execAttr []byte
+	observe := ""
+	profile := ""
+
+	err := parseMsgAttrs(data[32:], func(attrType byte, val []byte) error {
+		switch attrType {
+		case proto.MsgLoginAttrEnv:
+			if !strings.Contains(string(val), "=") {
+				return fmt.Errorf("invalid env '%s'", string(val))
+			}
+			env = append(env, string(val))
+		case proto.MsgLoginAttrObserve:
+			if len(val) != 32 {
+				return fmt.Errorf("invalid sid to observe '%s'", string(val))
+			}
+			observe = string(val)
+		case proto.MsgLoginAttrProfile:
+			profile = string(val)
+		case proto.MsgLoginAttrExec:
+			execAttr = val
+		}
+		return nil
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("invalid login msg")
+		return cli.WriteMsg(proto.MsgTypeLogin, sid, byte(1))
+	}
+
+	if observe != "" {
+		return cli.observe(sid, observe)
+	}
+
+	if execAttr != nil {
+		return cli.startExec(sid, execAttr, env)
+	}
+
+	if val, ok := cli.sessions.Load(sid); ok && val.(*TermSession).attach() {
+		log.Info().Msgf("resume tty %s", sid)
+		return cli.loginReply(val.(*TermSession))
+	}
+
+	cfg, profile, err := cli.cfg.termConfig(profile)
+	if err != nil {
+		log.Error().Err(err).Msg("invalid login msg")
+		return cli.WriteMsg(proto.MsgTypeLogin, sid, byte(1))
+	}
+
+	// The server's variables come last to take precedence
+	env = append(slices.Clone(cfg.env), env...)
+	env = append(env, fileTransferEnv(&cli.cfg, sid)...)
 
 	var retCode byte
+	var s *TermSession
 
 	cli.mu.Lock()
-	if cli.ntty == rttyTermLimit {
+	if cli.ntty >= int(cli.cfg.maxTtys) {
 		log.Error().Msgf("maximum number of TTYs reached: %d", cli.ntty)
 		retCode = 1
 	} else {
-		term, err := NewTerminal(cli.cfg.username)
+		term, err := NewTerminal(cfg, env)
 		if err != nil {
 			log.Error().Err(err).Msg("failed to create terminal")
 			retCode = 1
+		} else if rec, err := cli.newRecorder(sid, term); err != nil {
+			// Better no session than one that goes unrecorded
+			log.Error().Err(err).Msg("failed to record terminal")
+			term.Close()
+			retCode = 1
+		} else if audit, err := cli.newAuditLog(sid, term); err != nil {
+			log.Error().Err(err).Msg("failed to create audit log")
+			rec.Close()
+			term.Close()
+			retCode = 1
 		} else {
-			log.Info().Msgf("new tty: %d/%d %s", cli.ntty, rttyTermLimit, sid)
+			log.Info().Msgf("new tty: %d/%d %s, running %s", cli.ntty, cli.cfg.maxTtys, sid, term.backend)
+
+			s = &TermSession{
+				cli:     cli,
+				cfg:     cfg,
+				profile: profile,
+				sid:     sid,
+				term:    term,
+				rec:     rec,
+				audit:   audit,
+			}
+
+			if cli.cfg.maxTermRate > 0 {
+				s.limiter = newRateLimiter(cli.cfg.maxTermRate)
+			}
+
+			if cli.cfg.commandFilter != nil {
+				s.input = &inputFilter{commandFilter: cli.cfg.commandFilter}
+			}
+
+			s.termOut, s.termIn = term, term
 
-			s := &TermSession{
-				cli:  cli,
-				sid:  sid,
-				term: term,
+			if cli.cfg.charset != "" {
+				enc, _ := lookupCharset(cli.cfg.charset)
+				s.termOut, s.termIn = transcode(term, enc)
 			}
 
-			s.fc = &RttyFileContext{ses: s}
+			s.termOut = newClipboardFilter(s.termOut, &cli.cfg)
+
+			s.files = &fileTransfers{ses: s}
+			s.files.listen()
 
 			cli.sessions.Store(sid, s)
 
 			cli.ntty++
-
-			go s.Run(cli)
 		}
 	}
 	cli.mu.Unlock()
 
-	cli.WriteMsg(proto.MsgTypeLogin, sid, retCode)
+	if s == nil {
+		return cli.WriteMsg(proto.MsgTypeLogin, sid, retCode)
+	}
+
+	cli.loginReply(s)
+
+	// The shell output waits in the pty until Run, so the banner comes first
+	if banner := cli.banner(); len(banner) > 0 {
+		s.rec.output(banner)
+		cli.WriteMsg(proto.MsgTypeTermData, sid, banner)
+	}
+
+	s.runHook(cli.cfg.onSessionStart, "start")
+
+	go s.Run(cli)
+
+	if s.cfg.noRoot {
+		go s.watchElevation()
+	}
 
 	return nil
 }
 
+// loginReply tells the server the terminal is ready, along with labels
+// describing it for its UI
+func (cli *RttyClient) loginReply(s *TermSession) error {
+	bb := bytebufferpool.Get()
+	defer bytebufferpool.Put(bb)
+
+	bb.WriteByte(0)
+
+	for _, label := range s.labels() {
+		putMsgAttr(bb, proto.MsgLoginReplyAttrLabel, label)
+	}
+
+	return cli.WriteMsg(proto.MsgTypeLogin, s.sid, bb)
+}
+
+func (s *TermSession) labels() []string {
+	cfg := s.cfg
+	term := s.term
+
+	var labels []string
+
+	switch {
+	case cfg.serial != "":
+		labels = append(labels, "backend=serial", "serial="+term.backend)
+	case filepath.Base(term.backend) == "login":
+		labels = append(labels, "backend=login")
+	default:
+		labels = append(labels, "backend=shell", "shell="+term.backend)
+	}
+
+	if s.profile != "" {
+		labels = append(labels, "profile="+s.profile)
+	}
+
+	if cfg.shellWrapper != "" {
+		labels = append(labels, "wrapper="+cfg.shellWrapper)
+	}
+
+	if cfg.runAs != "" {
+		labels = append(labels, "user="+cfg.runAs)
+	}
+
+	if cfg.chroot != "" {
+		labels = append(labels, "chroot="+cfg.chroot)
+	}
+
+	if cfg.charset != "" {
+		labels = append(labels, "charset="+cfg.charset)
+	}
+
+	return append(labels, cfg.labels...)
+}
+
+// banner returns the text shown at the top of every new terminal. The file is
+// read on each login, so it may be changed without restarting rtty.
+func (cli *RttyClient) banner() []byte {
+	var lines []string
+
+	if cli.cfg.banner != "" {
+		lines = append(lines, strings.ReplaceAll(cli.cfg.banner, `\n`, "\n"))
+	}
+
+	if cli.cfg.bannerFile != "" {
+		data, err := os.ReadFile(cli.cfg.bannerFile)
+		if err != nil {
+			log.Warn().Err(err).Msg("failed to read banner file")
+		} else if len(data) > 0 {
+			lines = append(lines, strings.TrimSuffix(string(data), "\n"))
+		}
+	}
+
+	if len(lines) == 0 {
+		return nil
+	}
+
+	text := strings.Join(lines, "\n") + "\n"
+
+	// Terminals need a carriage return to go back to the first column
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\n", "\r\n")
+
+	return []byte(text)
+}
+
 func handleLogoutMsg(cli *RttyClient, data []byte) error {
 	sid := string(data)
 
+	if val, ok := cli.execs.Load(sid); ok {
+		log.Info().Msgf("close exec session %s", sid)
+		val.(*execSession).close()
+		return nil
+	}
+
+	if val, loaded := cli.observers.LoadAndDelete(sid); loaded {
+		log.Info().Msgf("stop observing tty %s by %s", val.(*TermSession).sid, sid)
+		val.(*TermSession).unobserve(sid)
+		return nil
+	}
+
 	if val, loaded := cli.sessions.LoadAndDelete(sid); loaded {
 		log.Info().Msgf("delete tty %s", sid)
 		s := val.(*TermSession)
@@ -361,6 +1035,8 @@ func handleLogoutMsg(cli *RttyClient, data []byte) error {
 		}
 		cli.ntty--
 		s.mu.Unlock()
+
+		s.dropObservers()
 	} else {
 		log.Error().Msgf("tty session %s not found", sid)
 		return nil
@@ -372,6 +1048,16 @@ func handleLogoutMsg(cli *RttyClient, data []byte) error {
 func handleTermDataMsg(cli *RttyClient, data []byte) error {
 	sid := string(data[:32])
 
+	// Observers are read-only
+	if _, ok := cli.observers.Load(sid); ok {
+		return nil
+	}
+
+	if val, ok := cli.execs.Load(sid); ok {
+		val.(*execSession).input(data[32:])
+		return nil
+	}
+
 	val, ok := cli.sessions.Load(sid)
 	if !ok {
 		log.Error().Msgf("terminal session %s not found", sid)
@@ -379,7 +1065,23 @@ func handleTermDataMsg(cli *RttyClient, data []byte) error {
 	}
 
 	s := val.(*TermSession)
-	s.term.Write(data[32:])
+	data = data[32:]
+
+	s.rec.recordInput(data)
+	s.audit.input(data)
+
+	if s.input != nil {
+		data = s.input.filter(data, func(line string) {
+			log.Warn().Msgf("tty %s: command denied: %s", sid, line)
+			s.audit.write("denied", line)
+
+			msg := "\r\n*** command not allowed ***"
+			s.rec.output([]byte(msg))
+			cli.WriteMsg(proto.MsgTypeTermData, sid, msg)
+		})
+	}
+
+	s.termIn.Write(data)
 	s.active()
 
 	return nil
@@ -388,6 +1090,15 @@ func handleTermDataMsg(cli *RttyClient, data []byte) error {
 func handleTermWinsizeMsg(cli *RttyClient, data []byte) error {
 	sid := string(data[:32])
 
+	// Observers are read-only, exec sessions have no terminal
+	if _, ok := cli.observers.Load(sid); ok {
+		return nil
+	}
+
+	if _, ok := cli.execs.Load(sid); ok {
+		return nil
+	}
+
 	val, ok := cli.sessions.Load(sid)
 	if !ok {
 		log.Error().Msgf("terminal session %s not found", sid)
@@ -397,12 +1108,16 @@ func handleTermWinsizeMsg(cli *RttyClient, data []byte) error {
 	col := binary.BigEndian.Uint16(data[32:34])
 	row := binary.BigEndian.Uint16(data[34:36])
 
-	err := val.(*TermSession).term.SetWinSize(col, row)
+	s := val.(*TermSession)
+
+	err := s.term.SetWinSize(col, row)
 	if err != nil {
 		log.Error().Err(err).Msgf("failed to set terminal size for %s", sid)
 		return err
 	}
 
+	s.rec.resize(col, row)
+
 	log.Debug().Msgf("setting terminal %s size to %dx%d", sid, col, row)
 
 	return nil
@@ -411,6 +1126,15 @@ func handleTermWinsizeMsg(cli *RttyClient, data []byte) error {
 func handleAckMsg(cli *RttyClient, data []byte) error {
 	sid := string(data[:32])
 
+	// Observers are read-only, exec sessions have no terminal
+	if _, ok := cli.observers.Load(sid); ok {
+		return nil
+	}
+
+	if _, ok := cli.execs.Load(sid); ok {
+		return nil
+	}
+
 	val, ok := cli.sessions.Load(sid)
 	if !ok {
 		log.Error().Msgf("terminal session %s not found", sid)
@@ -423,12 +1147,44 @@ func handleAckMsg(cli *RttyClient, data []byte) error {
 }
 
 type TermSession struct {
-	cli   *RttyClient
-	sid   string
+	cli *RttyClient
+	sid string
+
+	// The options the terminal was started with, those of its profile if any
+	cfg     *Config
+	profile string
+
 	term  *Terminal
 	timer *time.Timer
 	mu    sync.Mutex
-	fc    *RttyFileContext
+	files *fileTransfers
+	rec   *castRecorder
+	audit *auditLog
+
+	// Limits the output rate, nil when unlimited
+	limiter *rate.Limiter
+
+	// Checks the command lines typed, nil when unrestricted
+	input *inputFilter
+
+	// The terminal, or what converts from and to its charset
+	termOut io.Reader
+	termIn  io.Writer
+
+	// The inactivity warning has been shown
+	warned bool
+
+	// sids watching the output, replaced rather than modified when changed
+	observers []string
+
+	// While the server is away the output goes to the backlog, which is
+	// replayed once the same sid logs in again
+	detached   bool
+	backlog    []byte
+	graceTimer *time.Timer
+
+	// The most recent output, replayed to whoever attaches
+	scrollback []byte
 }
 
 func (s *TermSession) Write(buf []byte) (int, error) {
@@ -436,40 +1192,365 @@ func (s *TermSession) Write(buf []byte) (int, error) {
 
 	s.active()
 
-	if s.fc.detect(buf) {
+	s.mu.Lock()
+	if s.detached {
+		s.backlog = appendTail(s.backlog, buf, rttySessionBacklog)
+		s.keepScrollback(buf)
+		s.mu.Unlock()
+		s.rec.output(buf)
+		s.audit.recordOutput(buf)
+		return length, nil
+	}
+	observers := s.observers
+	s.mu.Unlock()
+
+	if s.files.detect(buf) {
 		return length, nil
 	}
 
+	s.mu.Lock()
+	s.keepScrollback(buf)
+	s.mu.Unlock()
+
+	if s.limiter != nil {
+		waitRate(s.limiter, length)
+	}
+
+	s.rec.output(buf)
+	s.audit.recordOutput(buf)
+
 	s.cli.WriteMsg(proto.MsgTypeTermData, s.sid, buf)
 
+	for _, sid := range observers {
+		s.cli.WriteMsg(proto.MsgTypeTermData, sid, buf)
+	}
+
 	s.term.WaitAck(length)
 
 	return length, nil
 }
 
 func (s *TermSession) Run(cli *RttyClient) {
+	idle, _ := s.cfg.termTimeouts()
+
+	// No timeout, the terminal stays until logged out
+	if idle > 0 {
+		s.mu.Lock()
+		s.timer = time.AfterFunc(idle, s.idle)
+		s.mu.Unlock()
+	}
+
+	if err := s.copyOutput(time.Duration(cli.cfg.termCoalesce) * time.Millisecond); err != nil {
+		log.Error().Err(err).Msgf("error while copying terminal data for %s", s.sid)
+	}
+	s.close(cli)
+	s.files.reset()
+	s.files.close()
+	s.rec.Close()
+	s.audit.Close()
+	s.runHook(cli.cfg.onSessionEnd, "end")
+}
+
+const (
+	// Output is sent in one message once this much is gathered
+	termCoalesceSize = 16 * 1024
+
+	// The most terminal output a message can carry besides the sid
+	termDataMax = 0xffff - 32
+)
+
+// copyOutput writes the output of the terminal to the session. Reads that
+// follow each other within delay are written together, saving the overhead of
+// a message for each of the tiny reads typing and curses programs cause.
+func (s *TermSession) copyOutput(delay time.Duration) error {
+	buf := make([]byte, int(s.cli.cfg.termReadBuffer)*1024)
+
+	if delay == 0 {
+		_, err := io.CopyBuffer(s, s.termOut, buf)
+		return err
+	}
+
+	chunks := make(chan []byte)
+	errc := make(chan error, 1)
+
+	go func() {
+		defer close(chunks)
+
+		for {
+			n, err := s.termOut.Read(buf)
+			if n > 0 {
+				chunks <- slices.Clone(buf[:n])
+			}
+
+			if err != nil {
+				if err != io.EOF {
+					errc <- err
+				}
+				return
+			}
+		}
+	}()
+
+	var pending []byte
+
+	timer := time.NewTimer(delay)
+	timer.Stop()
+
+	flush := func() {
+		timer.Stop()
+		if len(pending) > 0 {
+			s.Write(pending)
+			pending = nil
+		}
+	}
+
+	for {
+		select {
+		case chunk, ok := <-chunks:
+			if !ok {
+				flush()
+				select {
+				case err := <-errc:
+					return err
+				default:
+					return nil
+				}
+			}
+
+			// It's only recognized when written as it was read
+			if isFileMagic(chunk) {
+				flush()
+				s.Write(chunk)
+				continue
+			}
+
+			if len(pending)+len(chunk) > termDataMax {
+				flush()
+			}
+
+			if len(pending) == 0 {
+				timer.Reset(delay)
+			}
+
+			pending = append(pending, chunk...)
+
+			if len(pending) >= termCoalesceSize {
+				flush()
+			}
+
+		case <-timer.C:
+			flush()
+		}
+	}
+}
+
+// detach keeps the session alive without a server for grace
+func (s *TermSession) detach(grace time.Duration) {
 	s.mu.Lock()
-	s.timer = time.AfterFunc(rttyTermTimeout, func() {
-		log.Info().Msgf("tty %s inactive over %v, now kill it", s.sid, rttyTermTimeout)
+	defer s.mu.Unlock()
+
+	if s.detached {
+		return
+	}
+
+	log.Info().Msgf("detach tty %s, kept for %v", s.sid, grace)
+
+	s.detached = true
+
+	s.graceTimer = time.AfterFunc(grace, func() {
+		log.Info().Msgf("tty %s not resumed within %v, now kill it", s.sid, grace)
 		s.term.Close()
 	})
+
+	// Nothing sent so far will be acknowledged anymore
+	s.term.ResetAck()
+}
+
+// attach resumes a detached session and replays its backlog
+func (s *TermSession) attach() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.detached || s.graceTimer == nil {
+		return false
+	}
+
+	if !s.graceTimer.Stop() {
+		// Too late, it's being killed
+		return false
+	}
+
+	s.graceTimer = nil
+
+	s.term.ResetAck()
+
+	// The viewer starts from a blank screen, give it some context
+	if s.cli.cfg.scrollback > 0 {
+		s.backlog = slices.Clone(s.scrollback)
+	}
+
+	go s.replay()
+
+	return true
+}
+
+// replay sends the backlog, the session only leaves the detached state once
+// it's empty so that new output can't overtake it.
+func (s *TermSession) replay() {
+	for {
+		s.mu.Lock()
+
+		if len(s.backlog) == 0 {
+			s.backlog = nil
+			s.detached = false
+			s.mu.Unlock()
+			return
+		}
+
+		n := min(len(s.backlog), 4096)
+		chunk := slices.Clone(s.backlog[:n])
+		s.backlog = s.backlog[n:]
+
+		s.mu.Unlock()
+
+		if err := s.cli.WriteMsg(proto.MsgTypeTermData, s.sid, chunk); err != nil {
+			return
+		}
+
+		s.term.WaitAck(n)
+	}
+}
+
+// observe lets sid watch the output of the session target without being
+// able to type into it. Only what is printed from now on is shown.
+func (cli *RttyClient) observe(sid, target string) error {
+	val, ok := cli.sessions.Load(target)
+	if !ok {
+		log.Error().Msgf("tty %s to observe not found", target)
+		return cli.WriteMsg(proto.MsgTypeLogin, sid, byte(1))
+	}
+
+	s := val.(*TermSession)
+
+	log.Info().Msgf("tty %s observed by %s", target, sid)
+
+	if err := cli.WriteMsg(proto.MsgTypeLogin, sid, byte(0)); err != nil {
+		return err
+	}
+
+	if err := cli.WriteMsg(proto.MsgTypeTermData, sid, "*** observing a terminal session, read-only ***\r\n"); err != nil {
+		return err
+	}
+
+	// Holding the lock keeps new output from overtaking the scrollback
+	s.mu.Lock()
+	for data := s.scrollback; len(data) > 0; {
+		n := min(len(data), 4096)
+		cli.WriteMsg(proto.MsgTypeTermData, sid, data[:n])
+		data = data[n:]
+	}
+	s.observers = append(slices.Clone(s.observers), sid)
 	s.mu.Unlock()
 
-	if _, err := io.Copy(s, s.term); err != nil {
-		log.Error().Err(err).Msgf("error while copying terminal data for %s", s.sid)
+	cli.observers.Store(sid, s)
+
+	return nil
+}
+
+func (s *TermSession) unobserve(sid string) {
+	s.mu.Lock()
+	s.observers = slices.DeleteFunc(slices.Clone(s.observers), func(o string) bool {
+		return o == sid
+	})
+	s.mu.Unlock()
+}
+
+// keepScrollback adds to the scrollback, called with s.mu held
+func (s *TermSession) keepScrollback(buf []byte) {
+	if size := int(s.cli.cfg.scrollback) * 1024; size > 0 {
+		s.scrollback = appendTail(s.scrollback, buf, size)
+	}
+}
+
+// appendTail appends data to b, dropping the oldest beyond size
+func appendTail(b, data []byte, size int) []byte {
+	b = append(b, data...)
+	if len(b) > size {
+		b = b[len(b)-size:]
+	}
+	return b
+}
+
+// dropObservers logs out the observers of a session that is gone
+func (s *TermSession) dropObservers() {
+	s.mu.Lock()
+	observers := s.observers
+	s.observers = nil
+	s.mu.Unlock()
+
+	for _, sid := range observers {
+		s.cli.observers.Delete(sid)
+		s.cli.WriteMsg(proto.MsgTypeLogout, sid)
 	}
-	s.close(cli)
 }
 
 func (s *TermSession) active() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	s.warned = false
+
 	if s.timer != nil {
-		s.timer.Reset(rttyTermTimeout)
+		idle, _ := s.cfg.termTimeouts()
+		s.timer.Reset(idle)
 	}
 }
 
+// idle warns the user first if configured, and kills the terminal when it
+// stays inactive after that
+func (s *TermSession) idle() {
+	_, warn := s.cfg.termTimeouts()
+
+	s.mu.Lock()
+
+	if s.timer == nil {
+		s.mu.Unlock()
+		return
+	}
+
+	if warn > 0 && !s.warned {
+		s.warned = true
+		s.timer.Reset(warn)
+		detached := s.detached
+		s.mu.Unlock()
+
+		if !detached {
+			msg := fmt.Sprintf("\r\n*** session will close in %v due to inactivity, press any key ***\r\n", warn)
+			s.rec.output([]byte(msg))
+			s.cli.WriteMsg(proto.MsgTypeTermData, s.sid, msg)
+		}
+		return
+	}
+
+	s.mu.Unlock()
+
+	log.Info().Msgf("tty %s inactive over %v, now kill it", s.sid, time.Duration(s.cfg.termTimeout)*time.Second)
+	s.term.Close()
+}
+
+// termTimeouts splits the inactivity timeout into the time until the warning
+// and the time from the warning until the terminal is closed
+func (cfg *Config) termTimeouts() (idle, warn time.Duration) {
+	timeout := time.Duration(cfg.termTimeout) * time.Second
+	warn = time.Duration(cfg.termTimeoutWarning) * time.Second
+
+	if warn >= timeout {
+		warn = 0
+	}
+
+	return timeout - warn, warn
+}
+
 func (s *TermSession) close(cli *RttyClient) {
 	if _, loaded := cli.sessions.LoadAndDelete(s.sid); !loaded {
 		return
@@ -487,6 +1568,8 @@ func (s *TermSession) close(cli *RttyClient) {
 	cli.ntty--
 	s.mu.Unlock()
 
+	s.dropObservers()
+
 	log.Info().Msgf("delete tty %s", s.sid)
 }
 
@@ -524,3 +1607,28 @@ func putMsgAttr(bb *bytebufferpool.ByteBuffer, attrType byte, val any) {
 
 	binary.BigEndian.PutUint16(bb.B[lengthPos:], uint16(length))
 }
+
+// parseMsgAttrs walks the type-length-value attributes encoded by putMsgAttr
+func parseMsgAttrs(data []byte, fn func(attrType byte, val []byte) error) error {
+	for len(data) > 0 {
+		if len(data) < 3 {
+			return fmt.Errorf("truncated attribute")
+		}
+
+		attrType := data[0]
+		length := int(binary.BigEndian.Uint16(data[1:3]))
+		data = data[3:]
+
+		if len(data) < length {
+			return fmt.Errorf("truncated attribute %d", attrType)
+		}
+
+		if err := fn(attrType, data[:length]); err != nil {
+			return err
+		}
+
+		data = data[length:]
+	}
+
+	return nil
+}
@@ -0,0 +1,116 @@
+//go:build linux
+// +build linux
+
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+var serialSpeeds = map[uint]uint32{
+	1200:    unix.B1200,
+	2400:    unix.B2400,
+	4800:    unix.B4800,
+	9600:    unix.B9600,
+	19200:   unix.B19200,
+	38400:   unix.B38400,
+	57600:   unix.B57600,
+	115200:  unix.B115200,
+	230400:  unix.B230400,
+	460800:  unix.B460800,
+	921600:  unix.B921600,
+	1500000: unix.B1500000,
+	3000000: unix.B3000000,
+}
+
+func checkSerialConfig(cfg *Config) error {
+	if _, ok := serialSpeeds[cfg.serialBaud]; !ok {
+		return fmt.Errorf("invalid serial baud rate: %d", cfg.serialBaud)
+	}
+
+	switch cfg.serialParity {
+	case "none", "odd", "even":
+	default:
+		return fmt.Errorf("invalid serial parity: %s, must be one of none, odd, even", cfg.serialParity)
+	}
+
+	return nil
+}
+
+// newSerialTerminal connects the terminal to the serial port in raw mode,
+// 8 data bits and 1 stop bit, whatever is attached to it does the echoing.
+func newSerialTerminal(cfg *Config) (*Terminal, error) {
+	f, err := os.OpenFile(cfg.serial, os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	// Not f.Fd(), which would stop Close from interrupting a blocked Read
+	rc, err := f.SyscallConn()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	rc.Control(func(fd uintptr) {
+		err = setupSerial(int(fd), cfg)
+	})
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &Terminal{
+		backend:   fmt.Sprintf("%s %d %s", cfg.serial, cfg.serialBaud, cfg.serialParity),
+		pty:       f,
+		ack_block: int32(cfg.termAckWindow) * 1024,
+		cond:      sync.NewCond(&sync.Mutex{}),
+		waitDone:  make(chan struct{}),
+	}, nil
+}
+
+func setupSerial(fd int, cfg *Config) error {
+	// A serial port serves a single terminal at a time
+	if err := unix.Flock(fd, unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		return fmt.Errorf("serial port %s is in use", cfg.serial)
+	}
+
+	tio, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return err
+	}
+
+	speed := serialSpeeds[cfg.serialBaud]
+
+	tio.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR |
+		unix.IGNCR | unix.ICRNL | unix.IXON | unix.IXOFF | unix.INPCK
+	tio.Oflag &^= unix.OPOST
+	tio.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	tio.Cflag &^= unix.CSIZE | unix.PARENB | unix.PARODD | unix.CSTOPB | unix.CRTSCTS | unix.CBAUD
+	tio.Cflag |= unix.CS8 | unix.CREAD | unix.CLOCAL | speed
+
+	switch cfg.serialParity {
+	case "odd":
+		tio.Cflag |= unix.PARENB | unix.PARODD
+		tio.Iflag |= unix.INPCK
+	case "even":
+		tio.Cflag |= unix.PARENB
+		tio.Iflag |= unix.INPCK
+	}
+
+	tio.Ispeed = speed
+	tio.Ospeed = speed
+	tio.Cc[unix.VMIN] = 1
+	tio.Cc[unix.VTIME] = 0
+
+	return unix.IoctlSetTermios(fd, unix.TCSETS, tio)
+}
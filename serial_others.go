@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package main
+
+import "fmt"
+
+func checkSerialConfig(cfg *Config) error {
+	return fmt.Errorf("serial is only supported on Linux")
+}
+
+func newSerialTerminal(cfg *Config) (*Terminal, error) {
+	return nil, fmt.Errorf("serial is only supported on Linux")
+}
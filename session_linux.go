@@ -0,0 +1,67 @@
+//go:build linux
+// +build linux
+
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// killSession kills every process of the session sid. Background jobs of a
+// shell with job control each have their own process group, so killing the
+// group of the shell isn't enough.
+func killSession(sid int) {
+	syscall.Kill(-sid, syscall.SIGKILL)
+
+	for pid := range sessionProcs(sid) {
+		syscall.Kill(pid, syscall.SIGKILL)
+	}
+}
+
+// sessionProcs returns the command names of the processes of the session sid
+// by pid
+func sessionProcs(sid int) map[int]string {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+
+	procs := make(map[int]string)
+
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+
+		stat, err := os.ReadFile("/proc/" + entry.Name() + "/stat")
+		if err != nil {
+			continue
+		}
+
+		// The command in parentheses may contain spaces, the session is
+		// the fourth field after it: state ppid pgrp session
+		i := strings.IndexByte(string(stat), '(')
+		j := strings.LastIndexByte(string(stat), ')')
+		if i < 0 || j < i {
+			continue
+		}
+
+		fields := strings.Fields(string(stat[j+1:]))
+		if len(fields) < 4 || fields[3] != strconv.Itoa(sid) {
+			continue
+		}
+
+		procs[pid] = string(stat[i+1 : j])
+	}
+
+	return procs
+}
@@ -0,0 +1,151 @@
+//go:build linux
+// +build linux
+
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// procGone tells whether pid exited, a zombie nobody reaps counts as gone
+func procGone(pid int) bool {
+	stat, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return true
+	}
+
+	fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+
+	return len(fields) > 0 && fields[0] == "Z"
+}
+
+func waitProcGone(t *testing.T, pid int) {
+	t.Helper()
+
+	for range 100 {
+		if procGone(pid) {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	syscall.Kill(pid, syscall.SIGKILL)
+	t.Fatalf("process %d outlived the terminal", pid)
+}
+
+func TestTerminalCloseKillsJobs(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+	}{
+		// Killed with the process group of the shell
+		{"same group", "sleep 1000 & echo pid=$!; wait"},
+		// With job control the job has a group of its own, only the scan
+		// of the session finds it
+		{"own group", "set -m; sleep 1000 & echo pid=$!; wait"},
+	}
+
+	re := regexp.MustCompile(`pid=(\d+)`)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{
+				shell:     "/bin/sh",
+				shellArgs: []string{"-c", tt.script},
+				term:      "xterm",
+				termCols:  80,
+				termRows:  24,
+			}
+
+			term, err := NewTerminal(cfg, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var out []byte
+			var m [][]byte
+
+			buf := make([]byte, 256)
+
+			for m == nil {
+				n, err := term.Read(buf)
+				if err != nil {
+					term.Close()
+					t.Fatalf("no pid in %q: %v", out, err)
+				}
+				out = append(out, buf[:n]...)
+				m = re.FindSubmatch(out)
+			}
+
+			pid, _ := strconv.Atoi(string(m[1]))
+
+			if procGone(pid) {
+				t.Fatalf("job %d not running", pid)
+			}
+
+			term.Close()
+
+			waitProcGone(t, pid)
+		})
+	}
+}
+
+func TestSessionProcs(t *testing.T) {
+	cmd := exec.Command("/bin/sh", "-c", "set -m; sleep 1000 & echo $!; wait")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	go cmd.Wait()
+
+	var line [32]byte
+
+	n, _ := out.Read(line[:])
+
+	job, err := strconv.Atoi(strings.TrimSpace(string(line[:n])))
+	if err != nil {
+		killSession(cmd.Process.Pid)
+		t.Fatalf("no pid in %q", line[:n])
+	}
+
+	sid := cmd.Process.Pid
+
+	// The job may not have run sleep yet
+	var procs map[int]string
+
+	for range 100 {
+		procs = sessionProcs(sid)
+		if procs[job] == "sleep" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if procs[sid] != "sh" || procs[job] != "sleep" {
+		killSession(sid)
+		t.Fatalf("got %v, want sh %d and sleep %d", procs, sid, job)
+	}
+
+	killSession(sid)
+
+	waitProcGone(t, sid)
+	waitProcGone(t, job)
+}
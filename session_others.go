@@ -0,0 +1,17 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package main
+
+import "syscall"
+
+// killSession kills the process group of the session leader sid, processes
+// moved to groups of their own are out of reach.
+func killSession(sid int) {
+	syscall.Kill(-sid, syscall.SIGKILL)
+}
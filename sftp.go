@@ -0,0 +1,822 @@
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/valyala/bytebufferpool"
+	"github.com/zhaojh329/rtty-go/proto"
+)
+
+// The part of SFTP version 3(draft-ietf-secsh-filexfer-02) served, enough to
+// browse, download, upload and delete files. Other requests are answered
+// with SSH_FX_OP_UNSUPPORTED.
+const (
+	sftpInit     = 1
+	sftpVersion  = 2
+	sftpOpen     = 3
+	sftpClose    = 4
+	sftpRead     = 5
+	sftpWrite    = 6
+	sftpLstat    = 7
+	sftpFstat    = 8
+	sftpOpendir  = 11
+	sftpReaddir  = 12
+	sftpRemove   = 13
+	sftpMkdir    = 14
+	sftpRmdir    = 15
+	sftpRealpath = 16
+	sftpStat     = 17
+	sftpStatus   = 101
+	sftpHandle   = 102
+	sftpData     = 103
+	sftpName     = 104
+	sftpAttrs    = 105
+)
+
+const (
+	sftpOK               = 0
+	sftpEOF              = 1
+	sftpNoSuchFile       = 2
+	sftpPermissionDenied = 3
+	sftpFailure          = 4
+	sftpBadMessage       = 5
+	sftpOpUnsupported    = 8
+)
+
+const (
+	sftpFlagRead   = 0x01
+	sftpFlagWrite  = 0x02
+	sftpFlagAppend = 0x04
+	sftpFlagCreat  = 0x08
+	sftpFlagTrunc  = 0x10
+	sftpFlagExcl   = 0x20
+)
+
+const (
+	sftpAttrSize        = 0x00000001
+	sftpAttrUidGid      = 0x00000002
+	sftpAttrPermissions = 0x00000004
+	sftpAttrAcModTime   = 0x00000008
+	sftpAttrExtended    = 0x80000000
+)
+
+const (
+	// Largest packet taken from the client, a write of 32KB and then some
+	sftpMaxPacket = 256 * 1024
+	// Largest read answered, clients ask for less or read again
+	sftpMaxRead = 32 * 1024
+	// Entries returned by one READDIR
+	sftpReaddirCount = 64
+	// Files and directories a channel may keep open
+	sftpMaxHandles = 256
+	// Bytes of the stream sent in one message
+	sftpMsgChunk = 32 * 1024
+)
+
+// An SFTP session opened by the server. Sftp messages carry the id of the
+// channel then the bytes of the SFTP stream, an empty one closes it.
+type RttySftpChannel struct {
+	cli     *RttyClient
+	id      [4]byte
+	data    chan *bytebufferpool.ByteBuffer
+	pending []byte
+	ctx     context.Context
+	cancel  context.CancelFunc
+
+	root    *os.Root
+	handles map[string]*sftpFile
+	next    uint64
+}
+
+type sftpFile struct {
+	file   *os.File
+	dir    bool
+	append bool
+}
+
+func checkSftpConfig(cfg *Config) error {
+	if !cfg.sftp {
+		return nil
+	}
+
+	if cfg.sftpRoot != "" && !filepath.IsAbs(cfg.sftpRoot) {
+		return fmt.Errorf("invalid sftp-root: %s, must be an absolute path", cfg.sftpRoot)
+	}
+
+	// Files are accessed as rtty, which would let root in through the back door
+	if cfg.noRoot && os.Geteuid() == 0 {
+		return fmt.Errorf("sftp is not supported with no-root when running as root")
+	}
+
+	return nil
+}
+
+func handleSftpMsg(cli *RttyClient, data []byte) error {
+	var id [4]byte
+
+	copy(id[:], data[:4])
+	data = data[4:]
+
+	if !cli.cfg.sftp {
+		log.Debug().Msg("sftp is disabled")
+		if len(data) > 0 {
+			cli.SendSftpMsg(id, nil)
+		}
+		return nil
+	}
+
+	if v, ok := cli.sftpChans.Load(id); ok {
+		c := v.(*RttySftpChannel)
+
+		if len(data) == 0 {
+			c.cancel()
+			return nil
+		}
+
+		bb := bytebufferpool.Get()
+		bb.Write(data)
+
+		select {
+		case c.data <- bb:
+		case <-c.ctx.Done():
+			bytebufferpool.Put(bb)
+		}
+
+		return nil
+	}
+
+	if len(data) == 0 {
+		return nil
+	}
+
+	dir := cli.cfg.sftpRoot
+	if dir == "" {
+		dir = "/"
+	}
+
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to open sftp root")
+		cli.SendSftpMsg(id, nil)
+		return nil
+	}
+
+	c := &RttySftpChannel{
+		cli:     cli,
+		id:      id,
+		data:    make(chan *bytebufferpool.ByteBuffer, 100),
+		root:    root,
+		handles: make(map[string]*sftpFile),
+	}
+
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+
+	bb := bytebufferpool.Get()
+	bb.Write(data)
+	c.data <- bb
+
+	cli.sftpChans.Store(id, c)
+
+	log.Debug().Msgf("sftp channel %x opened", id)
+
+	go c.run()
+
+	return nil
+}
+
+func (cli *RttyClient) SendSftpMsg(id [4]byte, data []byte) error {
+	return cli.WriteMsg(proto.MsgTypeSftp, id[:], data)
+}
+
+// Read gives the serving loop the stream received from the server
+func (c *RttySftpChannel) Read(b []byte) (int, error) {
+	if len(c.pending) == 0 {
+		select {
+		case bb := <-c.data:
+			c.pending = append(c.pending[:0], bb.B...)
+			bytebufferpool.Put(bb)
+		case <-c.ctx.Done():
+			return 0, io.EOF
+		}
+	}
+
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+
+	return n, nil
+}
+
+func (c *RttySftpChannel) run() {
+	defer func() {
+		for _, h := range c.handles {
+			h.file.Close()
+		}
+		c.root.Close()
+
+		c.cli.sftpChans.Delete(c.id)
+
+		// Closed by the server, or to be told to the server
+		if c.ctx.Err() == nil {
+			c.cancel()
+			c.cli.SendSftpMsg(c.id, nil)
+		}
+
+		log.Debug().Msgf("sftp channel %x closed", c.id)
+	}()
+
+	var head [4]byte
+
+	for {
+		if _, err := io.ReadFull(c, head[:]); err != nil {
+			return
+		}
+
+		n := binary.BigEndian.Uint32(head[:])
+		if n < 1 || n > sftpMaxPacket {
+			log.Error().Msgf("sftp channel %x: invalid packet length %d", c.id, n)
+			return
+		}
+
+		pkt := make([]byte, n)
+
+		if _, err := io.ReadFull(c, pkt); err != nil {
+			return
+		}
+
+		if err := c.write(c.handle(pkt)); err != nil {
+			log.Error().Err(err).Msgf("sftp channel %x: send fail", c.id)
+			return
+		}
+	}
+}
+
+// write sends a packet, in as many messages as it takes
+func (c *RttySftpChannel) write(pkt []byte) error {
+	pkt = append(binary.BigEndian.AppendUint32(nil, uint32(len(pkt))), pkt...)
+
+	for len(pkt) > 0 {
+		n := min(len(pkt), sftpMsgChunk)
+		if err := c.cli.SendSftpMsg(c.id, pkt[:n]); err != nil {
+			return err
+		}
+		pkt = pkt[n:]
+	}
+
+	return nil
+}
+
+func (c *RttySftpChannel) handle(pkt []byte) []byte {
+	typ := pkt[0]
+	r := &sftpReader{b: pkt[1:]}
+
+	if typ == sftpInit {
+		return binary.BigEndian.AppendUint32([]byte{sftpVersion}, 3)
+	}
+
+	id := r.uint32()
+	if r.bad {
+		return sftpStatusPacket(0, sftpBadMessage, "bad message")
+	}
+
+	var resp []byte
+
+	switch typ {
+	case sftpRealpath:
+		name := "/" + c.relPath(r.string())
+		if name == "/." {
+			name = "/"
+		}
+		resp = sftpNamePacket(id, []sftpNameEntry{{name: name, longname: name}})
+
+	case sftpStat, sftpLstat:
+		name := c.relPath(r.string())
+
+		var info os.FileInfo
+		var err error
+
+		if typ == sftpStat {
+			info, err = c.root.Stat(name)
+		} else {
+			info, err = c.root.Lstat(name)
+		}
+
+		if err != nil {
+			resp = sftpErrorPacket(id, err)
+		} else {
+			resp = sftpAttrsPacket(id, info)
+		}
+
+	case sftpFstat:
+		h := c.handles[r.string()]
+		if h == nil {
+			resp = sftpStatusPacket(id, sftpFailure, "invalid handle")
+			break
+		}
+
+		info, err := h.file.Stat()
+		if err != nil {
+			resp = sftpErrorPacket(id, err)
+		} else {
+			resp = sftpAttrsPacket(id, info)
+		}
+
+	case sftpOpendir:
+		resp = c.opendir(id, c.relPath(r.string()))
+
+	case sftpReaddir:
+		resp = c.readdir(id, r.string())
+
+	case sftpOpen:
+		name := c.relPath(r.string())
+		pflags := r.uint32()
+		attrs := r.attrs()
+		if r.bad {
+			break
+		}
+		resp = c.open(id, name, pflags, attrs)
+
+	case sftpRead:
+		handle := r.string()
+		offset := r.uint64()
+		length := r.uint32()
+		if r.bad {
+			break
+		}
+		resp = c.read(id, handle, int64(offset), length)
+
+	case sftpWrite:
+		handle := r.string()
+		offset := r.uint64()
+		data := r.bytes()
+		if r.bad {
+			break
+		}
+		resp = c.writeFile(id, handle, int64(offset), data)
+
+	case sftpClose:
+		handle := r.string()
+
+		h := c.handles[handle]
+		if h == nil {
+			resp = sftpStatusPacket(id, sftpFailure, "invalid handle")
+			break
+		}
+
+		delete(c.handles, handle)
+
+		if err := h.file.Close(); err != nil {
+			resp = sftpErrorPacket(id, err)
+		} else {
+			resp = sftpStatusPacket(id, sftpOK, "")
+		}
+
+	case sftpRemove:
+		resp = c.remove(id, c.relPath(r.string()), false)
+
+	case sftpRmdir:
+		resp = c.remove(id, c.relPath(r.string()), true)
+
+	case sftpMkdir:
+		name := c.relPath(r.string())
+		attrs := r.attrs()
+		if r.bad {
+			break
+		}
+
+		perm := os.FileMode(0755)
+		if attrs.flags&sftpAttrPermissions != 0 {
+			perm = os.FileMode(attrs.perm & 0777)
+		}
+
+		if err := c.root.Mkdir(name, perm); err != nil {
+			resp = sftpErrorPacket(id, err)
+		} else {
+			resp = sftpStatusPacket(id, sftpOK, "")
+		}
+
+	default:
+		log.Debug().Msgf("sftp channel %x: unsupported request %d", c.id, typ)
+		resp = sftpStatusPacket(id, sftpOpUnsupported, "unsupported")
+	}
+
+	if r.bad {
+		return sftpStatusPacket(id, sftpBadMessage, "bad message")
+	}
+
+	return resp
+}
+
+// relPath turns the path of the client, taken from the root as the working
+// directory is, into one within the root. Leaving the root is left to
+// os.Root to refuse, as it follows symbolic links.
+func (c *RttySftpChannel) relPath(name string) string {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if name == "" {
+		return "."
+	}
+	return filepath.FromSlash(name)
+}
+
+func (c *RttySftpChannel) addHandle(id uint32, h *sftpFile) []byte {
+	if len(c.handles) >= sftpMaxHandles {
+		h.file.Close()
+		return sftpStatusPacket(id, sftpFailure, "too many open handles")
+	}
+
+	c.next++
+	handle := strconv.FormatUint(c.next, 10)
+	c.handles[handle] = h
+
+	resp := binary.BigEndian.AppendUint32([]byte{sftpHandle}, id)
+	return sftpAppendString(resp, handle)
+}
+
+func (c *RttySftpChannel) opendir(id uint32, name string) []byte {
+	f, err := c.root.Open(name)
+	if err != nil {
+		return sftpErrorPacket(id, err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return sftpErrorPacket(id, err)
+	}
+
+	if !info.IsDir() {
+		f.Close()
+		return sftpStatusPacket(id, sftpFailure, "not a directory")
+	}
+
+	return c.addHandle(id, &sftpFile{file: f, dir: true})
+}
+
+func (c *RttySftpChannel) readdir(id uint32, handle string) []byte {
+	h := c.handles[handle]
+	if h == nil || !h.dir {
+		return sftpStatusPacket(id, sftpFailure, "invalid handle")
+	}
+
+	infos, err := h.file.Readdir(sftpReaddirCount)
+	if len(infos) == 0 {
+		if err == nil || errors.Is(err, io.EOF) {
+			return sftpStatusPacket(id, sftpEOF, "")
+		}
+		return sftpErrorPacket(id, err)
+	}
+
+	entries := make([]sftpNameEntry, len(infos))
+
+	for i, info := range infos {
+		entries[i] = sftpNameEntry{name: info.Name(), longname: sftpLongname(info), info: info}
+	}
+
+	return sftpNamePacket(id, entries)
+}
+
+func (c *RttySftpChannel) open(id uint32, name string, pflags uint32, attrs sftpFileAttrs) []byte {
+	var flag int
+
+	switch {
+	case pflags&sftpFlagRead != 0 && pflags&sftpFlagWrite != 0:
+		flag = os.O_RDWR
+	case pflags&sftpFlagWrite != 0:
+		flag = os.O_WRONLY
+	default:
+		flag = os.O_RDONLY
+	}
+
+	if pflags&sftpFlagAppend != 0 {
+		flag |= os.O_APPEND
+	}
+
+	if pflags&sftpFlagCreat != 0 {
+		flag |= os.O_CREATE
+	}
+
+	if pflags&sftpFlagTrunc != 0 {
+		flag |= os.O_TRUNC
+	}
+
+	if pflags&sftpFlagExcl != 0 {
+		flag |= os.O_EXCL
+	}
+
+	perm := os.FileMode(0644)
+	if attrs.flags&sftpAttrPermissions != 0 {
+		perm = os.FileMode(attrs.perm & 0777)
+	}
+
+	f, err := c.root.OpenFile(name, flag, perm)
+	if err != nil {
+		return sftpErrorPacket(id, err)
+	}
+
+	return c.addHandle(id, &sftpFile{file: f, append: flag&os.O_APPEND != 0})
+}
+
+func (c *RttySftpChannel) read(id uint32, handle string, offset int64, length uint32) []byte {
+	h := c.handles[handle]
+	if h == nil || h.dir {
+		return sftpStatusPacket(id, sftpFailure, "invalid handle")
+	}
+
+	buf := make([]byte, min(length, sftpMaxRead))
+
+	n, err := h.file.ReadAt(buf, offset)
+	if n == 0 {
+		if err == nil || errors.Is(err, io.EOF) {
+			return sftpStatusPacket(id, sftpEOF, "")
+		}
+		return sftpErrorPacket(id, err)
+	}
+
+	resp := binary.BigEndian.AppendUint32([]byte{sftpData}, id)
+	return sftpAppendString(resp, string(buf[:n]))
+}
+
+func (c *RttySftpChannel) writeFile(id uint32, handle string, offset int64, data []byte) []byte {
+	h := c.handles[handle]
+	if h == nil || h.dir {
+		return sftpStatusPacket(id, sftpFailure, "invalid handle")
+	}
+
+	var err error
+
+	// Files opened to append can't be written at an offset
+	if h.append {
+		_, err = h.file.Write(data)
+	} else {
+		_, err = h.file.WriteAt(data, offset)
+	}
+
+	if err != nil {
+		return sftpErrorPacket(id, err)
+	}
+
+	return sftpStatusPacket(id, sftpOK, "")
+}
+
+// remove deletes a file, or an empty directory for RMDIR
+func (c *RttySftpChannel) remove(id uint32, name string, dir bool) []byte {
+	info, err := c.root.Lstat(name)
+	if err != nil {
+		return sftpErrorPacket(id, err)
+	}
+
+	if info.IsDir() != dir {
+		if dir {
+			return sftpStatusPacket(id, sftpFailure, "not a directory")
+		}
+		return sftpStatusPacket(id, sftpFailure, "is a directory")
+	}
+
+	if err := c.root.Remove(name); err != nil {
+		return sftpErrorPacket(id, err)
+	}
+
+	return sftpStatusPacket(id, sftpOK, "")
+}
+
+type sftpReader struct {
+	b   []byte
+	bad bool
+}
+
+func (r *sftpReader) uint32() uint32 {
+	if len(r.b) < 4 {
+		r.bad = true
+		return 0
+	}
+
+	v := binary.BigEndian.Uint32(r.b)
+	r.b = r.b[4:]
+
+	return v
+}
+
+func (r *sftpReader) uint64() uint64 {
+	if len(r.b) < 8 {
+		r.bad = true
+		return 0
+	}
+
+	v := binary.BigEndian.Uint64(r.b)
+	r.b = r.b[8:]
+
+	return v
+}
+
+func (r *sftpReader) bytes() []byte {
+	n := r.uint32()
+	if r.bad || uint32(len(r.b)) < n {
+		r.bad = true
+		return nil
+	}
+
+	v := r.b[:n]
+	r.b = r.b[n:]
+
+	return v
+}
+
+func (r *sftpReader) string() string {
+	return string(r.bytes())
+}
+
+type sftpFileAttrs struct {
+	flags uint32
+	perm  uint32
+}
+
+// attrs parses the attributes of a request, of which only the permissions
+// are used
+func (r *sftpReader) attrs() sftpFileAttrs {
+	var a sftpFileAttrs
+
+	a.flags = r.uint32()
+
+	if a.flags&sftpAttrSize != 0 {
+		r.uint64()
+	}
+
+	if a.flags&sftpAttrUidGid != 0 {
+		r.uint32()
+		r.uint32()
+	}
+
+	if a.flags&sftpAttrPermissions != 0 {
+		a.perm = r.uint32()
+	}
+
+	if a.flags&sftpAttrAcModTime != 0 {
+		r.uint32()
+		r.uint32()
+	}
+
+	if a.flags&sftpAttrExtended != 0 {
+		for n := r.uint32(); n > 0 && !r.bad; n-- {
+			r.bytes()
+			r.bytes()
+		}
+	}
+
+	return a
+}
+
+func sftpAppendString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(len(s)))
+	return append(b, s...)
+}
+
+func sftpStatusPacket(id uint32, code uint32, msg string) []byte {
+	b := binary.BigEndian.AppendUint32([]byte{sftpStatus}, id)
+	b = binary.BigEndian.AppendUint32(b, code)
+	b = sftpAppendString(b, msg)
+	return sftpAppendString(b, "")
+}
+
+func sftpErrorPacket(id uint32, err error) []byte {
+	code := uint32(sftpFailure)
+
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		code = sftpNoSuchFile
+	case errors.Is(err, fs.ErrPermission):
+		code = sftpPermissionDenied
+	}
+
+	return sftpStatusPacket(id, code, err.Error())
+}
+
+func sftpAttrsPacket(id uint32, info os.FileInfo) []byte {
+	b := binary.BigEndian.AppendUint32([]byte{sftpAttrs}, id)
+	return sftpAppendAttrs(b, info)
+}
+
+type sftpNameEntry struct {
+	name     string
+	longname string
+	info     os.FileInfo
+}
+
+func sftpNamePacket(id uint32, entries []sftpNameEntry) []byte {
+	b := binary.BigEndian.AppendUint32([]byte{sftpName}, id)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(entries)))
+
+	for _, e := range entries {
+		b = sftpAppendString(b, e.name)
+		b = sftpAppendString(b, e.longname)
+		b = sftpAppendAttrs(b, e.info)
+	}
+
+	return b
+}
+
+// sftpAppendAttrs appends the size, permissions and times of info, or no
+// attributes without it
+func sftpAppendAttrs(b []byte, info os.FileInfo) []byte {
+	if info == nil {
+		return binary.BigEndian.AppendUint32(b, 0)
+	}
+
+	b = binary.BigEndian.AppendUint32(b, sftpAttrSize|sftpAttrPermissions|sftpAttrAcModTime)
+	b = binary.BigEndian.AppendUint64(b, uint64(info.Size()))
+	b = binary.BigEndian.AppendUint32(b, sftpFileMode(info.Mode()))
+
+	mtime := uint32(info.ModTime().Unix())
+
+	b = binary.BigEndian.AppendUint32(b, mtime)
+	return binary.BigEndian.AppendUint32(b, mtime)
+}
+
+// sftpFileMode returns mode the way stat(2) gives it, which clients expect
+func sftpFileMode(mode os.FileMode) uint32 {
+	m := uint32(mode.Perm())
+
+	switch {
+	case mode.IsDir():
+		m |= 0040000
+	case mode&os.ModeSymlink != 0:
+		m |= 0120000
+	case mode&os.ModeNamedPipe != 0:
+		m |= 0010000
+	case mode&os.ModeSocket != 0:
+		m |= 0140000
+	case mode&os.ModeCharDevice != 0:
+		m |= 0020000
+	case mode&os.ModeDevice != 0:
+		m |= 0060000
+	default:
+		m |= 0100000
+	}
+
+	if mode&os.ModeSetuid != 0 {
+		m |= 04000
+	}
+
+	if mode&os.ModeSetgid != 0 {
+		m |= 02000
+	}
+
+	if mode&os.ModeSticky != 0 {
+		m |= 01000
+	}
+
+	return m
+}
+
+// sftpLongname formats an entry the way ls -l does, which some clients show
+// as is
+func sftpLongname(info os.FileInfo) string {
+	mode := info.Mode()
+
+	typ := '-'
+
+	switch {
+	case mode.IsDir():
+		typ = 'd'
+	case mode&os.ModeSymlink != 0:
+		typ = 'l'
+	case mode&os.ModeNamedPipe != 0:
+		typ = 'p'
+	case mode&os.ModeSocket != 0:
+		typ = 's'
+	case mode&os.ModeCharDevice != 0:
+		typ = 'c'
+	case mode&os.ModeDevice != 0:
+		typ = 'b'
+	}
+
+	owner, group, _ := strings.Cut(fileOwner(info), ":")
+	if owner == "" {
+		owner, group = "-", "-"
+	}
+
+	mtime := info.ModTime()
+
+	layout := "Jan _2 15:04"
+	if time.Since(mtime).Abs() > 180*24*time.Hour {
+		layout = "Jan _2  2006"
+	}
+
+	return fmt.Sprintf("%c%s 1 %-8s %-8s %8d %s %s", typ, mode.Perm().String()[1:],
+		owner, group, info.Size(), mtime.Format(layout), info.Name())
+}
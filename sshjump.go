@@ -0,0 +1,257 @@
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sshJumpDialer reaches the server through a direct-tcpip channel of an
+// SSH connection to a bastion host.
+type sshJumpDialer struct {
+	addr    string
+	config  *ssh.ClientConfig
+	forward contextDialer
+}
+
+// sshTunnelConn is a channel of the connection to the jump host, whose
+// deadlines ssh doesn't take. The channel is read in the background for
+// reads to give up at their deadline. A write past its deadline closes the
+// tunnel, what the server got of it is cut anyway.
+type sshTunnelConn struct {
+	net.Conn
+	client *ssh.Client
+
+	data    chan []byte
+	pending []byte
+	err     error // the channel ended with, once data is closed
+	closed  chan struct{}
+	once    sync.Once
+
+	mu            sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func newSSHTunnelConn(conn net.Conn, client *ssh.Client) *sshTunnelConn {
+	c := &sshTunnelConn{
+		Conn:   conn,
+		client: client,
+		data:   make(chan []byte),
+		closed: make(chan struct{}),
+	}
+
+	go c.readLoop()
+
+	return c
+}
+
+func (c *sshTunnelConn) readLoop() {
+	defer close(c.data)
+
+	for {
+		buf := make([]byte, 32*1024)
+
+		n, err := c.Conn.Read(buf)
+		if n > 0 {
+			select {
+			case c.data <- buf[:n]:
+			case <-c.closed:
+				return
+			}
+		}
+
+		if err != nil {
+			c.err = err
+			return
+		}
+	}
+}
+
+// deadlineTimer returns a channel receiving once deadline passed, nil for
+// none, and the function releasing it
+func deadlineTimer(deadline time.Time) (<-chan time.Time, func() bool) {
+	if deadline.IsZero() {
+		return nil, func() bool { return false }
+	}
+
+	timer := time.NewTimer(time.Until(deadline))
+
+	return timer.C, timer.Stop
+}
+
+func (c *sshTunnelConn) Read(b []byte) (int, error) {
+	if len(c.pending) == 0 {
+		c.mu.Lock()
+		timeout, stop := deadlineTimer(c.readDeadline)
+		c.mu.Unlock()
+
+		defer stop()
+
+		select {
+		case data, ok := <-c.data:
+			if !ok {
+				return 0, c.err
+			}
+			c.pending = data
+		case <-c.closed:
+			return 0, net.ErrClosed
+		case <-timeout:
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+
+	return n, nil
+}
+
+func (c *sshTunnelConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	timeout, stop := deadlineTimer(c.writeDeadline)
+	c.mu.Unlock()
+
+	defer stop()
+
+	if timeout == nil {
+		return c.Conn.Write(b)
+	}
+
+	type result struct {
+		n   int
+		err error
+	}
+
+	done := make(chan result, 1)
+
+	go func() {
+		n, err := c.Conn.Write(b)
+		done <- result{n, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.n, r.err
+	case <-timeout:
+		// Closing the tunnel ends the write, b is the caller's again then
+		c.Close()
+		<-done
+		return 0, os.ErrDeadlineExceeded
+	}
+}
+
+func (c *sshTunnelConn) Close() error {
+	var err error
+
+	c.once.Do(func() {
+		close(c.closed)
+		err = c.Conn.Close()
+		c.client.Close()
+	})
+
+	return err
+}
+
+func (c *sshTunnelConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.writeDeadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *sshTunnelConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *sshTunnelConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+// newSSHJumpDialer parses jump as [user@]host[:port]
+func newSSHJumpDialer(jump, keyFile, knownHostsFile string, forward contextDialer) (*sshJumpDialer, error) {
+	user := "root"
+
+	if i := strings.LastIndex(jump, "@"); i >= 0 {
+		user = jump[:i]
+		jump = jump[i+1:]
+	}
+
+	if _, _, err := net.SplitHostPort(jump); err != nil {
+		jump = net.JoinHostPort(jump, "22")
+	}
+
+	key, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("read ssh key: %w", err)
+	}
+
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("parse ssh key: %w", err)
+	}
+
+	// Anyone on the way could pose as the jump host otherwise
+	hostKeyCallback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("load ssh known hosts: %w", err)
+	}
+
+	return &sshJumpDialer{
+		addr: jump,
+		config: &ssh.ClientConfig{
+			User:            user,
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: hostKeyCallback,
+		},
+		forward: forward,
+	}, nil
+}
+
+func (d *sshJumpDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := d.forward.DialContext(ctx, "tcp", d.addr)
+	if err != nil {
+		return nil, fmt.Errorf("connect to ssh jump host %s: %w", d.addr, err)
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	c, chans, reqs, err := ssh.NewClientConn(conn, d.addr, d.config)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("ssh handshake with %s: %w", d.addr, err)
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	client := ssh.NewClient(c, chans, reqs)
+
+	tunnel, err := client.DialContext(ctx, network, addr)
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("open ssh tunnel to %s: %w", addr, err)
+	}
+
+	return newSSHTunnelConn(tunnel, client), nil
+}
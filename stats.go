@@ -0,0 +1,117 @@
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package main
+
+import (
+	"fmt"
+	"maps"
+	"net"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/zhaojh329/rtty-go/proto"
+)
+
+// Stats is a snapshot of the traffic exchanged with the server since start,
+// bytes are counted as they go over the wire, after compression, and of the
+// commands it had run by name.
+type Stats struct {
+	BytesIn    uint64
+	BytesOut   uint64
+	MsgsIn     map[string]uint64
+	MsgsOut    map[string]uint64
+	Reconnects uint64
+	Cmds       map[string]CmdStats
+}
+
+type trafficStats struct {
+	bytesIn    atomic.Uint64
+	bytesOut   atomic.Uint64
+	msgsIn     [256]atomic.Uint64
+	msgsOut    [256]atomic.Uint64
+	reconnects atomic.Uint64
+}
+
+// statsConn counts the bytes read from and written to the server connection
+type statsConn struct {
+	net.Conn
+	stats *trafficStats
+}
+
+func (c *statsConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.stats.bytesIn.Add(uint64(n))
+	return n, err
+}
+
+func (c *statsConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.stats.bytesOut.Add(uint64(n))
+	return n, err
+}
+
+func (cli *RttyClient) Stats() Stats {
+	s := &cli.stats
+
+	stats := Stats{
+		BytesIn:    s.bytesIn.Load(),
+		BytesOut:   s.bytesOut.Load(),
+		MsgsIn:     make(map[string]uint64),
+		MsgsOut:    make(map[string]uint64),
+		Reconnects: s.reconnects.Load(),
+		Cmds:       cli.cmdStats.snapshot(),
+	}
+
+	for typ := range 256 {
+		if n := s.msgsIn[typ].Load(); n > 0 {
+			stats.MsgsIn[proto.MsgTypeName(byte(typ))] = n
+		}
+
+		if n := s.msgsOut[typ].Load(); n > 0 {
+			stats.MsgsOut[proto.MsgTypeName(byte(typ))] = n
+		}
+	}
+
+	return stats
+}
+
+func (s Stats) String() string {
+	var sb strings.Builder
+
+	fmt.Fprintf(&sb, "in %d bytes, out %d bytes, reconnects %d", s.BytesIn, s.BytesOut, s.Reconnects)
+
+	names := make(map[string]bool)
+
+	for name := range s.MsgsIn {
+		names[name] = true
+	}
+
+	for name := range s.MsgsOut {
+		names[name] = true
+	}
+
+	// Message counts as in/out per type
+	for _, name := range slices.Sorted(maps.Keys(names)) {
+		fmt.Fprintf(&sb, ", %s %d/%d", name, s.MsgsIn[name], s.MsgsOut[name])
+	}
+
+	return sb.String()
+}
+
+func (cli *RttyClient) logStats(interval time.Duration) {
+	for range time.Tick(interval) {
+		stats := cli.Stats()
+
+		log.Debug().Msgf("traffic: %s", stats)
+
+		for _, name := range slices.Sorted(maps.Keys(stats.Cmds)) {
+			log.Debug().Msgf("command %s: %s", name, stats.Cmds[name])
+		}
+	}
+}
@@ -9,11 +9,17 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
@@ -21,9 +27,11 @@ import (
 	"unsafe"
 
 	"github.com/creack/pty"
+	"github.com/rs/zerolog/log"
 )
 
 type Terminal struct {
+	backend   string
 	pty       *os.File
 	cmd       *exec.Cmd
 	wait_ack  atomic.Int32
@@ -32,6 +40,8 @@ type Terminal struct {
 	closeOnce sync.Once
 	closed    atomic.Bool
 	waitDone  chan struct{}
+	utmp      *utmpSession
+	killDelay time.Duration
 }
 
 type winsize struct {
@@ -41,6 +51,46 @@ type winsize struct {
 	Ypixel uint16
 }
 
+// wrapCommand runs cmd through wrapper, e.g. tmux new -A -s rtty, with cmd
+// appended to its arguments. Without the wrapper cmd runs as it is.
+func wrapCommand(cmd *exec.Cmd, wrapper []string, jailed bool) *exec.Cmd {
+	path := wrapper[0]
+
+	if !jailed {
+		p, err := exec.LookPath(path)
+		if err != nil {
+			log.Warn().Err(err).Msg("shell wrapper not found, running the shell directly")
+			return cmd
+		}
+		path = p
+	}
+
+	w := exec.Command(path, slices.Concat(wrapper[1:], []string{cmd.Path}, cmd.Args[1:])...)
+	w.Env = cmd.Env
+	w.Dir = cmd.Dir
+	w.SysProcAttr = cmd.SysProcAttr
+
+	return w
+}
+
+// jail confines cmd to root, its working directory is looked up in there
+func jail(cmd *exec.Cmd, root string) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+
+	cmd.SysProcAttr.Chroot = root
+
+	if cmd.Dir == "" {
+		cmd.Dir = "/"
+	} else if st, err := os.Stat(filepath.Join(root, cmd.Dir)); err != nil || !st.IsDir() {
+		cmd.Dir = "/"
+	}
+}
+
+// PATH of login shells given environment variables, which they may extend
+const loginDefaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
 func resolveLoginPath() (string, error) {
 	if p, err := exec.LookPath("login"); err == nil {
 		return p, nil
@@ -56,30 +106,228 @@ func resolveLoginPath() (string, error) {
 	return "", fmt.Errorf("login executable not found")
 }
 
-func NewTerminal(username string) (*Terminal, error) {
-	loginPath, err := resolveLoginPath()
+// usableLogin returns the path of login once it's seen running. A login which
+// is there but can't run, like a link to a busybox without the applet or one
+// missing its libraries, fails with 126 or 127 rather than printing its usage.
+// Checked once, by the first terminal.
+var usableLogin = sync.OnceValues(func() (string, error) {
+	path, err := resolveLoginPath()
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, path, "--help")
+
+	out, err := cmd.CombinedOutput()
+	if ctx.Err() != nil {
+		return "", fmt.Errorf("%s --help didn't exit", path)
+	}
+
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		return "", fmt.Errorf("%s: %w", path, err)
+	}
+
+	if code := cmd.ProcessState.ExitCode(); code == 126 || code == 127 {
+		return "", fmt.Errorf("%s doesn't run: %s", path, strings.TrimSpace(string(out)))
+	}
+
+	return path, nil
+})
+
+// terminalCommand returns the configured shell, or else the first usable one
+// of login, $SHELL and /bin/sh. Without login, the shell of username is
+// started as that user, never as rtty.
+func terminalCommand(cfg *Config, keepEnv bool) (*exec.Cmd, error) {
+	if cfg.runAs != "" {
+		return runAsCommand(cfg, cfg.runAs)
+	}
+
+	if cfg.shell != "" {
+		return exec.Command(cfg.shell, cfg.shellArgs...), nil
+	}
+
+	// The host's login and shells say nothing about the jail
+	if cfg.chroot != "" {
+		return exec.Command("/bin/sh"), nil
+	}
+
+	loginPath, err := usableLogin()
+	if err == nil {
+		var args []string
+		var env []string
+
+		// login clears the environment unless told to preserve it, which
+		// is then only TERM and the variables asked for, not rtty's own.
+		// Some logins leave PATH alone with -p.
+		if keepEnv {
+			args = append(args, "-p")
+			env = []string{"PATH=" + loginDefaultPath}
+		}
+
+		if cfg.username != "" {
+			args = append(args, "-f", cfg.username)
+		}
+
+		cmd := exec.Command(loginPath, args...)
+		cmd.Env = env
+
+		return cmd, nil
+	}
+
+	if cfg.username != "" {
+		log.Warn().Err(err).Msgf("login not usable, starting the shell of %s directly", cfg.username)
+		return runAsCommand(cfg, cfg.username)
+	}
+
+	// The shells below would run as root
+	if cfg.noRoot {
+		return nil, fmt.Errorf("login not usable, no-root forbids a root shell: %w", err)
+	}
+
+	for _, shell := range []string{os.Getenv("SHELL"), "/bin/sh"} {
+		if shell == "" {
+			continue
+		}
+
+		if p, err := exec.LookPath(shell); err == nil {
+			return exec.Command(p), nil
+		}
+	}
+
+	return nil, fmt.Errorf("neither login nor a shell found")
+}
+
+// runAsCommand starts the shell as username, of run-as or else of -f when
+// login isn't usable, switching to it directly instead of through login, so
+// that no terminal runs as root.
+func runAsCommand(cfg *Config, username string) (*exec.Cmd, error) {
+	u, err := user.Lookup(username)
 	if err != nil {
 		return nil, err
 	}
 
-	var cmd *exec.Cmd
-	if username != "" {
-		cmd = exec.Command(loginPath, "-f", username)
-	} else {
-		cmd = exec.Command(loginPath)
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid uid of %s: %s", u.Username, u.Uid)
 	}
 
-	ptmx, err := pty.Start(cmd)
+	if uid == 0 && cfg.noRoot {
+		return nil, fmt.Errorf("%s is root, which no-root forbids", u.Username)
+	}
+
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid gid of %s: %s", u.Username, u.Gid)
+	}
+
+	var groups []uint32
+
+	if ids, err := u.GroupIds(); err == nil {
+		for _, id := range ids {
+			if g, err := strconv.ParseUint(id, 10, 32); err == nil {
+				groups = append(groups, uint32(g))
+			}
+		}
+	}
+
+	shell := cfg.shell
+	if shell == "" {
+		shell = loginShell(u.Username)
+	}
+
+	cmd := exec.Command(shell, cfg.shellArgs...)
+
+	// Started as a login shell, like login does, unless configured otherwise
+	if cfg.shell == "" {
+		cmd.Args[0] = "-" + filepath.Base(shell)
+	}
+
+	cmd.Env = append(os.Environ(),
+		"HOME="+u.HomeDir,
+		"USER="+u.Username,
+		"LOGNAME="+u.Username,
+		"SHELL="+shell,
+	)
+
+	// login falls back to / as well
+	cmd.Dir = "/"
+
+	if st, err := os.Stat(u.HomeDir); err == nil && st.IsDir() {
+		cmd.Dir = u.HomeDir
+	}
+
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Credential: &syscall.Credential{
+			Uid:    uint32(uid),
+			Gid:    uint32(gid),
+			Groups: groups,
+		},
+	}
+
+	return cmd, nil
+}
+
+// loginShell returns the shell of username in /etc/passwd, or /bin/sh
+func loginShell(username string) string {
+	data, err := os.ReadFile("/etc/passwd")
+	if err != nil {
+		return "/bin/sh"
+	}
+
+	for line := range strings.SplitSeq(string(data), "\n") {
+		fields := strings.Split(line, ":")
+		if len(fields) == 7 && fields[0] == username && fields[6] != "" {
+			return fields[6]
+		}
+	}
+
+	return "/bin/sh"
+}
+
+// NewTerminal starts the shell with TERM and env added to the environment,
+// later entries of env override earlier ones. login keeps TERM in any case.
+func NewTerminal(cfg *Config, env []string) (*Terminal, error) {
+	if cfg.serial != "" {
+		return newSerialTerminal(cfg)
+	}
+
+	cmd, err := terminalCommand(cfg, len(env) > 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.shellWrapper != "" {
+		cmd = wrapCommand(cmd, strings.Fields(cfg.shellWrapper), cfg.chroot != "")
+	}
+
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+
+	cmd.Env = append(cmd.Env, "TERM="+cfg.term)
+	cmd.Env = append(cmd.Env, env...)
+
+	if cfg.chroot != "" {
+		jail(cmd, cfg.chroot)
+	}
+
+	ptmx, err := pty.StartWithSize(cmd, &pty.Winsize{Cols: cfg.termCols, Rows: cfg.termRows})
 	if err != nil {
 		return nil, err
 	}
 
 	t := &Terminal{
+		backend:   cmd.Path,
 		pty:       ptmx,
 		cmd:       cmd,
-		ack_block: 4096,
+		ack_block: int32(cfg.termAckWindow) * 1024,
 		cond:      sync.NewCond(&sync.Mutex{}),
 		waitDone:  make(chan struct{}),
+		killDelay: time.Duration(cfg.termKillDelay) * time.Second,
 	}
 
 	go func() {
@@ -87,6 +335,14 @@ func NewTerminal(username string) (*Terminal, error) {
 		close(t.waitDone)
 	}()
 
+	// login takes care of it itself
+	if cfg.utmp && filepath.Base(cmd.Path) != "login" {
+		t.utmp, err = utmpLogin(ptmx, cmd.Process.Pid)
+		if err != nil {
+			log.Warn().Err(err).Msg("failed to register terminal in utmp")
+		}
+	}
+
 	return t, nil
 }
 
@@ -115,7 +371,7 @@ func (t *Terminal) Read(buf []byte) (int, error) {
 		}
 
 		// util-linux login briefly drops the PTY slave while reattaching the session.
-		if errors.Is(err, syscall.EIO) || errors.Is(err, io.EOF) {
+		if t.cmd != nil && (errors.Is(err, syscall.EIO) || errors.Is(err, io.EOF)) {
 			time.Sleep(10 * time.Millisecond)
 			continue
 		}
@@ -124,11 +380,24 @@ func (t *Terminal) Read(buf []byte) (int, error) {
 	}
 }
 
+// Pid returns 0 for a serial port
+func (t *Terminal) Pid() int {
+	if t.cmd == nil {
+		return 0
+	}
+	return t.cmd.Process.Pid
+}
+
 func (t *Terminal) Write(data []byte) (int, error) {
 	return t.pty.Write(data)
 }
 
 func (t *Terminal) SetWinSize(cols, rows uint16) error {
+	// Nothing tells the other end of a serial port
+	if t.cmd == nil {
+		return nil
+	}
+
 	ws := &winsize{
 		Row: rows,
 		Col: cols,
@@ -147,26 +416,60 @@ func (t *Terminal) SetWinSize(cols, rows uint16) error {
 	return nil
 }
 
+// Close hangs up the shell, giving it killDelay to save its history and run
+// its traps before it's killed along with whatever it left running. It
+// doesn't wait for the shell to exit.
 func (t *Terminal) Close() error {
 	t.closeOnce.Do(func() {
 		t.closed.Store(true)
 		t.wait_ack.Store(0)
 		t.cond.Signal()
 
-		if t.pty != nil {
+		if t.cmd == nil {
 			_ = t.pty.Close()
+			close(t.waitDone)
+			return
 		}
 
-		if t.cmd.Process != nil {
-			_ = t.cmd.Process.Kill()
+		// The shell leads a session of its own, see pty.Start
+		pid := t.cmd.Process.Pid
+
+		// Like a terminal emulator does when its window is closed. Not
+		// SIGTERM, interactive shells ignore it and scripts die before
+		// their SIGHUP trap runs.
+		if t.killDelay > 0 {
+			_ = syscall.Kill(-pid, syscall.SIGHUP)
 		}
 
-		<-t.waitDone
+		if t.pty != nil {
+			_ = t.pty.Close()
+		}
+
+		go func() {
+			select {
+			case <-t.waitDone:
+			case <-time.After(t.killDelay):
+			}
+
+			// Background jobs, nohup and the like included
+			killSession(pid)
+
+			<-t.waitDone
+
+			if err := t.utmp.logout(); err != nil {
+				log.Warn().Err(err).Msg("failed to unregister terminal from utmp")
+			}
+		}()
 	})
 
 	return nil
 }
 
+func (t *Terminal) ResetAck() {
+	t.wait_ack.Store(0)
+	t.cond.Signal()
+}
+
 func (t *Terminal) Ack(n uint16) {
 	t.wait_ack.Add(-int32(n))
 	t.cond.Signal()
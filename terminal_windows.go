@@ -10,13 +10,18 @@ package main
 
 import (
 	"context"
+	"os"
+	"slices"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 
-	conpty "github.com/qsocket/conpty-go"
+	"github.com/zhaojh329/rtty-go/conpty"
 )
 
 type Terminal struct {
+	backend   string
 	pty       *conpty.ConPty
 	wait_ack  atomic.Int32
 	cond      *sync.Cond
@@ -24,15 +29,60 @@ type Terminal struct {
 	closeOnce sync.Once
 }
 
-func NewTerminal(username string) (*Terminal, error) {
-	pty, err := conpty.Start("cmd.exe")
+// Well known shells which may be given by name
+var windowsShells = map[string][]string{
+	"cmd":        {"cmd.exe"},
+	"powershell": {"powershell.exe", "-NoLogo"},
+	"pwsh":       {"pwsh.exe", "-NoLogo"},
+}
+
+// shellCommandLine builds the command line of the shell. Without shell-args,
+// shell is taken as a complete command line, quoted the way Windows expects.
+func shellCommandLine(cfg *Config) string {
+	if cfg.shell == "" {
+		return "cmd.exe"
+	}
+
+	args, ok := windowsShells[strings.ToLower(cfg.shell)]
+	if !ok {
+		if len(cfg.shellArgs) == 0 {
+			return cfg.shell
+		}
+		args = []string{cfg.shell}
+	}
+
+	args = append(slices.Clone(args), cfg.shellArgs...)
+
+	for i, arg := range args {
+		args[i] = syscall.EscapeArg(arg)
+	}
+
+	return strings.Join(args, " ")
+}
+
+// NewTerminal starts the shell with TERM and env added to the environment,
+// later entries of env override earlier ones.
+func NewTerminal(cfg *Config, env []string) (*Terminal, error) {
+	opts := []conpty.ConPtyOption{
+		conpty.ConPtyDimensions(int(cfg.termCols), int(cfg.termRows)),
+	}
+
+	cmdline := shellCommandLine(cfg)
+
+	// Windows programs don't care, but ports of Unix ones like Git Bash do
+	env = append([]string{"TERM=" + cfg.term}, env...)
+
+	opts = append(opts, conpty.ConPtyEnv(mergeEnv(os.Environ(), env)))
+
+	pty, err := conpty.Start(cmdline, opts...)
 	if err != nil {
 		return nil, err
 	}
 
 	t := &Terminal{
+		backend:   cmdline,
 		pty:       pty,
-		ack_block: 4096,
+		ack_block: int32(cfg.termAckWindow) * 1024,
 		cond:      sync.NewCond(&sync.Mutex{}),
 	}
 
@@ -45,6 +95,47 @@ func NewTerminal(username string) (*Terminal, error) {
 
 }
 
+// mergeEnv appends extra to base, dropping the variables of base that extra
+// sets. Windows treats the names case-insensitively.
+func mergeEnv(base, extra []string) []string {
+	names := make(map[string]bool)
+
+	for _, kv := range extra {
+		name, _, _ := strings.Cut(kv, "=")
+		names[strings.ToUpper(name)] = true
+	}
+
+	env := make([]string, 0, len(base)+len(extra))
+
+	for _, kv := range base {
+		name, _, _ := strings.Cut(kv, "=")
+		if !names[strings.ToUpper(name)] {
+			env = append(env, kv)
+		}
+	}
+
+	// Later entries win, like os/exec does
+	seen := make(map[string]int)
+
+	for _, kv := range extra {
+		name, _, _ := strings.Cut(kv, "=")
+
+		if i, ok := seen[strings.ToUpper(name)]; ok {
+			env[i] = kv
+			continue
+		}
+
+		seen[strings.ToUpper(name)] = len(env)
+		env = append(env, kv)
+	}
+
+	return env
+}
+
+func (t *Terminal) Pid() int {
+	return t.pty.Pid()
+}
+
 func (t *Terminal) Read(buf []byte) (int, error) {
 	return t.pty.Read(buf)
 }
@@ -66,6 +157,11 @@ func (t *Terminal) Close() error {
 	return nil
 }
 
+func (t *Terminal) ResetAck() {
+	t.wait_ack.Store(0)
+	t.cond.Signal()
+}
+
 func (t *Terminal) Ack(n uint16) {
 	t.wait_ack.Add(-int32(n))
 	t.cond.Signal()
@@ -0,0 +1,219 @@
+//go:build !windows
+// +build !windows
+
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/tls"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"strconv"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport/linuxtpm"
+)
+
+// tpmSigner signs with a key that never leaves the TPM. The device is only
+// opened for the duration of each operation, so nothing is held across reconnects.
+type tpmSigner struct {
+	device string
+	handle tpm2.TPMHandle
+	name   tpm2.TPM2BName
+	pub    crypto.PublicKey
+}
+
+// loadTPMKeyPair pairs the PEM certificate chain in certFile with the TPM key
+// at the given persistent handle, e.g. "0x81000001".
+func loadTPMKeyPair(certFile, device, handle string) (tls.Certificate, error) {
+	var cert tls.Certificate
+
+	h, err := strconv.ParseUint(handle, 0, 32)
+	if err != nil {
+		return cert, fmt.Errorf("invalid tpm key handle '%s'", handle)
+	}
+
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		return cert, err
+	}
+
+	for {
+		var block *pem.Block
+
+		block, certPEM = pem.Decode(certPEM)
+		if block == nil {
+			break
+		}
+
+		if block.Type == "CERTIFICATE" {
+			cert.Certificate = append(cert.Certificate, block.Bytes)
+		}
+	}
+
+	if len(cert.Certificate) == 0 {
+		return cert, fmt.Errorf("no certificate found in %s", certFile)
+	}
+
+	t, err := linuxtpm.Open(device)
+	if err != nil {
+		return cert, fmt.Errorf("open tpm %s: %w", device, err)
+	}
+	defer t.Close()
+
+	rsp, err := tpm2.ReadPublic{ObjectHandle: tpm2.TPMHandle(h)}.Execute(t)
+	if err != nil {
+		return cert, fmt.Errorf("read tpm key 0x%x: %w", h, err)
+	}
+
+	pub, err := rsp.OutPublic.Contents()
+	if err != nil {
+		return cert, err
+	}
+
+	signer := &tpmSigner{
+		device: device,
+		handle: tpm2.TPMHandle(h),
+		name:   rsp.Name,
+	}
+
+	switch pub.Type {
+	case tpm2.TPMAlgRSA:
+		detail, err := pub.Parameters.RSADetail()
+		if err != nil {
+			return cert, err
+		}
+
+		unique, err := pub.Unique.RSA()
+		if err != nil {
+			return cert, err
+		}
+
+		signer.pub, err = tpm2.RSAPub(detail, unique)
+		if err != nil {
+			return cert, err
+		}
+
+	case tpm2.TPMAlgECC:
+		detail, err := pub.Parameters.ECCDetail()
+		if err != nil {
+			return cert, err
+		}
+
+		unique, err := pub.Unique.ECC()
+		if err != nil {
+			return cert, err
+		}
+
+		signer.pub, err = tpm2.ECDSAPub(detail, unique)
+		if err != nil {
+			return cert, err
+		}
+
+	default:
+		return cert, fmt.Errorf("unsupported tpm key type: 0x%x", pub.Type)
+	}
+
+	cert.PrivateKey = signer
+
+	return cert, nil
+}
+
+func (s *tpmSigner) Public() crypto.PublicKey {
+	return s.pub
+}
+
+func (s *tpmSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	var hashAlg tpm2.TPMIAlgHash
+
+	switch opts.HashFunc() {
+	case crypto.SHA1:
+		hashAlg = tpm2.TPMAlgSHA1
+	case crypto.SHA256:
+		hashAlg = tpm2.TPMAlgSHA256
+	case crypto.SHA384:
+		hashAlg = tpm2.TPMAlgSHA384
+	case crypto.SHA512:
+		hashAlg = tpm2.TPMAlgSHA512
+	default:
+		return nil, fmt.Errorf("unsupported hash: %v", opts.HashFunc())
+	}
+
+	var alg tpm2.TPMIAlgSigScheme
+
+	switch s.pub.(type) {
+	case *rsa.PublicKey:
+		alg = tpm2.TPMAlgRSASSA
+		if _, ok := opts.(*rsa.PSSOptions); ok {
+			alg = tpm2.TPMAlgRSAPSS
+		}
+	case *ecdsa.PublicKey:
+		alg = tpm2.TPMAlgECDSA
+	}
+
+	t, err := linuxtpm.Open(s.device)
+	if err != nil {
+		return nil, fmt.Errorf("open tpm %s: %w", s.device, err)
+	}
+	defer t.Close()
+
+	rsp, err := tpm2.Sign{
+		KeyHandle: tpm2.AuthHandle{
+			Handle: s.handle,
+			Name:   s.name,
+			Auth:   tpm2.PasswordAuth(nil),
+		},
+		Digest: tpm2.TPM2BDigest{Buffer: digest},
+		InScheme: tpm2.TPMTSigScheme{
+			Scheme:  alg,
+			Details: tpm2.NewTPMUSigScheme(alg, &tpm2.TPMSSchemeHash{HashAlg: hashAlg}),
+		},
+		Validation: tpm2.TPMTTKHashCheck{
+			Tag:       tpm2.TPMSTHashCheck,
+			Hierarchy: tpm2.TPMRHNull,
+		},
+	}.Execute(t)
+	if err != nil {
+		return nil, fmt.Errorf("tpm sign: %w", err)
+	}
+
+	switch alg {
+	case tpm2.TPMAlgRSASSA:
+		sig, err := rsp.Signature.Signature.RSASSA()
+		if err != nil {
+			return nil, err
+		}
+		return sig.Sig.Buffer, nil
+
+	case tpm2.TPMAlgRSAPSS:
+		sig, err := rsp.Signature.Signature.RSAPSS()
+		if err != nil {
+			return nil, err
+		}
+		return sig.Sig.Buffer, nil
+
+	default:
+		sig, err := rsp.Signature.Signature.ECDSA()
+		if err != nil {
+			return nil, err
+		}
+
+		return asn1.Marshal(struct {
+			R, S *big.Int
+		}{
+			new(big.Int).SetBytes(sig.SignatureR.Buffer),
+			new(big.Int).SetBytes(sig.SignatureS.Buffer),
+		})
+	}
+}
@@ -0,0 +1,18 @@
+//go:build windows
+// +build windows
+
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+)
+
+func loadTPMKeyPair(certFile, device, handle string) (tls.Certificate, error) {
+	return tls.Certificate{}, fmt.Errorf("not supported on Windows")
+}
@@ -0,0 +1,445 @@
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/proxy"
+	"golang.org/x/time/rate"
+)
+
+type contextDialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+const unixHostPrefix = "unix://"
+
+// unixDialer connects to the unix socket at its path whatever address is asked for
+type unixDialer string
+
+func (d unixDialer) DialContext(ctx context.Context, _, _ string) (net.Conn, error) {
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "unix", string(d))
+}
+
+// isSRVName reports whether host is a DNS SRV name such as _rtty._tcp.example.com
+func isSRVName(host string) bool {
+	return strings.HasPrefix(host, "_")
+}
+
+// lookupSRV resolves name to a list of host:port, ordered by priority and
+// randomized by weight within the same priority as described in RFC 2782.
+func lookupSRV(resolver *net.Resolver, name string) ([]string, error) {
+	_, records, err := resolver.LookupSRV(context.Background(), "", "", name)
+	if err != nil {
+		return nil, fmt.Errorf("lookup SRV %s: %w", name, err)
+	}
+
+	addrs := make([]string, 0, len(records))
+
+	for _, r := range records {
+		// A single "." target means the service is decidedly not available
+		if r.Target == "." {
+			continue
+		}
+
+		target := strings.TrimSuffix(r.Target, ".")
+		addrs = append(addrs, net.JoinHostPort(target, strconv.Itoa(int(r.Port))))
+	}
+
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no server found in SRV %s", name)
+	}
+
+	return addrs, nil
+}
+
+func (cli *RttyClient) dialer(resolver *net.Resolver) (contextDialer, error) {
+	cfg := cli.cfg
+
+	dialer, err := cli.proxyDialer(resolver)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.sshJump != "" {
+		return newSSHJumpDialer(cfg.sshJump, cfg.sshKey, cfg.sshKnownHosts, dialer)
+	}
+
+	return dialer, nil
+}
+
+// uplink returns the interface the server connection is bound to, if any
+func (cli *RttyClient) uplink() string {
+	if cli.onBackup {
+		return cli.cfg.backupInterface
+	}
+	return cli.cfg.bindInterface
+}
+
+func (cli *RttyClient) proxyDialer(resolver *net.Resolver) (contextDialer, error) {
+	netDialer := &net.Dialer{
+		Resolver: resolver,
+		KeepAliveConfig: net.KeepAliveConfig{
+			Enable:   true,
+			Idle:     time.Duration(cli.cfg.keepaliveIdle) * time.Second,
+			Interval: time.Duration(cli.cfg.keepaliveInterval) * time.Second,
+			Count:    int(cli.cfg.keepaliveCount),
+		},
+		FallbackDelay: time.Duration(cli.cfg.happyEyeballsDelay) * time.Millisecond,
+	}
+
+	// Go races the other address family after FallbackDelay, 300ms when 0,
+	// which a negative one disables
+	if cli.cfg.happyEyeballsDelay == 0 {
+		netDialer.FallbackDelay = -1
+	}
+
+	if iface := cli.uplink(); iface != "" {
+		if err := bindToInterface(netDialer, iface); err != nil {
+			return nil, fmt.Errorf("bind to interface %s: %w", iface, err)
+		}
+	}
+
+	if cli.cfg.bindAddress != "" && !cli.onBackup {
+		netDialer.LocalAddr = &net.TCPAddr{IP: net.ParseIP(cli.cfg.bindAddress)}
+	}
+
+	if cli.cfg.proxy != "" {
+		u, err := url.Parse(cli.cfg.proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy: %w", err)
+		}
+
+		return newProxyDialer(u, netDialer)
+	}
+
+	if cli.cfg.autoProxy {
+		scheme := "http"
+		if cli.cfg.ssl || cli.cfg.transport == "wss" {
+			scheme = "https"
+		}
+
+		return newEnvProxyDialer(scheme, netDialer), nil
+	}
+
+	return netDialer, nil
+}
+
+func newProxyDialer(u *url.URL, forward *net.Dialer) (contextDialer, error) {
+	if u.Scheme == "http" {
+		return &httpProxyDialer{proxy: u, forward: forward}, nil
+	}
+
+	// socks5 and socks5h, with optional username/password authentication
+	dialer, err := proxy.FromURL(u, forward)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy: %w", err)
+	}
+
+	return dialer.(proxy.ContextDialer), nil
+}
+
+// envProxyDialer picks the proxy for each address from HTTP_PROXY, HTTPS_PROXY,
+// ALL_PROXY and NO_PROXY, like other programs on the same machine do.
+type envProxyDialer struct {
+	scheme  string
+	proxies []func(*url.URL) (*url.URL, error)
+	forward *net.Dialer
+}
+
+func newEnvProxyDialer(scheme string, forward *net.Dialer) *envProxyDialer {
+	env := httpproxy.FromEnvironment()
+
+	all := os.Getenv("ALL_PROXY")
+	if all == "" {
+		all = os.Getenv("all_proxy")
+	}
+
+	// HTTP_PROXY and HTTPS_PROXY take precedence, ALL_PROXY is usually a socks proxy
+	fallback := &httpproxy.Config{
+		HTTPProxy:  all,
+		HTTPSProxy: all,
+		NoProxy:    env.NoProxy,
+	}
+
+	return &envProxyDialer{
+		scheme:  scheme,
+		proxies: []func(*url.URL) (*url.URL, error){env.ProxyFunc(), fallback.ProxyFunc()},
+		forward: forward,
+	}
+}
+
+func (d *envProxyDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	for _, proxyFunc := range d.proxies {
+		u, err := proxyFunc(&url.URL{Scheme: d.scheme, Host: addr})
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy from environment: %w", err)
+		}
+
+		if u == nil {
+			continue
+		}
+
+		log.Debug().Msgf("connect to %s through proxy %s", addr, u.Redacted())
+
+		dialer, err := newProxyDialer(u, d.forward)
+		if err != nil {
+			return nil, err
+		}
+
+		return dialer.DialContext(ctx, network, addr)
+	}
+
+	return d.forward.DialContext(ctx, network, addr)
+}
+
+func tlsHandshake(ctx context.Context, conn net.Conn, host string, tlsConfig *tls.Config) (net.Conn, error) {
+	if tlsConfig.ServerName == "" {
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ServerName = host
+	}
+
+	tlsConn := tls.Client(conn, tlsConfig)
+
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return tlsConn, nil
+}
+
+func dialWebsocket(ctx context.Context, dialer contextDialer, addr, transport, path string, tlsConfig *tls.Config) (net.Conn, error) {
+	u := url.URL{
+		Scheme: transport,
+		Host:   addr,
+		Path:   path,
+	}
+
+	opts := &websocket.DialOptions{
+		HTTPClient: &http.Client{
+			Transport: &http.Transport{
+				DialContext:     dialer.DialContext,
+				TLSClientConfig: tlsConfig,
+			},
+		},
+	}
+
+	c, _, err := websocket.Dial(ctx, u.String(), opts)
+	if err != nil {
+		return nil, fmt.Errorf("websocket handshake: %w", err)
+	}
+
+	// A WebSocket message may carry several rtty messages and is streamed
+	// through, each rtty message is bounded as it's parsed
+	c.SetReadLimit(-1)
+
+	return websocket.NetConn(context.Background(), c, websocket.MessageBinary), nil
+}
+
+// httpProxyDialer establishes a tunnel through an HTTP proxy with the CONNECT method
+type httpProxyDialer struct {
+	proxy   *url.URL
+	forward contextDialer
+}
+
+func (d *httpProxyDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	proxyAddr := d.proxy.Host
+	if d.proxy.Port() == "" {
+		proxyAddr = net.JoinHostPort(proxyAddr, "80")
+	}
+
+	conn, err := d.forward.DialContext(ctx, network, proxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("connect to proxy %s: %w", proxyAddr, err)
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+
+	if user := d.proxy.User; user != nil {
+		password, _ := user.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("send CONNECT request to proxy: %w", err)
+	}
+
+	br := bufio.NewReader(conn)
+
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("read CONNECT response from proxy: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy refused CONNECT: %s", resp.Status)
+	}
+
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, br: br}, nil
+	}
+
+	return conn, nil
+}
+
+// bufferedConn keeps the bytes the proxy sent right after its response
+type bufferedConn struct {
+	net.Conn
+	br *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.br.Read(b)
+}
+
+// throttledConn limits the throughput of the server connection in each direction
+type throttledConn struct {
+	net.Conn
+	rlimiter *rate.Limiter
+	wlimiter *rate.Limiter
+	wtimeout atomic.Int64 // of the last write deadline, 0 when none or past
+}
+
+// newThrottledConn returns conn unchanged when neither rate(KB/s) is limited
+func newThrottledConn(conn net.Conn, upload, download uint) net.Conn {
+	if upload == 0 && download == 0 {
+		return conn
+	}
+
+	c := &throttledConn{Conn: conn}
+
+	if upload > 0 {
+		c.wlimiter = newRateLimiter(upload)
+	}
+
+	if download > 0 {
+		c.rlimiter = newRateLimiter(download)
+	}
+
+	return c
+}
+
+func (c *throttledConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 && c.rlimiter != nil {
+		waitRate(c.rlimiter, n)
+	}
+	return n, err
+}
+
+// Write waits for the rate before each burst of b, the write deadline then
+// counts from the end of the wait, so that throttling alone can't look like
+// a stalled connection
+func (c *throttledConn) Write(b []byte) (int, error) {
+	if c.wlimiter == nil {
+		return c.Conn.Write(b)
+	}
+
+	var written int
+
+	for len(b) > 0 {
+		chunk := b[:min(len(b), c.wlimiter.Burst())]
+
+		waitRate(c.wlimiter, len(chunk))
+
+		if d := c.wtimeout.Load(); d > 0 {
+			c.Conn.SetWriteDeadline(time.Now().Add(time.Duration(d)))
+		}
+
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+
+		b = b[n:]
+	}
+
+	return written, nil
+}
+
+func (c *throttledConn) SetDeadline(t time.Time) error {
+	c.setWriteTimeout(t)
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *throttledConn) SetWriteDeadline(t time.Time) error {
+	c.setWriteTimeout(t)
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// setWriteTimeout keeps how far away the write deadline t is, for Write to
+// set it again after each wait
+func (c *throttledConn) setWriteTimeout(t time.Time) {
+	var d time.Duration
+
+	if !t.IsZero() {
+		d = max(time.Until(t), 0)
+	}
+
+	c.wtimeout.Store(int64(d))
+}
+
+// newRateLimiter allows kbps KB per second with bursts of up to one second
+func newRateLimiter(kbps uint) *rate.Limiter {
+	bps := int(kbps) * 1024
+	return rate.NewLimiter(rate.Limit(bps), bps)
+}
+
+// reserveRate returns how long to wait before n bytes may pass, n may exceed
+// the burst of l
+func reserveRate(l *rate.Limiter, n int) time.Duration {
+	var delay time.Duration
+
+	for n > 0 {
+		chunk := min(n, l.Burst())
+		delay = l.ReserveN(time.Now(), chunk).Delay()
+		n -= chunk
+	}
+
+	return delay
+}
+
+// waitRate blocks until n bytes may pass, n may exceed the burst of l
+func waitRate(l *rate.Limiter, n int) {
+	for n > 0 {
+		chunk := min(n, l.Burst())
+		l.WaitN(context.Background(), chunk)
+		n -= chunk
+	}
+}
@@ -10,8 +10,10 @@ import (
 	"os"
 )
 
+// FileExists reports whether anything is at filename, a symbolic link counts
+// even when it points nowhere
 func FileExists(filename string) bool {
-	_, err := os.Stat(filename)
+	_, err := os.Lstat(filename)
 	return err == nil || !os.IsNotExist(err)
 }
 
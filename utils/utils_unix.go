@@ -94,3 +94,23 @@ func GetCwdByPid(pid uint32) (string, error) {
 
 	return cwd, nil
 }
+
+// GetEnvByPid returns the environment the process was started with
+func GetEnvByPid(pid uint32) (map[string]string, error) {
+	name := fmt.Sprintf("/proc/%d/environ", pid)
+
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", name, err)
+	}
+
+	env := make(map[string]string)
+
+	for _, kv := range strings.Split(string(data), "\x00") {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			env[k] = v
+		}
+	}
+
+	return env, nil
+}
@@ -10,10 +10,21 @@ package utils
 
 import (
 	"fmt"
+
+	"github.com/shirou/gopsutil/v3/disk"
 )
 
 func CheckSpaceAvailable(savePath string, totalSize uint64) error {
-	return fmt.Errorf("not supported on Windows")
+	usage, err := disk.Usage(savePath)
+	if err != nil {
+		return err
+	}
+
+	if usage.Free < totalSize {
+		return fmt.Errorf("no enough space: need %d bytes, available %d bytes", totalSize, usage.Free)
+	}
+
+	return nil
 }
 
 func GetUidByPid(pid uint32) (uint32, error) {
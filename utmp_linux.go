@@ -0,0 +1,230 @@
+//go:build linux
+// +build linux
+
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	utmpFile    = "/var/run/utmp"
+	wtmpFile    = "/var/log/wtmp"
+	lastlogFile = "/var/log/lastlog"
+
+	utmpUserProcess = 7
+	utmpDeadProcess = 8
+
+	// What who and last show as the remote host
+	utmpHost = "rtty"
+)
+
+// utmpRecord is struct utmp of glibc, which is the same on 32 and 64 bit
+type utmpRecord struct {
+	Type    int16
+	_       int16
+	Pid     int32
+	Line    [32]byte
+	ID      [4]byte
+	User    [32]byte
+	Host    [256]byte
+	Exit    [2]int16
+	Session int32
+	Sec     int32
+	Usec    int32
+	AddrV6  [4]int32
+	_       [20]byte
+}
+
+type lastlogRecord struct {
+	Time int32
+	Line [32]byte
+	Host [256]byte
+}
+
+// utmpSession shows a terminal in who, w and last like sshd does. The files
+// are only written if they exist, musl based systems usually have none.
+type utmpSession struct {
+	line string
+	pid  int
+}
+
+func utmpLogin(pty *os.File, pid int) (*utmpSession, error) {
+	var n uint32
+
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, pty.Fd(), syscall.TIOCGPTN, uintptr(unsafe.Pointer(&n)))
+	if errno != 0 {
+		return nil, errno
+	}
+
+	u, err := user.Current()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &utmpSession{line: "pts/" + strconv.Itoa(int(n)), pid: pid}
+
+	r := s.record(utmpUserProcess, u.Username)
+
+	if err := updateUtmp(r); err != nil {
+		return nil, err
+	}
+
+	if err := appendWtmp(r); err != nil {
+		return nil, err
+	}
+
+	if uid, err := strconv.Atoi(u.Uid); err == nil {
+		if err := updateLastlog(uid, r); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+func (s *utmpSession) logout() error {
+	if s == nil {
+		return nil
+	}
+
+	r := s.record(utmpDeadProcess, "")
+
+	return errors.Join(updateUtmp(r), appendWtmp(r))
+}
+
+func (s *utmpSession) record(typ int16, username string) *utmpRecord {
+	now := time.Now()
+
+	r := &utmpRecord{
+		Type: typ,
+		Pid:  int32(s.pid),
+		Sec:  int32(now.Unix()),
+		Usec: int32(now.Nanosecond() / 1000),
+	}
+
+	id := strings.TrimPrefix(s.line, "pts/")
+	if len(id) > len(r.ID) {
+		id = id[len(id)-len(r.ID):]
+	}
+
+	copy(r.Line[:], s.line)
+	copy(r.ID[:], id)
+	copy(r.User[:], username)
+
+	if typ == utmpUserProcess {
+		copy(r.Host[:], utmpHost)
+	}
+
+	return r
+}
+
+// openLocked opens an existing file and locks it against other writers
+func openLocked(name string, flag int) (*os.File, error) {
+	f, err := os.OpenFile(name, flag, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// updateUtmp overwrites the entry of the same terminal, or takes the first
+// free one, or else appends
+func updateUtmp(r *utmpRecord) error {
+	f, err := openLocked(utmpFile, os.O_RDWR)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("open %s: %w", utmpFile, err)
+	}
+	defer f.Close()
+
+	size := int64(binary.Size(r))
+	slot := int64(-1)
+
+	var e utmpRecord
+
+	for off := int64(0); ; off += size {
+		if err := binary.Read(f, binary.NativeEndian, &e); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				if slot < 0 {
+					slot = off
+				}
+				break
+			}
+			return err
+		}
+
+		if e.ID == r.ID && (e.Type == utmpUserProcess || e.Type == utmpDeadProcess) {
+			slot = off
+			break
+		}
+
+		if slot < 0 && e.Type == 0 {
+			slot = off
+		}
+	}
+
+	if _, err := f.Seek(slot, io.SeekStart); err != nil {
+		return err
+	}
+
+	return binary.Write(f, binary.NativeEndian, r)
+}
+
+func appendWtmp(r *utmpRecord) error {
+	f, err := openLocked(wtmpFile, os.O_WRONLY|os.O_APPEND)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("open %s: %w", wtmpFile, err)
+	}
+	defer f.Close()
+
+	return binary.Write(f, binary.NativeEndian, r)
+}
+
+// updateLastlog records the login at the slot of the user's uid
+func updateLastlog(uid int, r *utmpRecord) error {
+	f, err := openLocked(lastlogFile, os.O_WRONLY)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("open %s: %w", lastlogFile, err)
+	}
+	defer f.Close()
+
+	ll := lastlogRecord{Time: r.Sec, Line: r.Line}
+
+	copy(ll.Host[:], utmpHost)
+
+	if _, err := f.Seek(int64(uid)*int64(binary.Size(ll)), io.SeekStart); err != nil {
+		return err
+	}
+
+	return binary.Write(f, binary.NativeEndian, &ll)
+}
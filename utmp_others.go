@@ -0,0 +1,24 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+type utmpSession struct{}
+
+func utmpLogin(pty *os.File, pid int) (*utmpSession, error) {
+	return nil, fmt.Errorf("not supported on this platform")
+}
+
+func (s *utmpSession) logout() error {
+	return nil
+}